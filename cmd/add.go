@@ -1,97 +1,262 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
-	"strings"
-	"syscall"
 
 	"github.com/ignorantshr/mgit/model"
 	"github.com/ignorantshr/mgit/util"
 	"github.com/spf13/cobra"
 )
 
+var (
+	_addIntentToAdd bool
+	_addPatch       bool
+)
+
 func init() {
+	addCmd.Flags().BoolVarP(&_addIntentToAdd, "intent-to-add", "N", false, "record only the fact that the path will be added later")
+	addCmd.Flags().BoolVarP(&_addPatch, "patch", "p", false, "interactively choose hunks of patch between the index and the work tree")
+	addCmd.MarkFlagsMutuallyExclusive("intent-to-add", "patch")
 	rootCmd.AddCommand(addCmd)
 }
 
 var addCmd = &cobra.Command{
-	Use:   "add <path ...>",
+	Use:   "add [-N | -p] <path ...>",
 	Short: "Add files contents to the index.",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		add(repo, args)
+	Args: func(cmd *cobra.Command, args []string) error {
+		// -p 不指定路径时处理所有文件
+		if _addPatch {
+			return nil
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		switch {
+		case _addPatch:
+			return addPatch(repo, args)
+		case _addIntentToAdd:
+			return addIntentToAdd(repo, args)
+		}
+		return add(repo, args)
 	},
 }
 
-// 删除新增或修改的旧条目，然后重写 index 文件
-func add(repo *model.Repository, paths []string) {
-	pathSet := expandPaths(repo, nil, paths)
+// 删除新增或修改的旧条目，然后重写 index 文件。
+// 冲突的路径会删除所有 stage，再以 stage 0 加入，即标记为已解决
+func add(repo *model.Repository, paths []string) error {
+	pathSet, err := expandPaths(repo, nil, paths)
+	if err != nil {
+		return err
+	}
 	addedPath := []string{}
 
 	for k := range pathSet {
 		addedPath = append(addedPath, k)
 	}
 
-	rm(repo, addedPath)
+	// 整个过程持有 index.lock，并发的 add 不会丢失修改
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+
+	// core.filemode 为 false 时需要沿用旧条目的 mode
+	oldEntries := map[string]*model.IndexEntry{}
+	for _, e := range index.Entries {
+		if e.Stage() == model.StageMerged || e.Stage() == model.StageOurs {
+			oldEntries[e.Name] = e
+		}
+	}
 
-	worktree := repo.Worktree() + string(filepath.Separator)
+	removePaths(index, addedPath)
 
 	cleanPaths := [][2]string{} // (absolute, relative_to_worktree)
-	for p := range pathSet {
-		p, _ = filepath.Abs(p)
-		if strings.HasPrefix(p, worktree) && util.IsFile(p) {
-			relp, _ := filepath.Rel(worktree, p)
-			cleanPaths = append(cleanPaths, [2]string{p, relp})
+	for name := range pathSet {
+		// 文件不存在时只从 index 中删除；符号链接即使目标不存在也要加入
+		p := filepath.Join(repo.Worktree(), name)
+		if stat, err := os.Lstat(p); err == nil && !stat.IsDir() {
+			cleanPaths = append(cleanPaths, [2]string{p, name})
 		}
 	}
 
-	index := model.ReadIndex(repo)
-
 	for _, p := range cleanPaths {
-		sha := hashObject(p[0], "blob", repo)
-
-		stat, err := os.Stat(p[0])
-		util.PanicErr(err)
-		fstat := stat.Sys().(*syscall.Stat_t)
-
-		index.Entries = append(index.Entries, &model.IndexEntry{
-			Ctime:          model.TimePair{S: fstat.Ctimespec.Sec, NS: fstat.Ctimespec.Nsec},
-			Mtime:          model.TimePair{S: fstat.Mtimespec.Sec, NS: fstat.Mtimespec.Nsec},
-			Device:         int64(fstat.Dev),
-			Inode:          int64(fstat.Ino),
-			ModeType:       0b1000,
-			ModePerms:      0o644,
-			Uid:            int(fstat.Uid),
-			Gid:            int(fstat.Gid),
-			Fsize:          stat.Size(),
-			Sha:            sha,
-			FlagAssumValid: false,
-			FlagStage:      int64(fstat.Flags & 0b0011000000000000),
-			Name:           p[1],
-		})
-	}
-
-	model.WriteIndex(repo, index)
+		e, err := worktreeEntry(repo, p[0], p[1], oldEntries[p[1]])
+		if err != nil {
+			return err
+		}
+		index.Add(e)
+	}
+
+	return model.WriteIndex(repo, index)
+}
+
+// 只为 index 中没有的文件加入 intent-to-add 条目，内容为空 blob，之后 diff、status 把它当作新文件
+func addIntentToAdd(repo *model.Repository, paths []string) error {
+	pathSet, err := expandPaths(repo, nil, paths)
+	if err != nil {
+		return err
+	}
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+	tracked := map[string]bool{}
+	for _, e := range index.Entries {
+		tracked[e.Name] = true
+	}
+
+	names := []string{}
+	for name := range pathSet {
+		if !tracked[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var emptyBlob string
+	for _, name := range names {
+		stat, err := util.Lstat(path.Join(repo.Worktree(), name))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("pathspec '%s' did not match any files", name)
+		}
+		if err != nil {
+			return err
+		}
+		mode, err := worktreeFileMode(repo, stat, nil)
+		if err != nil {
+			return err
+		}
+		if emptyBlob == "" {
+			if emptyBlob, err = model.WriteObject(repo, model.NewBlobObj()); err != nil {
+				return err
+			}
+		}
+
+		e := &model.IndexEntry{Sha: emptyBlob, Name: name, IntentToAdd: true}
+		e.SetMode(mode)
+		e.SetStat(stat)
+		index.Add(e)
+	}
+	return model.WriteIndex(repo, index)
 }
 
-func expandPaths(repo *model.Repository, rules *model.GitIgnore, paths []string) map[string]struct{} {
+// 根据 worktree 中的文件生成 stage 0 的条目，内容写入对象库；old 为 index 中原有的条目，可以为 nil
+func worktreeEntry(repo *model.Repository, file, name string, old *model.IndexEntry) (*model.IndexEntry, error) {
+	stat, err := util.Lstat(file)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := worktreeFileMode(repo, stat, old)
+	if err != nil {
+		return nil, err
+	}
+	sha, err := hashWorktreeFile(repo, file, stat, true)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &model.IndexEntry{Sha: sha, Name: name}
+	e.SetMode(mode)
+	e.SetStat(stat)
+	return e, nil
+}
+
+// 根据文件类型和 core.filemode / core.symlinks 确定条目的 mode，old 为 index 中原有的条目，可以为 nil
+func worktreeFileMode(repo *model.Repository, st *util.FileStat, old *model.IndexEntry) (int, error) {
+	if st.Mode&os.ModeSymlink != 0 {
+		return 0o120000, nil
+	}
+	symlinks, err := repo.Symlinks()
+	if err != nil {
+		return 0, err
+	}
+	// 不支持符号链接时，符号链接检出为普通文件，仍然按符号链接记录
+	if !symlinks && old != nil && old.ModeType == model.ModeTypeSymlink {
+		return old.Mode(), nil
+	}
+
+	filemode, err := repo.FileMode()
+	if err != nil {
+		return 0, err
+	}
+	if !filemode {
+		if old != nil && old.ModeType == model.ModeTypeRegular {
+			return old.Mode(), nil
+		}
+		return 0o100644, nil
+	}
+	if st.Mode&0o100 != 0 {
+		return 0o100755, nil
+	}
+	return 0o100644, nil
+}
+
+// 文件内容对应的 blob，符号链接的内容为链接目标；write 为 false 时只计算 hash
+func hashWorktreeFile(repo *model.Repository, file string, st *util.FileStat, write bool) (string, error) {
+	if st.Mode&os.ModeSymlink == 0 {
+		return hashObject(file, "blob", repo, write)
+	}
+	target, err := os.Readlink(file)
+	if err != nil {
+		return "", err
+	}
+	blob := model.NewBlobObj()
+	if err := blob.Deserialize([]byte(target)); err != nil {
+		return "", err
+	}
+	if !write {
+		return model.HashObject(repo, blob)
+	}
+	return model.WriteObject(repo, blob)
+}
+
+// 把命令行中的路径转换为 index 中的名称，目录展开为其中未被忽略的文件；路径不在 worktree 中时报错
+func expandPaths(repo *model.Repository, rules *model.GitIgnore, paths []string) (map[string]struct{}, error) {
 	if rules == nil {
-		rules = model.ReadGitignore(repo)
+		var err error
+		if rules, err = model.ReadGitignore(repo); err != nil {
+			return nil, err
+		}
+	}
+	names := []string{}
+	for _, p := range paths {
+		name, err := indexPath(repo, p)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
 	}
+	return expandNames(repo, rules, names)
+}
 
+func expandNames(repo *model.Repository, rules *model.GitIgnore, names []string) (map[string]struct{}, error) {
 	dir := []string{}
 	res := make(map[string]struct{})
-	for _, p := range paths {
-		if !model.CheckIgnore(p, rules) {
-			abso, _ := filepath.Abs(p)
-			if !util.IsDir(abso) {
-				res[p] = struct{}{}
+	for _, name := range names {
+		ignored, err := model.CheckIgnore(name, rules)
+		if err != nil {
+			return nil, err
+		}
+		if !ignored {
+			// 不跟随符号链接，指向目录的符号链接作为一个文件加入
+			abso := filepath.Join(repo.Worktree(), name)
+			if stat, err := os.Lstat(abso); err != nil || !stat.IsDir() {
+				res[name] = struct{}{}
 			} else if !util.IsDirEmpty(abso) {
-				dir = append(dir, p)
+				dir = append(dir, name)
 			}
 		}
 	}
@@ -99,18 +264,27 @@ func expandPaths(repo *model.Repository, rules *model.GitIgnore, paths []string)
 	dir = slices.Compact[[]string](dir)
 	child := []string{}
 	for _, d := range dir {
-		entries, err := os.ReadDir(d)
-		util.PanicErr(err)
+		entries, err := os.ReadDir(filepath.Join(repo.Worktree(), d))
+		if err != nil {
+			return nil, err
+		}
 		for _, e := range entries {
+			// 与 walkFilesystem 相同，不加入仓库目录
+			if e.Name() == ".git" || e.Name() == model.GitDir {
+				continue
+			}
 			child = append(child, path.Join(d, e.Name()))
 		}
 	}
 	if len(child) > 0 {
-		sub := expandPaths(repo, rules, child)
+		sub, err := expandNames(repo, rules, child)
+		if err != nil {
+			return nil, err
+		}
 		for p := range sub {
 			res[p] = struct{}{}
 		}
 	}
 
-	return res
+	return res, nil
 }
@@ -0,0 +1,541 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/ignorantshr/mgit/util"
+)
+
+/* git add -p
+
+把已跟踪文件在 worktree 和 index 之间的差异分成 hunk，逐个询问是否加入 index。
+选中的 hunk 应用到 index 中的内容上生成新的 blob，worktree 不变。
+mode 的变化和文件的删除也作为单独的一步询问
+*/
+
+// hunk 前后保留的相同行数
+const patchContext = 3
+
+const envEditor = "MGIT_EDITOR"
+
+const addPatchHelp = `y - stage this hunk
+n - do not stage this hunk
+q - quit; do not stage this hunk or any of the remaining ones
+a - stage this hunk and all later hunks in the file
+d - do not stage this hunk or any of the later hunks in the file
+s - split the current hunk into smaller hunks
+e - manually edit the current hunk
+? - print help
+`
+
+type patchHunk struct {
+	oldStart, newStart int // 从 0 开始的行号
+	lines              []util.DiffLine
+}
+
+func (h *patchHunk) counts() (oldCount, newCount int) {
+	for _, l := range h.lines {
+		if l.Op != util.DiffInsert {
+			oldCount++
+		}
+		if l.Op != util.DiffDelete {
+			newCount++
+		}
+	}
+	return
+}
+
+// 与 diff -u 相同，行数为 1 时省略，为 0 时起始行是前一行
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func (h *patchHunk) String() string {
+	var sb strings.Builder
+	oldCount, newCount := h.counts()
+	fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(h.oldStart, oldCount), hunkRange(h.newStart, newCount))
+	for _, l := range h.lines {
+		sb.WriteByte(" -+"[l.Op])
+		sb.WriteString(l.Text)
+		if !strings.HasSuffix(l.Text, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	return sb.String()
+}
+
+// 相邻的变更之间相同的行不超过 2*patchContext 时放在同一个 hunk 中
+func buildHunks(diff []util.DiffLine) []*patchHunk {
+	// 每个位置之前旧、新文件的行数
+	oldAt, newAt := make([]int, len(diff)+1), make([]int, len(diff)+1)
+	for i, l := range diff {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if l.Op != util.DiffInsert {
+			oldAt[i+1]++
+		}
+		if l.Op != util.DiffDelete {
+			newAt[i+1]++
+		}
+	}
+
+	hunks := []*patchHunk{}
+	for i := 0; i < len(diff); {
+		if diff[i].Op == util.DiffEqual {
+			i++
+			continue
+		}
+		start, end := max(0, i-patchContext), i
+		for {
+			for end < len(diff) && diff[end].Op != util.DiffEqual {
+				end++
+			}
+			next := end
+			for next < len(diff) && diff[next].Op == util.DiffEqual {
+				next++
+			}
+			if next < len(diff) && next-end <= 2*patchContext {
+				end = next
+				continue
+			}
+			end = min(len(diff), end+patchContext)
+			break
+		}
+		hunks = append(hunks, &patchHunk{oldStart: oldAt[start], newStart: newAt[start], lines: diff[start:end]})
+		i = end
+	}
+	return hunks
+}
+
+// 在变更之间相同的行处拆分，相同的行同时作为前后两个 hunk 的上下文；不能拆分时返回 nil
+func (h *patchHunk) split() []*patchHunk {
+	runs := [][2]int{}
+	for i := 0; i < len(h.lines); {
+		if h.lines[i].Op == util.DiffEqual {
+			i++
+			continue
+		}
+		j := i
+		for j < len(h.lines) && h.lines[j].Op != util.DiffEqual {
+			j++
+		}
+		runs = append(runs, [2]int{i, j})
+		i = j
+	}
+	if len(runs) < 2 {
+		return nil
+	}
+
+	subs := []*patchHunk{}
+	for r := range runs {
+		start, end := 0, len(h.lines)
+		if r > 0 {
+			start = runs[r-1][1]
+		}
+		if r < len(runs)-1 {
+			end = runs[r+1][0]
+		}
+		prefix := &patchHunk{lines: h.lines[:start]}
+		oldSkip, newSkip := prefix.counts()
+		subs = append(subs, &patchHunk{
+			oldStart: h.oldStart + oldSkip,
+			newStart: h.newStart + newSkip,
+			lines:    h.lines[start:end],
+		})
+	}
+	return subs
+}
+
+// 把 hunk 应用到 old 上；拆分出的 hunk 可能共用上下文，重叠的部分跳过
+func applyHunks(old []string, hunks []*patchHunk) ([]string, error) {
+	sort.SliceStable(hunks, func(a, b int) bool { return hunks[a].oldStart < hunks[b].oldStart })
+
+	res := []string{}
+	pos := 0
+	for _, h := range hunks {
+		lines := h.lines
+		if h.oldStart < pos {
+			overlap := pos - h.oldStart
+			for k := 0; k < overlap; k++ {
+				if k >= len(lines) || lines[k].Op != util.DiffEqual {
+					return nil, errors.New("hunks overlap")
+				}
+			}
+			lines = lines[overlap:]
+		} else {
+			res = append(res, old[pos:min(h.oldStart, len(old))]...)
+			pos = h.oldStart
+		}
+
+		for _, l := range lines {
+			switch l.Op {
+			case util.DiffInsert:
+				res = append(res, l.Text)
+				continue
+			case util.DiffEqual:
+				res = append(res, l.Text)
+			}
+			if pos >= len(old) || old[pos] != l.Text {
+				return nil, fmt.Errorf("hunk does not apply at line %d", pos+1)
+			}
+			pos++
+		}
+	}
+	if pos < len(old) {
+		res = append(res, old[pos:]...)
+	}
+	return res, nil
+}
+
+// paths 为空时处理所有已跟踪的文件
+func addPatch(repo *model.Repository, paths []string) error {
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+
+	prefixes := []string{}
+	for _, p := range paths {
+		name, err := indexPath(repo, p)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, name)
+	}
+	match := func(name string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, p := range prefixes {
+			if p == "." || name == p || strings.HasPrefix(name, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	entries := []*model.IndexEntry{}
+	for _, e := range index.Entries {
+		if !match(e.Name) {
+			continue
+		}
+		if e.Stage() != model.StageMerged {
+			if e.Stage() == model.StageOurs {
+				fmt.Fprintf(os.Stderr, "ignoring unmerged: %s\n", e.Name)
+			}
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Name < entries[b].Name })
+
+	in := bufio.NewReader(os.Stdin)
+	for _, e := range entries {
+		quit, err := addPatchFile(repo, index, e, in)
+		if err != nil {
+			return err
+		}
+		if quit {
+			break
+		}
+	}
+	return model.WriteIndex(repo, index)
+}
+
+// 读取一行回答，输入结束时相当于 q
+func patchPrompt(in *bufio.Reader, format string, a ...any) string {
+	fmt.Printf(format, a...)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println()
+		return "q"
+	}
+	return strings.TrimSpace(line)
+}
+
+// 处理一个文件，返回用户是否选择了退出
+func addPatchFile(repo *model.Repository, index *model.Index, e *model.IndexEntry, in *bufio.Reader) (bool, error) {
+	if e.FlagAssumValid || e.SkipWorktree {
+		return false, nil
+	}
+	file := path.Join(repo.Worktree(), e.Name)
+	stat, err := util.Lstat(file)
+	if os.IsNotExist(err) {
+		fmt.Printf("diff --git a/%s b/%s\ndeleted file mode %06o\n", e.Name, e.Name, e.Mode())
+		switch patchPrompt(in, "Stage deletion [y,n,q,a,d,?]? ") {
+		case "y", "a":
+			index.Remove(e.Name)
+		case "q":
+			return true, nil
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	mode, err := worktreeFileMode(repo, stat, e)
+	if err != nil {
+		return false, err
+	}
+	worktreeSha, err := hashWorktreeFile(repo, file, stat, false)
+	if err != nil {
+		return false, err
+	}
+	if !e.IntentToAdd && mode == e.Mode() && worktreeSha == e.Sha {
+		return false, nil
+	}
+
+	oldContent, newContent := "", ""
+	if !e.IntentToAdd {
+		obj, err := model.ReadObject(repo, e.Sha)
+		if err != nil {
+			return false, err
+		}
+		raw, err := obj.Serialize(repo)
+		if err != nil {
+			return false, err
+		}
+		oldContent = string(raw)
+	}
+	if stat.Mode&os.ModeSymlink != 0 {
+		newContent, err = os.Readlink(file)
+	} else {
+		var raw []byte
+		raw, err = os.ReadFile(file)
+		newContent = string(raw)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("diff --git a/%s b/%s\n", e.Name, e.Name)
+	if strings.ContainsRune(oldContent, 0) || strings.ContainsRune(newContent, 0) {
+		fmt.Println("Only binary files changed.")
+		return false, nil
+	}
+
+	newMode := e.Mode()
+	if e.IntentToAdd {
+		fmt.Printf("new file mode %06o\n", mode)
+		newMode = mode
+	} else if mode != e.Mode() {
+		fmt.Printf("old mode %06o\nnew mode %06o\n", e.Mode(), mode)
+	}
+
+	oldLines := util.SplitLines(oldContent)
+	diff, err := util.DiffLines(oldLines, util.SplitLines(newContent))
+	if err != nil {
+		return false, err
+	}
+	queue := buildHunks(diff)
+	selected := []*patchHunk{}
+	stageAll, skipAll := false, false
+
+	if !e.IntentToAdd && mode != e.Mode() {
+	modeLoop:
+		for {
+			switch patchPrompt(in, "Stage mode change [y,n,q,a,d,?]? ") {
+			case "y":
+				newMode = mode
+			case "n":
+			case "a":
+				newMode, stageAll = mode, true
+			case "d":
+				skipAll = true
+			case "q":
+				return true, nil
+			default:
+				fmt.Print(addPatchHelp)
+				continue
+			}
+			break modeLoop
+		}
+	}
+
+	quit := false
+	for i := 0; i < len(queue) && !quit; i++ {
+		h := queue[i]
+		if stageAll {
+			selected = append(selected, h)
+			continue
+		}
+		if skipAll {
+			break
+		}
+
+		fmt.Print(h)
+		subs := h.split()
+		options := "y,n,q,a,d"
+		if subs != nil {
+			options += ",s"
+		}
+		options += ",e,?"
+		switch answer := patchPrompt(in, "(%d/%d) Stage this hunk [%s]? ", i+1, len(queue), options); answer {
+		case "y":
+			selected = append(selected, h)
+		case "n":
+		case "a":
+			selected = append(selected, h)
+			stageAll = true
+		case "d":
+			skipAll = true
+		case "q":
+			quit = true
+		case "s":
+			if subs == nil {
+				fmt.Println("Sorry, cannot split this hunk")
+			} else {
+				fmt.Printf("Split into %d hunks.\n", len(subs))
+				queue = append(queue[:i], append(subs, queue[i+1:]...)...)
+			}
+			i--
+		case "e":
+			edited, err := editHunk(repo, h, oldLines)
+			if err != nil {
+				return false, err
+			}
+			if edited != nil {
+				selected = append(selected, edited)
+			} else {
+				i--
+			}
+		default:
+			if answer != "?" {
+				fmt.Println("Unknown answer, choose one of the following:")
+			}
+			fmt.Print(addPatchHelp)
+			i--
+		}
+	}
+
+	if len(selected) == 0 && newMode == e.Mode() {
+		return quit, nil
+	}
+	lines, err := applyHunks(oldLines, selected)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", e.Name, err)
+	}
+	blob := model.NewBlobObj()
+	if err := blob.Deserialize([]byte(strings.Join(lines, ""))); err != nil {
+		return false, err
+	}
+	sha, err := model.WriteObject(repo, blob)
+	if err != nil {
+		return false, err
+	}
+
+	staged := &model.IndexEntry{Sha: sha, Name: e.Name, FlagAssumValid: e.FlagAssumValid}
+	staged.SetMode(newMode)
+	// 只加入了部分修改时清空元数据，之后总是比较内容
+	if sha == worktreeSha && newMode == mode {
+		staged.SetStat(stat)
+	} else {
+		staged.SetStat(&util.FileStat{})
+	}
+	index.Set(staged)
+	return quit, nil
+}
+
+const editHunkGuide = `# ---
+# To remove '-' lines, make them ' ' lines (context).
+# To remove '+' lines, delete them.
+# Lines starting with # will be removed.
+# If the patch applies cleanly, the edited hunk will immediately be
+# marked for staging. If all lines of the hunk are removed, then the
+# edit is aborted and the hunk is left unchanged.
+`
+
+// 在编辑器中修改 hunk，修改后不能应用或者删除了所有行时返回 nil
+func editHunk(repo *model.Repository, h *patchHunk, oldLines []string) (*patchHunk, error) {
+	file, err := repo.RepoFile(false, "addp-hunk-edit.diff")
+	if err != nil {
+		return nil, err
+	}
+	content := "# Manual hunk edit mode -- see bottom for a quick guide.\n" + h.String() + editHunkGuide
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(file)
+	if err := launchEditor(repo, file); err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	edited := &patchHunk{oldStart: h.oldStart, newStart: h.newStart}
+	for _, line := range util.SplitLines(string(raw)) {
+		switch {
+		case strings.HasPrefix(line, "#"), strings.HasPrefix(line, "@@"):
+		case strings.HasPrefix(line, `\`):
+			if n := len(edited.lines); n > 0 {
+				edited.lines[n-1].Text = strings.TrimSuffix(edited.lines[n-1].Text, "\n")
+			}
+		case line == "\n":
+			// 编辑器可能去掉了空行前面的空格
+			edited.lines = append(edited.lines, util.DiffLine{Op: util.DiffEqual, Text: line})
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			op := map[byte]util.DiffOp{' ': util.DiffEqual, '-': util.DiffDelete, '+': util.DiffInsert}[line[0]]
+			text := line[1:]
+			if !strings.HasSuffix(text, "\n") {
+				text += "\n"
+			}
+			edited.lines = append(edited.lines, util.DiffLine{Op: op, Text: text})
+		default:
+			fmt.Fprintf(os.Stderr, "error: corrupt patch line: %s", line)
+			return nil, nil
+		}
+	}
+	if len(edited.lines) == 0 {
+		return nil, nil
+	}
+	if _, err := applyHunks(oldLines, []*patchHunk{edited}); err != nil {
+		fmt.Fprintln(os.Stderr, "error: your edited hunk does not apply:", err)
+		return nil, nil
+	}
+	return edited, nil
+}
+
+// 与 git 相同，依次使用 MGIT_EDITOR、core.editor、VISUAL、EDITOR，都没有设置时使用 vi
+func launchEditor(repo *model.Repository, file string) error {
+	editor := os.Getenv(envEditor)
+	if editor == "" {
+		editor, _ = repo.Config().Get("core.editor")
+	}
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor == "" {
+			editor = os.Getenv(env)
+		}
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	if editor == ":" {
+		return nil
+	}
+
+	// 通过 shell 执行，editor 中可以带参数
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, file)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %w", editor, err)
+	}
+	return nil
+}
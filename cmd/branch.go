@@ -1,13 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"io/fs"
-	"os"
+	"path"
 	"path/filepath"
+	"sort"
 
 	"github.com/ignorantshr/mgit/model"
-	"github.com/ignorantshr/mgit/util"
 	"github.com/spf13/cobra"
 )
 
@@ -26,8 +26,11 @@ var branchCmd = &cobra.Command{
 	Use: "branch [-a] | " +
 		"branch -c [<old-branch>|<commit>] <new-branch>",
 	Short: "List and create and remove branches",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
 		if _branchCopy {
 			oldName := "HEAD"
 			newName := ""
@@ -38,65 +41,106 @@ var branchCmd = &cobra.Command{
 				oldName = args[0]
 				newName = args[1]
 			default:
-				fmt.Println("invalid args")
-				os.Exit(1)
+				return &usageError{cmd.CommandPath(), errors.New("invalid args")}
 			}
 
-			branchCopy(repo, oldName, newName)
+			return branchCopy(repo, oldName, newName)
 		} else if _branchDelete {
 			if len(args) < 1 {
-				fmt.Println("invalid args")
-				os.Exit(1)
+				return &usageError{cmd.CommandPath(), errors.New("invalid args")}
 			}
-			branchDelete(repo, args[0])
-		} else {
-			branchList(repo, _branchAll)
+			return branchDelete(repo, args[0])
 		}
+		return branchList(repo, _branchAll)
 	},
 }
 
-func branchList(repo *model.Repository, all bool) {
-	b := model.GetActiveBranch(repo)
+func branchList(repo *model.Repository, all bool) error {
+	b, err := model.GetActiveBranch(repo)
+	if err != nil {
+		return err
+	}
 	if b != "" {
-		sha := model.GetRefSha(repo, filepath.Join(model.BranchDir, b))
-		fmt.Printf("* %v %v\n", b, sha[:7])
+		sha, err := model.GetRefSha(repo, filepath.Join(model.BranchDir, b))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("* %v %v\n", b, shortSha(sha))
 	} else {
-		fmt.Printf("HEAD detached at %v.\n", model.FindObject(repo, "HEAD", "", true))
+		sha, err := model.FindObject(repo, "HEAD", "", true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("HEAD detached at %v.\n", sha)
 	}
 
 	if !all {
-		return
+		return nil
 	}
 
-	filepath.WalkDir(filepath.Join(repo.GitDir(), model.BranchDir),
-		func(path string, d fs.DirEntry, err error) error {
-			if !d.IsDir() && d.Name() != b {
-				sha := model.GetRefSha(repo, filepath.Join(model.BranchDir, d.Name()))
-				fmt.Printf("  %v %v\n", d.Name(), sha[:7])
-			}
-			return nil
-		})
+	// 包括 packed-refs 中的分支
+	refs, err := model.ListRef(repo, "")
+	if err != nil {
+		return err
+	}
+	heads, _ := refs["heads"].(map[string]any)
+	branches := map[string]string{}
+	flattenRefs(heads, "", branches)
+	names := make([]string, 0, len(branches))
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != b {
+			fmt.Printf("  %v %v\n", name, shortSha(branches[name]))
+		}
+	}
+	return nil
 }
 
-func branchCopy(repo *model.Repository, oldName, newName string) {
-	sha := model.FindObject(repo, oldName, "", true)
-	if sha == "" {
-		return
+// 把 ListRef 返回的嵌套结构展开为 name -> sha
+func flattenRefs(refs map[string]any, prefix string, res map[string]string) {
+	for k, v := range refs {
+		switch v := v.(type) {
+		case string:
+			res[path.Join(prefix, k)] = v
+		case map[string]any:
+			flattenRefs(v, path.Join(prefix, k), res)
+		}
+	}
+}
+
+func branchCopy(repo *model.Repository, oldName, newName string) error {
+	sha, err := model.FindObject(repo, oldName, "", true)
+	if err != nil {
+		return err
 	}
 
-	name := filepath.Join(repo.GitDir(), model.BranchDir, newName)
-	if util.IsFileExist(name) {
-		fmt.Printf("branch %v is already exist.\n", newName)
-		return
+	exist, err := model.GetRefSha(repo, model.BranchDir+newName)
+	if err != nil {
+		return err
 	}
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
-	util.PanicErr(err)
-	defer f.Close()
+	if exist != "" {
+		return fmt.Errorf("branch %v is already exist", newName)
+	}
+	return model.CreateRef(repo, "heads/"+newName, sha)
+}
 
-	f.WriteString(sha)
+func branchDelete(repo *model.Repository, oldName string) error {
+	// 其他 worktree 检出的分支不能删除
+	if wt, err := model.WorktreeOfBranch(repo, oldName); err != nil {
+		return err
+	} else if wt != nil {
+		return fmt.Errorf("cannot delete branch '%s' checked out at '%s'", oldName, wt.Path)
+	}
+	return model.DeleteRef(repo, "heads/"+oldName)
 }
 
-func branchDelete(repo *model.Repository, oldName string) {
-	name := filepath.Join(repo.GitDir(), model.BranchDir, oldName)
-	os.Remove(name)
+// 新分支还没有 commit 时 sha 为空
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
 }
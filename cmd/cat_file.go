@@ -33,17 +33,28 @@ var catFileCmd = &cobra.Command{
 		}
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		catFile(repo, args[0], args[1])
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return catFile(repo, args[0], args[1])
 	},
 }
 
-func catFile(repo *model.Repository, format, objStr string) {
-	sha := model.FindObject(repo, objStr, format, true)
-	if sha == "" {
-		return
+func catFile(repo *model.Repository, format, objStr string) error {
+	sha, err := model.FindObject(repo, objStr, format, true)
+	if err != nil {
+		return err
+	}
+	object, err := model.ReadObject(repo, sha)
+	if err != nil {
+		return err
+	}
+	data, err := object.Serialize(nil)
+	if err != nil {
+		return err
 	}
-	object := model.ReadObject(repo, sha)
-	fmt.Printf("%s", object.Serialize(nil))
+	fmt.Printf("%s", data)
+	return nil
 }
@@ -20,17 +20,35 @@ var checkIgnoreCmd = &cobra.Command{
 	Use:   "check-ignore <path ...>",
 	Short: "Check path(s) against ignore rules.",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		checkIgnore(repo, args)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		return checkIgnore(repo, args)
 	},
 }
 
-func checkIgnore(repo *model.Repository, paths []string) {
-	rules := model.ReadGitignore(repo)
+func checkIgnore(repo *model.Repository, paths []string) error {
+	rules, err := model.ReadGitignore(repo)
+	if err != nil {
+		return err
+	}
 	for _, p := range paths {
-		if model.CheckIgnore(p, rules) {
+		name, err := indexPath(repo, p)
+		if err != nil {
+			return err
+		}
+		ignored, err := model.CheckIgnore(name, rules)
+		if err != nil {
+			return err
+		}
+		if ignored {
 			fmt.Println(p)
 		}
 	}
+	return nil
 }
@@ -2,9 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
 
 	"github.com/ignorantshr/mgit/model"
 	"github.com/ignorantshr/mgit/util"
@@ -13,7 +14,8 @@ import (
 
 /* git checkout
 
-因为 mgit 没有完整的测试过，所以为了防止对 worktree 造成不可恢复的动作，我们使用新的文件夹来承载历史版本
+因为 mgit 没有完整的测试过，所以为了防止对 worktree 造成不可恢复的动作，我们使用新的文件夹来承载历史版本。
+新文件夹是一个 linked worktree（同 mgit worktree add <path> <commit>），在其中的提交对本仓库可见
 */
 
 func init() {
@@ -25,67 +27,114 @@ var checkoutCmd = &cobra.Command{
 	Short:                 "Checkout a commit inside of a directory.",
 	DisableFlagsInUseLine: true,
 	Args:                  cobra.MinimumNArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		p := args[1]
-		if util.IsFile(p) || (util.IsDir(p) && !util.IsDirEmpty(p)) {
-			util.PanicErr(fmt.Errorf("%s not a valid path", p))
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
 		}
-
-		sha := model.FindObject(repo, args[0], "", true)
-		obj := model.ReadObject(repo, sha)
-		if obj == nil {
-			return
-		}
-		if obj.Format() == "commit" {
-			cobj := obj.(*model.CommitObj)
-			sha = cobj.KV().Tree
-			obj = model.ReadObject(repo, sha)
-		}
-
-		os.MkdirAll(p, 0755)
-		checkoutTree(repo, p, obj.(*model.TreeObj))
-		buildGitDir(repo, args[0], p, sha)
+		return worktreeAdd(repo, args[1], args[0], "", false, false)
 	},
 }
 
-func checkoutTree(repo *model.Repository, destPath string, tree *model.TreeObj) {
+// 把 tree 写到 destPath，同时把每个文件的条目加入 index；prefix 为 tree 相对于 worktree 的路径
+func checkoutTree(repo *model.Repository, index *model.Index, destPath, prefix string, tree *model.TreeObj) error {
+	symlinks, err := repo.Symlinks()
+	if err != nil {
+		return err
+	}
 	for _, v := range tree.Items() {
-		obj := model.ReadObject(repo, v.Sha)
 		dest := path.Join(destPath, v.Path)
+		name := path.Join(prefix, v.Path)
+
+		mode, err := strconv.ParseInt(v.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("%s: invalid mode %q", name, v.Mode)
+		}
+		switch mode >> 12 {
+		case 0o04:
+			if err := os.Mkdir(dest, 0755); err != nil {
+				return err
+			}
+			obj, err := model.ReadObject(repo, v.Sha)
+			if err != nil {
+				return err
+			}
+			sub, ok := obj.(*model.TreeObj)
+			if !ok {
+				return fmt.Errorf("%s: expected tree, got %s", v.Sha, obj.Format())
+			}
+			if err := checkoutTree(repo, index, dest, name, sub); err != nil {
+				return err
+			}
+			continue
+		case model.ModeTypeGitlink:
+			// 子模块只创建空目录
+			if err := os.Mkdir(dest, 0755); err != nil {
+				return err
+			}
+		case model.ModeTypeSymlink:
+			if err := checkoutSymlink(repo, dest, v.Sha, symlinks); err != nil {
+				return err
+			}
+		default:
+			perm := os.FileMode(0644)
+			if mode&0o100 != 0 {
+				perm = 0755
+			}
+			if err := checkoutBlob(repo, dest, v.Sha, perm); err != nil {
+				return err
+			}
+		}
 
-		if obj.Format() == "tree" {
-			err := os.Mkdir(dest, 0755)
-			checkoutTree(repo, dest, obj.(*model.TreeObj))
-			util.PanicErr(err)
-		} else if obj.Format() == "blob" {
-			err := os.WriteFile(dest, obj.(*model.BlobObj).Serialize(repo), 0644)
-			util.PanicErr(err)
+		stat, err := util.Lstat(dest)
+		if err != nil {
+			return err
 		}
+		e := &model.IndexEntry{Sha: v.Sha, Name: name}
+		e.SetMode(int(mode))
+		e.SetStat(stat)
+		index.Add(e)
 	}
+	return nil
 }
 
-func buildGitDir(repo *model.Repository, src, destPath, ref string) {
-	newGitDir := filepath.Join(destPath, model.GitDir)
-	err := util.CopyDir(repo.GitDir(), newGitDir)
-	util.PanicErr(err)
-	os.Chdir(destPath)
+// blob 以流的方式写出，大文件不会被完整读入内存
+func checkoutBlob(repo *model.Repository, dest, sha string, perm os.FileMode) error {
+	format, _, r, err := model.OpenObjectStream(repo, sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if format != "blob" {
+		return fmt.Errorf("%s: expected blob, got %s", sha, format)
+	}
 
-	paths := []string{}
-	entries := model.Tree2Map(repo, ref, "")
-	for p := range entries {
-		paths = append(paths, p)
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
 	}
-	repo.SetWorktree(filepath.Join(repo.Worktree(), destPath))
-	repo.SetGitDir(filepath.Join(repo.Worktree(), model.GitDir))
-	os.Remove(filepath.Join(repo.GitDir(), "index"))
-	add(repo, paths)
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
 
-	head, err := os.OpenFile(filepath.Join(repo.GitDir(), "HEAD"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	util.PanicErr(err)
-	if model.HashRegx.MatchString(src) {
-		head.WriteString(src)
-	} else {
-		head.WriteString("ref: " + model.BranchDir + src)
+// blob 的内容是链接目标；不支持符号链接时写成内容为链接目标的普通文件
+func checkoutSymlink(repo *model.Repository, dest, sha string, symlinks bool) error {
+	if !symlinks {
+		return checkoutBlob(repo, dest, sha, 0644)
+	}
+	obj, err := model.ReadObject(repo, sha)
+	if err != nil {
+		return err
+	}
+	if obj.Format() != "blob" {
+		return fmt.Errorf("%s: expected blob, got %s", sha, obj.Format())
+	}
+	target, err := obj.Serialize(repo)
+	if err != nil {
+		return err
 	}
+	return os.Symlink(string(target), dest)
 }
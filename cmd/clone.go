@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/ignorantshr/mgit/util"
+	"github.com/spf13/cobra"
+)
+
+/* git clone
+
+从本地仓库克隆，复制所有分支、标签以及它们可达的对象，并检出 HEAD。
+
+--shared 不复制对象，而是把源仓库的 objects 目录写入 objects/info/alternates 直接使用；
+--reference 把另一个本地仓库的 objects 目录写入 alternates，只复制其中没有的对象；
+--bare 克隆为 bare 仓库，不检出
+*/
+
+var (
+	_cloneShared    bool
+	_cloneReference string
+	_cloneBare      bool
+)
+
+func init() {
+	cloneCmd.Flags().BoolVarP(&_cloneShared, "shared", "s", false, "share the objects with the source repository instead of copying")
+	cloneCmd.Flags().StringVar(&_cloneReference, "reference", "", "borrow objects from the reference repository")
+	cloneCmd.Flags().BoolVar(&_cloneBare, "bare", false, "make a bare repository")
+	rootCmd.AddCommand(cloneCmd)
+}
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone [--shared] [--reference <repository>] [--bare] <repository> <directory>",
+	Short: "Clone a local repository into a new directory.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		dest, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+		if util.IsFile(dest) || (util.IsDir(dest) && !util.IsDirEmpty(dest)) {
+			return fmt.Errorf("destination path '%s' already exists and is not an empty directory", args[1])
+		}
+
+		var reference *model.Repository
+		if _cloneReference != "" {
+			p, err := filepath.Abs(_cloneReference)
+			if err != nil {
+				return err
+			}
+			if reference, err = model.FindRepo(p); err != nil {
+				return err
+			}
+		}
+		srcRepo, err := model.FindRepo(src)
+		if err != nil {
+			return err
+		}
+		return clone(srcRepo, dest, _cloneShared, _cloneBare, reference)
+	},
+}
+
+func clone(src *model.Repository, dest string, shared, bare bool, reference *model.Repository) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	repo, err := model.CreateRepository(dest, src.ObjectFormat(), src.Compat(), bare)
+	if err != nil {
+		return err
+	}
+
+	if shared {
+		if err := model.AddAlternate(repo, filepath.Join(src.CommonDir(), "objects")); err != nil {
+			return err
+		}
+	}
+	if reference != nil {
+		if reference.ObjectFormat() != src.ObjectFormat() {
+			return fmt.Errorf("reference repository uses %s, not %s", reference.ObjectFormat(), src.ObjectFormat())
+		}
+		if err := model.AddAlternate(repo, filepath.Join(reference.CommonDir(), "objects")); err != nil {
+			return err
+		}
+	}
+
+	// 只复制 alternates 中没有的对象
+	roots, err := model.RootObjects(src)
+	if err != nil {
+		return err
+	}
+	reachable, err := model.ReachableObjects(src, roots)
+	if err != nil {
+		return err
+	}
+	store := repo.Objects()
+	copied := 0
+	for sha := range reachable {
+		if store.Has(sha) {
+			continue
+		}
+		if err := copyObject(src, repo, sha); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	refs, err := model.ListRef(src, "")
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{"heads", "tags"} {
+		if m, ok := refs[dir].(map[string]any); ok {
+			if err := cloneRefs(repo, dir, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	branch, err := model.GetActiveBranch(src)
+	if err != nil {
+		return err
+	}
+	head := "ref: " + model.BranchDir + branch
+	if branch == "" {
+		if head, err = model.GetRefSha(src, "HEAD"); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repo.GitDir(), "HEAD"), []byte(head+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if bare {
+		fmt.Printf("Cloning into bare repository '%s'... %d objects copied\n", dest, copied)
+		return nil
+	}
+	fmt.Printf("Cloning into '%s'... %d objects copied\n", dest, copied)
+
+	// 空仓库没有可以检出的内容
+	sha, err := model.GetRefSha(repo, "HEAD")
+	if err != nil || sha == "" {
+		return err
+	}
+	tree, err := model.FindObject(repo, sha, "tree", true)
+	if err != nil {
+		return err
+	}
+	obj, err := model.ReadObject(repo, tree)
+	if err != nil {
+		return err
+	}
+	// 检出的同时生成 index
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+	if err := checkoutTree(repo, index, dest, "", obj.(*model.TreeObj)); err != nil {
+		return err
+	}
+	if err := model.WriteIndex(repo, index); err != nil {
+		return err
+	}
+	return model.RunHook(repo, model.HookPostCheckout, repo.NullSha(), sha, "1")
+}
+
+func copyObject(src, dest *model.Repository, sha string) error {
+	format, size, r, err := model.OpenObjectStream(src, sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = model.WriteObjectStream(dest, format, size, r)
+	return err
+}
+
+func cloneRefs(repo *model.Repository, prefix string, refs map[string]any) error {
+	for k, v := range refs {
+		name := filepath.Join(prefix, k)
+		switch v := v.(type) {
+		case string:
+			if v != "" {
+				if _, err := repo.RepoFile(true, "refs", name); err != nil {
+					return err
+				}
+				if err := model.CreateRef(repo, name, v); err != nil {
+					return err
+				}
+			}
+		case map[string]any:
+			if err := cloneRefs(repo, name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,15 +1,16 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ignorantshr/mgit/model"
-	"github.com/ignorantshr/mgit/util"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 /*
@@ -18,12 +19,16 @@ commit 实际上就是把 index 转换成 commit 对象
 1. 把 index 转换成 tree 对象
 2. 生成并存储相应的 commit 对象
 3. 更新 HEAD 分支指向新的 commit（分支就是指向一个 commit 的引用）
+
+之前执行 pre-commit 和 commit-msg hook（--no-verify 跳过），任一失败则放弃提交；之后执行 post-commit
 */
 
 var _commitMsg string
+var _commitNoVerify bool
 
 func init() {
 	commitCmd.Flags().StringVarP(&_commitMsg, "message", "m", "nothing", "Message to associate with this commit.")
+	commitCmd.Flags().BoolVarP(&_commitNoVerify, "no-verify", "n", false, "bypass the pre-commit and commit-msg hooks")
 	commitCmd.MarkFlagRequired("message")
 	rootCmd.AddCommand(commitCmd)
 }
@@ -31,56 +36,136 @@ func init() {
 var commitCmd = &cobra.Command{
 	Use:   "commit -m <message>",
 	Short: "Record changes to the repository.",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		commit(repo, _commitMsg)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		return commit(repo, _commitMsg, !_commitNoVerify)
 	},
 }
 
-func commit(repo *model.Repository, msg string) {
-	index := model.ReadIndex(repo)
-	treesha := model.Index2Tree(repo, index)
+func commit(repo *model.Repository, msg string, verify bool) error {
+	// 有冲突时不执行 hook，直接退出
+	index, err := model.ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	if index.HasUnmerged() {
+		fmt.Fprintln(os.Stderr, "error: Committing is not possible because you have unmerged files.")
+		fmt.Fprintln(os.Stderr, "hint: Fix them up in the work tree, and then use 'mgit add/rm <file>'")
+		fmt.Fprintln(os.Stderr, "hint: as appropriate to mark resolution and make a commit.")
+		return errors.New("Exiting because of an unresolved conflict.")
+	}
 
-	com := model.CreateCommit(repo, treesha, model.FindObject(repo, "HEAD", "", true), readGitAuthor(), msg, time.Now())
+	// pre-commit 可能修改 index，所以在执行之后重新读取 index
+	if verify {
+		if err := model.RunHook(repo, model.HookPreCommit); err != nil {
+			return err
+		}
+	}
+
+	index, err = model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+	treesha, err := model.Index2Tree(repo, index)
+	if err != nil {
+		return err
+	}
+	// 保存更新后的 cached tree，下次提交时没有变化的目录可以直接使用
+	if err := model.WriteIndex(repo, index); err != nil {
+		return err
+	}
+
+	// 第一个 commit 没有 parent
+	parent, err := model.FindObject(repo, "HEAD", "", true)
+	if err != nil && !errors.Is(err, model.ErrObjectNotFound) {
+		return err
+	}
+	author, err := readGitAuthor(repo)
+	if err != nil {
+		return err
+	}
+	if msg, err = commitMessage(repo, msg, verify); err != nil {
+		return err
+	}
+	com := model.CreateCommit(repo, treesha, parent, author, msg, time.Now())
+	sha, err := model.WriteObject(repo, com)
+	if err != nil {
+		return err
+	}
 
-	ab := model.GetActiveBranch(repo)
+	ab, err := model.GetActiveBranch(repo)
+	if err != nil {
+		return err
+	}
+	ref := "HEAD" // detached HEAD 直接指向新的 commit
 	if ab != "" {
-		p, err := repo.RepoFile(false, path.Join("refs/heads", ab))
-		util.PanicErr(err)
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		util.PanicErr(err)
-		defer f.Close()
-		f.WriteString(model.WriteObject(repo, com) + "\n")
-	} else {
-		p, err := repo.RepoFile(false, "HEAD")
-		util.PanicErr(err)
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		util.PanicErr(err)
-		defer f.Close()
-		f.WriteString("\n")
+		ref = path.Join("refs/heads", ab)
+	}
+	// 其他进程在这期间移动了分支时放弃更新
+	if err := model.UpdateRef(repo, ref, sha, parent); err != nil {
+		return err
+	}
+
+	// 提交已经完成，post-commit 的退出状态被忽略
+	var hookErr *model.HookError
+	if err := model.RunHook(repo, model.HookPostCommit); err != nil && !errors.As(err, &hookErr) {
+		return err
 	}
+	return nil
 }
 
-func readGitAuthor() string {
-	xdgConfigHome, ok := os.LookupEnv("XDG_CONFIG_HOME")
-	userhome, _ := os.UserHomeDir()
-	if !ok {
-		xdgConfigHome = path.Join(userhome, ".conf")
+// 提交信息写入 COMMIT_EDITMSG 后交给 commit-msg 检查，hook 可以修改这个文件
+func commitMessage(repo *model.Repository, msg string, verify bool) (string, error) {
+	p, err := repo.RepoFile(false, "COMMIT_EDITMSG")
+	if err != nil {
+		return "", err
+	}
+	written := msg
+	if !strings.HasSuffix(written, "\n") {
+		written += "\n"
+	}
+	if err := os.WriteFile(p, []byte(written), 0644); err != nil {
+		return "", err
+	}
+	if !verify {
+		return msg, nil
 	}
 
-	vip := viper.New()
-	p1 := path.Join(xdgConfigHome, "git/config")
-	if util.IsFile(p1) {
-		vip.SetConfigFile(p1)
+	// hook 在 worktree 的根目录执行，使用绝对路径
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
 	}
-	p2 := path.Join(userhome, ".gitconfig")
-	if util.IsFile(p2) {
-		vip.SetConfigFile(p2)
+	if err := model.RunHook(repo, model.HookCommitMsg, abs); err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	if string(raw) == written {
+		return msg, nil
+	}
+	if msg = strings.TrimRight(string(raw), "\n"); strings.TrimSpace(msg) == "" {
+		return "", errors.New("aborting commit due to empty commit message")
+	}
+	return msg, nil
+}
+
+// user.name <user.email>
+func readGitAuthor(repo *model.Repository) (string, error) {
+	conf := repo.Config()
+	name, _ := conf.Get("user.name")
+	email, _ := conf.Get("user.email")
+	if name == "" || email == "" {
+		return "", errors.New("author identity unknown, please set user.name and user.email with 'mgit config'")
 	}
-	vip.SetConfigType("ini")
-	vip.ReadInConfig()
-	user := vip.GetStringMap("user")
-	name := user["name"]
-	email := user["email"]
-	return fmt.Sprintf("%s <%s>", name, email)
+	return fmt.Sprintf("%s <%s>", name, email), nil
 }
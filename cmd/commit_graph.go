@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git commit-graph
+
+write 为所有可达的 commit 写入 objects/info/commit-graph，log、merge-base 等遍历历史时不必再逐个解析 commit 对象；
+verify 校验 commit-graph 与对象是否一致，不一致时以非 0 状态退出
+*/
+
+func init() {
+	commitGraphCmd.AddCommand(commitGraphWriteCmd, commitGraphVerifyCmd)
+	rootCmd.AddCommand(commitGraphCmd)
+}
+
+var commitGraphCmd = &cobra.Command{
+	Use:   "commit-graph {write|verify}",
+	Short: "Write and verify the commit-graph file.",
+}
+
+var commitGraphWriteCmd = &cobra.Command{
+	Use:   "write",
+	Short: "Write a commit-graph file for all reachable commits.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		n, err := model.WriteCommitGraph(repo)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote commit-graph with %d commits\n", n)
+		return nil
+	},
+}
+
+var commitGraphVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the commit-graph file against the object database.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		errs := model.VerifyCommitGraph(repo)
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, "error:", e)
+		}
+		if len(errs) > 0 {
+			return exitError(exitFailure)
+		}
+		return nil
+	},
+}
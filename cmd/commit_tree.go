@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git commit-tree
+
+用已有的 tree 生成 commit 对象并输出 sha，不修改任何引用，也不执行 hook。
+提交信息来自 -m 或 -F，都没有指定时从 stdin 读取
+*/
+
+var (
+	_commitTreeParents  []string
+	_commitTreeMessages []string
+	_commitTreeFiles    []string
+)
+
+func init() {
+	commitTreeCmd.Flags().StringArrayVarP(&_commitTreeParents, "parent", "p", nil, "id of a parent commit object")
+	commitTreeCmd.Flags().StringArrayVarP(&_commitTreeMessages, "message", "m", nil, "commit message, multiple -m are concatenated as separate paragraphs")
+	commitTreeCmd.Flags().StringArrayVarP(&_commitTreeFiles, "file", "F", nil, "read commit message from the given file, - for stdin")
+	rootCmd.AddCommand(commitTreeCmd)
+}
+
+var commitTreeCmd = &cobra.Command{
+	Use:   "commit-tree <tree> [(-p <parent>)...] [(-m <message>)...] [(-F <file>)...]",
+	Short: "Create a new commit object",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		msg, err := commitTreeMessage(_commitTreeMessages, _commitTreeFiles)
+		if err != nil {
+			return err
+		}
+		sha, err := commitTree(repo, args[0], _commitTreeParents, msg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(sha)
+		return nil
+	},
+}
+
+func commitTree(repo *model.Repository, treeish string, parentNames []string, msg string) (string, error) {
+	tree, err := model.FindObject(repo, treeish, "tree", true)
+	if err != nil {
+		return "", err
+	}
+
+	parents := []string{}
+	for _, p := range parentNames {
+		sha, err := model.FindObject(repo, p, "commit", true)
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(parents, sha) {
+			fmt.Fprintf(os.Stderr, "error: duplicate parent %s ignored\n", sha)
+			continue
+		}
+		parents = append(parents, sha)
+	}
+
+	author, err := readGitAuthor(repo)
+	if err != nil {
+		return "", err
+	}
+	com := model.CreateCommit(repo, tree, strings.Join(parents, "\n"), author, msg, time.Now())
+	return model.WriteObject(repo, com)
+}
+
+// 多个 -m、-F 之间空一行；与 git 相同，非空的提交信息以换行结尾
+func commitTreeMessage(messages, files []string) (string, error) {
+	paragraphs := slices.Clone(messages)
+	for _, f := range files {
+		var raw []byte
+		var err error
+		if f == "-" {
+			raw, err = io.ReadAll(os.Stdin)
+		} else {
+			raw, err = os.ReadFile(f)
+		}
+		if err != nil {
+			return "", err
+		}
+		paragraphs = append(paragraphs, strings.TrimRight(string(raw), "\n"))
+	}
+	if len(messages) == 0 && len(files) == 0 {
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		paragraphs = append(paragraphs, strings.TrimRight(string(raw), "\n"))
+	}
+
+	msg := strings.Join(paragraphs, "\n\n")
+	if msg == "" {
+		return "", nil
+	}
+	return msg + "\n", nil
+}
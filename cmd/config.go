@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git config
+
+读写配置。不指定 scope 时读取 system、global、local、worktree 合并后的配置，写入本仓库的配置文件；
+指定 scope（或 -f）时只读写对应的文件，不展开 include。
+找不到要读取或删除的 key 时以 1 退出
+*/
+
+var (
+	_configSystem     bool
+	_configGlobal     bool
+	_configLocal      bool
+	_configWorktree   bool
+	_configFile       string
+	_configList       bool
+	_configShowOrigin bool
+	_configGet        bool
+	_configGetAll     bool
+	_configUnset      bool
+	_configUnsetAll   bool
+)
+
+func init() {
+	configCmd.Flags().BoolVar(&_configSystem, "system", false, "use the system-wide config file")
+	configCmd.Flags().BoolVar(&_configGlobal, "global", false, "use the global config file")
+	configCmd.Flags().BoolVar(&_configLocal, "local", false, "use the repository config file")
+	configCmd.Flags().BoolVar(&_configWorktree, "worktree", false, "use the per-worktree config file")
+	configCmd.Flags().StringVarP(&_configFile, "file", "f", "", "use the given config file")
+	configCmd.Flags().BoolVarP(&_configList, "list", "l", false, "list all variables set in config file, along with their values")
+	configCmd.Flags().BoolVar(&_configShowOrigin, "show-origin", false, "show the origin file of each value")
+	configCmd.Flags().BoolVar(&_configGet, "get", false, "get the value for the given key")
+	configCmd.Flags().BoolVar(&_configGetAll, "get-all", false, "get all values for a multi-valued key")
+	configCmd.Flags().BoolVar(&_configUnset, "unset", false, "remove the given key")
+	configCmd.Flags().BoolVar(&_configUnsetAll, "unset-all", false, "remove all values of a multi-valued key")
+	configCmd.MarkFlagsMutuallyExclusive("system", "global", "local", "worktree", "file")
+	configCmd.MarkFlagsMutuallyExclusive("list", "get", "get-all", "unset", "unset-all")
+	rootCmd.AddCommand(configCmd)
+}
+
+var configCmd = &cobra.Command{
+	Use: "config [--system|--global|--local|--worktree|-f <file>] [--show-origin] " +
+		"{--list | --get <name> | --get-all <name> | --unset <name> | --unset-all <name> | <name> [<value>]}",
+	Short: "Get and set repository or global options.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// 只读写 system、global 或指定文件时不需要仓库
+		repo, err := model.FindRepo(".")
+		if err != nil && !errors.Is(err, model.ErrNotARepository) {
+			return err
+		}
+
+		file, scope, err := configTarget(repo)
+		if err != nil {
+			return err
+		}
+
+		wantArgs := 1
+		switch {
+		case _configList:
+			wantArgs = 0
+		case !_configGet && !_configGetAll && !_configUnset && !_configUnsetAll && len(args) == 2:
+			wantArgs = 2
+		}
+		if len(args) != wantArgs {
+			return &usageError{cmd.CommandPath(), fmt.Errorf("wrong number of arguments, should be %d", wantArgs)}
+		}
+
+		switch {
+		case _configUnset, _configUnsetAll:
+			if file == "" {
+				if file, err = model.ConfigFile(repo, model.ScopeLocal); err != nil {
+					return err
+				}
+			}
+			n, err := model.UnsetConfigValue(file, args[0], _configUnsetAll)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return exitError(exitFailure)
+			}
+			return nil
+		case len(args) == 2:
+			if file == "" {
+				if file, err = model.ConfigFile(repo, model.ScopeLocal); err != nil {
+					return err
+				}
+			}
+			return model.SetConfigValue(file, args[0], args[1])
+		}
+
+		var conf *model.Config
+		if file == "" {
+			conf = repo.Config()
+			if repo == nil {
+				if conf, err = model.LoadConfig(nil); err != nil {
+					return err
+				}
+			}
+		} else if conf, err = model.ReadConfigFile(file, scope); err != nil {
+			return err
+		}
+
+		if _configList {
+			for _, e := range conf.Entries {
+				printConfigEntry(e, true)
+			}
+			return nil
+		}
+
+		entries := conf.GetAllEntries(args[0])
+		if len(entries) == 0 {
+			return exitError(exitFailure)
+		}
+		if !_configGetAll {
+			entries = entries[len(entries)-1:]
+		}
+		for _, e := range entries {
+			printConfigEntry(e, false)
+		}
+		return nil
+	},
+}
+
+// scope 参数对应的文件，没有指定时返回空字符串
+func configTarget(repo *model.Repository) (string, model.ConfigScope, error) {
+	scope := model.ScopeFile
+	switch {
+	case _configFile != "":
+		return _configFile, scope, nil
+	case _configSystem:
+		scope = model.ScopeSystem
+	case _configGlobal:
+		scope = model.ScopeGlobal
+	case _configLocal:
+		scope = model.ScopeLocal
+	case _configWorktree:
+		// 没有开启 extensions.worktreeConfig 时与 --local 相同
+		scope = model.ScopeLocal
+		if enabled, err := repo.Config().GetBool("extensions.worktreeconfig", false); err != nil {
+			return "", scope, err
+		} else if enabled {
+			scope = model.ScopeWorktree
+		}
+	default:
+		return "", scope, nil
+	}
+	file, err := model.ConfigFile(repo, scope)
+	return file, scope, err
+}
+
+func printConfigEntry(e *model.ConfigEntry, withName bool) {
+	if _configShowOrigin {
+		fmt.Printf("file:%s\t", e.File)
+	}
+	switch {
+	case !withName:
+		fmt.Println(e.Value)
+	case e.NoValue:
+		fmt.Println(e.Name())
+	default:
+		fmt.Printf("%s=%s\n", e.Name(), e.Value)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ignorantshr/mgit/model"
+)
+
+// 退出状态，脚本可以依赖这些值
+const (
+	exitOK             = 0
+	exitFailure        = 1   // 其他错误
+	exitNotFound       = 2   // 对象或引用不存在，或者名称有歧义
+	exitCorrupt        = 3   // 对象或 index 损坏
+	exitNotARepository = 128 // 不在仓库中，或者 bare 仓库中执行需要 worktree 的命令
+	exitUsage          = 129 // 命令行参数错误
+)
+
+// 只需要以指定状态退出、不需要再输出信息的错误，例如 fsck 发现仓库损坏
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// 参数错误，输出时附带用法提示
+type usageError struct {
+	cmd string // 出错的命令，例如 "mgit cat-file"
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+func exitCode(err error) int {
+	var code exitError
+	var ambiguous *model.AmbiguousRefError
+	var usage *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &code):
+		return int(code)
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, model.ErrNotARepository), errors.Is(err, model.ErrNoWorktree):
+		return exitNotARepository
+	case errors.Is(err, model.ErrObjectNotFound), errors.As(err, &ambiguous):
+		return exitNotFound
+	case errors.Is(err, model.ErrCorruptObject), errors.Is(err, model.ErrCorruptIndex):
+		return exitCorrupt
+	}
+	return exitFailure
+}
+
+// 输出错误信息并退出
+func exitWithError(err error) {
+	var code exitError
+	var usage *usageError
+	switch {
+	case errors.As(err, &code):
+	case errors.As(err, &usage):
+		fmt.Fprintln(os.Stderr, "error:", usage.err)
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", usage.cmd)
+	default:
+		fmt.Fprintln(os.Stderr, "fatal:", err)
+	}
+	os.Exit(exitCode(err))
+}
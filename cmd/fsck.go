@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git fsck
+
+校验对象数据库的完整性和连通性，发现损坏时以非 0 状态退出
+*/
+
+var _fsckUnreachable bool
+var _fsckNoDangling bool
+
+func init() {
+	fsckCmd.Flags().BoolVar(&_fsckUnreachable, "unreachable", false, "print objects that exist but aren't reachable")
+	fsckCmd.Flags().BoolVar(&_fsckNoDangling, "no-dangling", false, "do not print dangling objects")
+	rootCmd.AddCommand(fsckCmd)
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [--unreachable] [--no-dangling]",
+	Short: "Verifies the connectivity and validity of the objects in the database.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		ok, err := fsck(repo, _fsckUnreachable, !_fsckNoDangling)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return exitError(exitCorrupt)
+		}
+		return nil
+	},
+}
+
+// 仓库没有损坏时返回 true
+func fsck(repo *model.Repository, unreachable, dangling bool) (bool, error) {
+	report, err := model.Fsck(repo)
+	if err != nil {
+		return false, err
+	}
+
+	for _, e := range report.Errors {
+		fmt.Println(e)
+	}
+	if unreachable {
+		for _, o := range report.Unreachable {
+			fmt.Println("unreachable", o)
+		}
+	} else if dangling {
+		for _, o := range report.Dangling {
+			fmt.Println("dangling", o)
+		}
+	}
+
+	return !report.Corrupt(), nil
+}
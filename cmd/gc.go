@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git gc
+
+repack -d，然后删除超过宽限期仍不可达的 loose object，最后重写 commit-graph
+*/
+
+var _gcPrune time.Duration
+
+func init() {
+	gcCmd.Flags().DurationVar(&_gcPrune, "prune", 14*24*time.Hour, "prune unreachable loose objects older than this")
+	rootCmd.AddCommand(gcCmd)
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc [--prune=<duration>]",
+	Short: "Cleanup unnecessary files and optimize the local repository.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return gc(repo, _gcPrune)
+	},
+}
+
+func gc(repo *model.Repository, grace time.Duration) error {
+	_, reachable, err := repack(repo, true)
+	if err != nil {
+		return err
+	}
+	pruned, err := model.PruneLooseObjects(repo, reachable, grace)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d loose objects\n", pruned)
+	}
+	_, err = model.WriteCommitGraph(repo)
+	return err
+}
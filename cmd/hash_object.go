@@ -6,7 +6,6 @@ import (
 	"os"
 
 	"github.com/ignorantshr/mgit/model"
-	"github.com/ignorantshr/mgit/util"
 	"github.com/spf13/cobra"
 )
 
@@ -31,19 +30,49 @@ var hashObjectCmd = &cobra.Command{
 	Use:   "hash-object {-t blob|tree|commit|tag} <file>",
 	Short: "Compute object ID and optionally creates a blob from a file",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		var repo *model.Repository
-		if writeFlag {
-			repo = model.FindRepo(".")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// 不写入时可以在仓库外使用，此时使用 SHA-1
+		repo, err := model.FindRepo(".")
+		if err != nil && (writeFlag || !errors.Is(err, model.ErrNotARepository)) {
+			return err
+		}
+		sha, err := hashObject(args[0], typeFlag, repo, writeFlag)
+		if err != nil {
+			return err
 		}
-		sha := hashObject(args[0], typeFlag, repo)
 		fmt.Println(sha)
+		return nil
 	},
 }
 
-func hashObject(file string, format string, repo *model.Repository) string {
+// 按照 repo 的对象格式计算 sha，write 为 true 时写入 repo
+func hashObject(file string, format string, repo *model.Repository, write bool) (string, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+
+	// 大文件直接以流的方式写入，不读入内存
+	threshold, err := repo.BigFileThreshold()
+	if err != nil {
+		return "", err
+	}
+	if format == "blob" && stat.Size() > threshold {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if !write {
+			return model.HashObjectStream(repo, format, stat.Size(), f)
+		}
+		return model.WriteObjectStream(repo, format, stat.Size(), f)
+	}
+
 	raw, err := os.ReadFile(file)
-	util.PanicErr(err)
+	if err != nil {
+		return "", err
+	}
 
 	var obj model.Object
 	switch format {
@@ -56,9 +85,14 @@ func hashObject(file string, format string, repo *model.Repository) string {
 	case "tag":
 		obj = model.NewTagObj()
 	default:
-		util.PanicErr(errors.New("unsupported format " + format))
+		return "", errors.New("unsupported format " + format)
 	}
 
-	obj.Deserialize(raw)
+	if err := obj.Deserialize(raw); err != nil {
+		return "", fmt.Errorf("%s: bad %s: %w", file, format, err)
+	}
+	if !write {
+		return model.HashObject(repo, obj)
+	}
 	return model.WriteObject(repo, obj)
 }
@@ -8,20 +8,30 @@ import (
 /* git init
 
 创建 .git 文件目录结构，初始化 git 项目
+
+--compat 创建标准的 .git 仓库（配置文件为 config），git 和 mgit 可以同时使用；
+不指定时创建 .mgit 仓库。已有的 .git 仓库不需要 init，FindRepo 找不到 .mgit 时会自动使用它
+
+--bare 直接在 <path> 中创建仓库，没有 worktree，通常作为共享的远程仓库
 */
 
+var _initObjectFormat string
+var _initCompat bool
+var _initBare bool
+
 func init() {
+	initCmd.Flags().StringVar(&_initObjectFormat, "object-format", model.ObjectFormatSHA1, "the hash algorithm to use, sha1 or sha256")
+	initCmd.Flags().BoolVar(&_initCompat, "compat", false, "create a standard .git repository that git can also use")
+	initCmd.Flags().BoolVar(&_initBare, "bare", false, "create a bare repository without a work tree")
 	rootCmd.AddCommand(initCmd)
 }
 
 var initCmd = &cobra.Command{
-	Use:   "init <path>",
+	Use:   "init [--object-format=<format>] [--compat] [--bare] <path>",
 	Short: "Initialize a git directory",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		_, err := model.CreateRepository(args[0])
-		if err != nil {
-			panic(err)
-		}
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := model.CreateRepository(args[0], _initObjectFormat, _initCompat, _initBare)
+		return err
 	},
 }
@@ -2,58 +2,70 @@ package cmd
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/ignorantshr/mgit/model"
 	"github.com/spf13/cobra"
 )
 
+var _logMaxCount int
+
 func init() {
+	logCmd.Flags().IntVarP(&_logMaxCount, "max-count", "n", -1, "limit the number of commits to output")
 	rootCmd.AddCommand(logCmd)
 }
 
 var logCmd = &cobra.Command{
-	Use:   "log [commit]",
+	Use:   "log [-n <number>] [commit]",
 	Short: "Display history of a given commit",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
 		var sha string
 		if len(args) >= 1 {
 			sha = args[0]
 		} else {
 			sha = "HEAD"
 		}
-		sha = model.FindObject(repo, sha, "", true)
-		logPrint(repo, sha)
+		sha, err = model.FindObject(repo, sha, "commit", true)
+		if err != nil {
+			return err
+		}
+		return logPrint(repo, sha, _logMaxCount)
 	},
 }
 
-func logPrint(repo *model.Repository, sha string) {
-	if sha == "" {
-		return
-	}
-	commit := model.ReadObject(repo, sha).(*model.CommitObj)
-	kv := commit.KV()
-	msg := kv.Message
-	author := strings.Split(kv.Author, " ")
-	ts, _ := strconv.Atoi(author[2])
-
-	fmt.Println("commit", sha)
-	fmt.Println("Author:", author[0], author[1])
-	fmt.Println("Date:  ", time.Unix(int64(ts), 0))
-	fmt.Println()
-	fmt.Println("    " + msg)
-	fmt.Println()
-
-	parent := kv.Parent
-	if len(parent) == 0 {
-		return
-	}
+// 按提交时间从新到旧输出，遍历时通过 commit-graph 获取 parent，只有要输出的 commit 才需要解析
+func logPrint(repo *model.Repository, sha string, maxCount int) error {
+	var readErr error
+	err := model.WalkCommits(repo, []string{sha}, func(info *model.CommitInfo) bool {
+		if maxCount == 0 {
+			return false
+		}
+		maxCount--
 
-	ps := strings.Split(parent, "\n")
-	for _, p := range ps {
-		logPrint(repo, p)
+		obj, err := model.ReadObject(repo, info.Sha)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		kv := obj.(*model.CommitObj).KV()
+		msg := kv.Message
+		fmt.Println("commit", info.Sha)
+		if who, ts, err := model.ParseIdent(kv.Author); err == nil {
+			fmt.Println("Author:", who)
+			fmt.Println("Date:  ", ts)
+		} else {
+			fmt.Println("Author:", kv.Author)
+		}
+		fmt.Println()
+		fmt.Println("    " + msg)
+		fmt.Println()
+		return true
+	})
+	if err != nil {
+		return err
 	}
+	return readErr
 }
@@ -17,39 +17,59 @@ import (
 */
 
 var _lsFilesVerbose bool
+var _lsFilesStage bool
+var _lsFilesUnmerged bool
 
 func init() {
 	lsFilesCmd.Flags().BoolVarP(&_lsFilesVerbose, "verbose", "v", false, "Show everything")
+	lsFilesCmd.Flags().BoolVarP(&_lsFilesStage, "stage", "s", false, "Show mode, object name and stage number")
+	lsFilesCmd.Flags().BoolVarP(&_lsFilesUnmerged, "unmerged", "u", false, "Show only unmerged files (implies --stage)")
 	rootCmd.AddCommand(lsFilesCmd)
 }
 
 var lsFilesCmd = &cobra.Command{
 	Use:   "ls-files",
 	Short: "List all the stage files",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		lsFiles(repo, _lsFilesVerbose)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return lsFiles(repo, _lsFilesVerbose, _lsFilesStage || _lsFilesUnmerged, _lsFilesUnmerged)
 	},
 }
 
 var _modeType = map[int]string{
-	0b1000: "regular",
-	0b1010: "symlink",
-	0b1110: "gitlink",
+	model.ModeTypeRegular: "regular",
+	model.ModeTypeSymlink: "symlink",
+	model.ModeTypeGitlink: "gitlink",
 }
 
-func lsFiles(repo *model.Repository, verbose bool) {
-	index := model.ReadIndex(repo)
+func lsFiles(repo *model.Repository, verbose, stage, unmerged bool) error {
+	index, err := model.ReadIndex(repo)
+	if err != nil {
+		return err
+	}
 	if verbose {
 		fmt.Printf("Index file v%d, %d entries\n", index.Version, len(index.Entries))
 	}
 
 	entries := index.Entries
 	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name < entries[j].Name
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Stage() < entries[j].Stage()
 	})
 	for _, v := range entries {
-		fmt.Println(v.Name)
+		if unmerged && v.Stage() == model.StageMerged {
+			continue
+		}
+		if stage {
+			fmt.Printf("%06o %s %d\t%s\n", v.Mode(), v.Sha, v.Stage(), v.Name)
+		} else {
+			fmt.Println(v.Name)
+		}
 		if verbose {
 			fmt.Printf("\t%v with perms: %v\n", _modeType[v.ModeType], v.ModePerms)
 			fmt.Printf("\ton blob: %v\n", v.Sha)
@@ -58,7 +78,9 @@ func lsFiles(repo *model.Repository, verbose bool) {
 			u, _ := user.LookupId(strconv.Itoa(v.Uid))
 			g, _ := user.LookupGroupId(strconv.Itoa(v.Gid))
 			fmt.Printf("\tuser: %v(%v), group: %v(%v)\n", u.Username, v.Uid, g.Name, v.Gid)
-			fmt.Printf("\tflags: stage=%v assume_valid=%v\n", v.FlagStage, v.FlagAssumValid)
+			fmt.Printf("\tflags: stage=%v assume_valid=%v skip_worktree=%v intent_to_add=%v\n",
+				v.Stage(), v.FlagAssumValid, v.SkipWorktree, v.IntentToAdd)
 		}
 	}
+	return nil
 }
@@ -6,7 +6,6 @@ import (
 	"strings"
 
 	"github.com/ignorantshr/mgit/model"
-	"github.com/ignorantshr/mgit/util"
 	"github.com/spf13/cobra"
 )
 
@@ -26,18 +25,25 @@ var lsTreeCmd = &cobra.Command{
 	Use:   "ls-tree <tree>",
 	Short: "Pretty-print a tree object.",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		lsTree(repo, args[0], "", *_recur)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return lsTree(repo, args[0], "", *_recur)
 	},
 }
 
-func lsTree(repo *model.Repository, ref, prefix string, recursive bool) {
-	sha := model.FindObject(repo, ref, "tree", true)
-	if sha == "" {
-		return
+func lsTree(repo *model.Repository, ref, prefix string, recursive bool) error {
+	sha, err := model.FindObject(repo, ref, "tree", true)
+	if err != nil {
+		return err
+	}
+	tree, err := model.ReadObject(repo, sha)
+	if err != nil {
+		return err
 	}
-	obj := model.ReadObject(repo, sha).(*model.TreeObj)
+	obj := tree.(*model.TreeObj)
 
 	typ := ""
 	for _, v := range obj.Items() {
@@ -56,13 +62,16 @@ func lsTree(repo *model.Repository, ref, prefix string, recursive bool) {
 		case "16":
 			typ = "commit"
 		default:
-			util.PanicErr(fmt.Errorf("unacknowledged format: %s", typ))
+			return fmt.Errorf("unacknowledged format: %s", typ)
 		}
 
 		if recursive && typ == "tree" {
-			lsTree(repo, ref, path.Join(prefix, v.Path), recursive)
+			if err := lsTree(repo, v.Sha, path.Join(prefix, v.Path), recursive); err != nil {
+				return err
+			}
 		} else { // leaf
 			fmt.Printf("%v %v %v\t%v\n", strings.Repeat("0", 6-len(v.Mode))+v.Mode, typ, v.Sha, path.Join(prefix, v.Path))
 		}
 	}
+	return nil
 }
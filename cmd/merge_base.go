@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git merge-base
+
+找出两个 commit 的最佳公共祖先；--is-ancestor 判断第一个 commit 是否为第二个的祖先，结果通过退出状态返回
+*/
+
+var _mergeBaseIsAncestor bool
+
+func init() {
+	mergeBaseCmd.Flags().BoolVar(&_mergeBaseIsAncestor, "is-ancestor", false, "check if the first commit is an ancestor of the second")
+	rootCmd.AddCommand(mergeBaseCmd)
+}
+
+var mergeBaseCmd = &cobra.Command{
+	Use:   "merge-base [--is-ancestor] <commit> <commit>",
+	Short: "Find as good common ancestors as possible for a merge.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		a, err := model.FindObject(repo, args[0], "commit", true)
+		if err != nil {
+			return err
+		}
+		b, err := model.FindObject(repo, args[1], "commit", true)
+		if err != nil {
+			return err
+		}
+
+		if _mergeBaseIsAncestor {
+			ok, err := model.IsAncestor(repo, a, b)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return exitError(exitFailure)
+			}
+			return nil
+		}
+
+		bases, err := model.MergeBases(repo, a, b)
+		if err != nil {
+			return err
+		}
+		if len(bases) == 0 {
+			return exitError(exitFailure)
+		}
+		fmt.Println(bases[0])
+		return nil
+	},
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git read-tree
+
+把 tree 读入 index，不修改 worktree。规则与 git 的 unpack-trees 相同：
+  - read-tree <tree>：用 tree 替换 index 的全部内容
+  - read-tree -m <tree>：同上，内容没有变化的条目保留原有的元数据
+  - read-tree -m <H> <M>：从 H 切换到 M，index 中相对 H 的修改保留下来，与 M 冲突时失败
+  - read-tree -m <base> <ours> <theirs>：三方合并，只有一方修改的路径直接合并为 stage 0，
+    其余有差异的路径保存为 stage 1/2/3，index 与 ours 不同的路径被合并修改时失败
+使用 -m 时被替换或删除的条目对应的文件必须没有修改
+*/
+
+var _readTreeMerge bool
+
+func init() {
+	readTreeCmd.Flags().BoolVarP(&_readTreeMerge, "merge", "m", false, "perform a merge in addition to a read")
+	rootCmd.AddCommand(readTreeCmd)
+}
+
+var readTreeCmd = &cobra.Command{
+	Use:   "read-tree [-m] <tree-ish1> [<tree-ish2> [<tree-ish3>]]",
+	Short: "Reads tree information into the index",
+	Args:  cobra.RangeArgs(1, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !_readTreeMerge && len(args) > 1 {
+			return &usageError{cmd.CommandPath(), errors.New("reading more than one tree requires -m")}
+		}
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return readTree(repo, args, _readTreeMerge)
+	},
+}
+
+func readTree(repo *model.Repository, treeishes []string, merge bool) error {
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+	if merge && index.HasUnmerged() {
+		return errors.New("you need to resolve your current index first")
+	}
+
+	trees := make([]map[string]*model.IndexEntry, len(treeishes))
+	for k, t := range treeishes {
+		if trees[k], err = readTreeEntries(repo, t); err != nil {
+			return err
+		}
+	}
+
+	current := map[string]*model.IndexEntry{}
+	if merge {
+		for _, e := range index.Entries {
+			current[e.Name] = e
+		}
+	}
+
+	var entries []*model.IndexEntry
+	switch len(trees) {
+	case 1:
+		entries = onewayMerge(current, trees[0])
+	case 2:
+		entries, err = twowayMerge(current, trees[0], trees[1])
+	case 3:
+		entries, err = threewayMerge(current, trees[0], trees[1], trees[2])
+	}
+	if err != nil {
+		return err
+	}
+	if err := verifyUptodate(repo, current, entries); err != nil {
+		return err
+	}
+
+	index.Entries = entries
+	index.Tree = nil
+	index.ResolveUndo = nil
+	// 读入的是完整的 tree，所有目录的 tree 对象都已经存在，直接生成 cached tree
+	if len(trees) == 1 {
+		if _, err := model.Index2Tree(repo, index); err != nil {
+			return err
+		}
+	}
+	return model.WriteIndex(repo, index)
+}
+
+// 被替换或删除的条目在 worktree 中的文件不能有修改，否则之后检出合并结果时会丢失这些修改
+func verifyUptodate(repo *model.Repository, current map[string]*model.IndexEntry, entries []*model.IndexEntry) error {
+	if repo.IsBare() {
+		return nil
+	}
+	kept := map[*model.IndexEntry]bool{}
+	for _, e := range entries {
+		kept[e] = true
+	}
+	for _, name := range mergePaths(current) {
+		if i := current[name]; !kept[i] {
+			_, modified, err := worktreeFileChanged(repo, i)
+			if err != nil {
+				return err
+			}
+			if modified {
+				return fmt.Errorf("Entry '%s' not uptodate. Cannot merge.", name)
+			}
+		}
+	}
+	return nil
+}
+
+// tree 中的所有文件，条目没有元数据
+func readTreeEntries(repo *model.Repository, treeish string) (map[string]*model.IndexEntry, error) {
+	shas, err := model.Tree2Map(repo, treeish, "")
+	if err != nil {
+		return nil, err
+	}
+	modes, err := model.Tree2ModeMap(repo, treeish, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*model.IndexEntry, len(shas))
+	for name, sha := range shas {
+		mode, err := strconv.ParseInt(modes[name], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid mode %q", name, modes[name])
+		}
+		e := &model.IndexEntry{Sha: sha, Name: name}
+		e.SetMode(int(mode))
+		res[name] = e
+	}
+	return res, nil
+}
+
+// 两个条目的内容相同，都不存在也算相同
+func sameEntry(a, b *model.IndexEntry) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Mode() == b.Mode() && a.Sha == b.Sha
+}
+
+// 使用 e，与 index 中原有的条目 old 相同时保留 old 的元数据
+func mergedEntry(e, old *model.IndexEntry) *model.IndexEntry {
+	if sameEntry(e, old) {
+		return old
+	}
+	return e
+}
+
+func rejectMerge(name string) error {
+	return fmt.Errorf("Entry '%s' would be overwritten by merge. Cannot merge.", name)
+}
+
+// 所有出现过的路径，排序后输出的错误是确定的
+func mergePaths(maps ...map[string]*model.IndexEntry) []string {
+	set := map[string]struct{}{}
+	for _, m := range maps {
+		for name := range m {
+			set[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func onewayMerge(current, tree map[string]*model.IndexEntry) []*model.IndexEntry {
+	entries := make([]*model.IndexEntry, 0, len(tree))
+	for name, e := range tree {
+		entries = append(entries, mergedEntry(e, current[name]))
+	}
+	return entries
+}
+
+// 从 head 切换到 next
+func twowayMerge(current, head, next map[string]*model.IndexEntry) ([]*model.IndexEntry, error) {
+	entries := []*model.IndexEntry{}
+	for _, name := range mergePaths(current, head, next) {
+		i, h, m := current[name], head[name], next[name]
+		if i == nil {
+			// index 中删除了 h：m 与 h 相同时保持删除，否则冲突
+			if m != nil && h != nil && !sameEntry(h, m) {
+				return nil, rejectMerge(name)
+			}
+			if m != nil && h == nil {
+				entries = append(entries, m)
+			}
+			continue
+		}
+
+		switch {
+		case sameEntry(i, m), h == nil && m == nil, h != nil && m != nil && sameEntry(h, m):
+			// 切换不影响这个路径，或者 index 中已经是切换后的内容
+			entries = append(entries, i)
+		case h != nil && m == nil && sameEntry(i, h):
+			// 切换后删除
+		case h != nil && m != nil && sameEntry(i, h):
+			entries = append(entries, m)
+		default:
+			return nil, rejectMerge(name)
+		}
+	}
+	return entries, nil
+}
+
+func threewayMerge(current, base, ours, theirs map[string]*model.IndexEntry) ([]*model.IndexEntry, error) {
+	entries := []*model.IndexEntry{}
+	for _, name := range mergePaths(current, base, ours, theirs) {
+		i, o, a, b := current[name], base[name], ours[name], theirs[name]
+		oursChanged, theirsChanged := !sameEntry(o, a), !sameEntry(o, b)
+
+		// 只有 theirs 修改了，index 与 ours 或 theirs 相同即可
+		if b != nil && !oursChanged && theirsChanged {
+			if i != nil && !sameEntry(i, a) && !sameEntry(i, b) {
+				return nil, rejectMerge(name)
+			}
+			entries = append(entries, mergedEntry(b, i))
+			continue
+		}
+		// 其余情况 index 必须与 ours 相同
+		if i != nil && !sameEntry(i, a) {
+			return nil, rejectMerge(name)
+		}
+		if a != nil && (sameEntry(a, b) || !theirsChanged && oursChanged) {
+			entries = append(entries, mergedEntry(a, i))
+			continue
+		}
+		if a == nil && b == nil && o == nil {
+			continue
+		}
+
+		// 冲突，包括被删除的路径，留给之后的合并处理
+		for k, e := range []*model.IndexEntry{o, a, b} {
+			if e == nil {
+				continue
+			}
+			conflict := *e
+			conflict.SetStage(k + 1)
+			entries = append(entries, &conflict)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git repack
+
+把所有可达对象打包进一个 packfile，可选地删除冗余的 loose object 和旧的 packfile
+*/
+
+var _repackDelete bool
+
+func init() {
+	repackCmd.Flags().BoolVarP(&_repackDelete, "delete", "d", false, "remove redundant packs and loose objects after packing")
+	rootCmd.AddCommand(repackCmd)
+}
+
+var repackCmd = &cobra.Command{
+	Use:   "repack [-d]",
+	Short: "Pack all reachable objects into a single pack.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		_, _, err = repack(repo, _repackDelete)
+		return err
+	},
+}
+
+// 返回新 pack 的名称和所有可达对象
+func repack(repo *model.Repository, deleteRedundant bool) (string, map[string]string, error) {
+	roots, err := model.RootObjects(repo)
+	if err != nil {
+		return "", nil, err
+	}
+	reachable, err := model.ReachableObjects(repo, roots)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reachable) == 0 {
+		fmt.Println("Nothing new to pack.")
+		return "", reachable, nil
+	}
+
+	// alternates 中的对象属于其他仓库，不打包进来
+	shas := make([]string, 0, len(reachable))
+	for sha := range reachable {
+		if repo.HasLocalObject(sha) {
+			shas = append(shas, sha)
+		}
+	}
+	if len(shas) == 0 {
+		fmt.Println("Nothing new to pack.")
+		return "", reachable, nil
+	}
+	sort.Strings(shas)
+
+	name, err := model.WritePack(repo, shas, reachable)
+	if err != nil {
+		return "", nil, err
+	}
+	fmt.Printf("Wrote %s with %d objects\n", name, len(shas))
+
+	if deleteRedundant {
+		if err := model.RemovePacks(repo, name); err != nil {
+			return "", nil, err
+		}
+		// 只删除已打包的，不可达的 loose object 留给 gc 处理
+		if _, err := model.RemovePackedLooseObjects(repo); err != nil {
+			return "", nil, err
+		}
+	}
+	return name, reachable, nil
+}
@@ -24,12 +24,20 @@ var revParseCmd = &cobra.Command{
 	Short:                 "Parse revision (or other objects) identifiers",
 	DisableFlagsInUseLine: true,
 	Args:                  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(args[0])
-		revParse(repo, args[0], revParseType)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return revParse(repo, args[0], revParseType)
 	},
 }
 
-func revParse(repo *model.Repository, name, format string) {
-	fmt.Println(model.FindObject(repo, name, format, true))
+func revParse(repo *model.Repository, name, format string) error {
+	sha, err := model.FindObject(repo, name, format, true)
+	if err != nil {
+		return err
+	}
+	fmt.Println(sha)
+	return nil
 }
@@ -1,10 +1,6 @@
 package cmd
 
 import (
-	"path"
-	"path/filepath"
-	"strings"
-
 	"github.com/ignorantshr/mgit/model"
 	"github.com/spf13/cobra"
 )
@@ -17,37 +13,53 @@ var rmCmd = &cobra.Command{
 	Use:   "rm <path ...>",
 	Short: "Remove files from the index.",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		rm(repo, args)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		return rm(repo, args)
 	},
 }
 
 // 过滤出不删除的条目，重写 index 文件
-func rm(repo *model.Repository, paths []string) {
-	index := model.ReadIndex(repo)
-
-	worktree := repo.Worktree() + string(filepath.Separator)
-	abspaths := map[string]struct{}{}
+func rm(repo *model.Repository, paths []string) error {
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
 
+	names := []string{}
 	for _, p := range paths {
-		p, _ = filepath.Abs(p)
-		if strings.HasPrefix(p, worktree) {
-			abspaths[p] = struct{}{}
+		name, err := indexPath(repo, p)
+		if err != nil {
+			return err
 		}
+		names = append(names, name)
 	}
+	removePaths(index, names)
+	return model.WriteIndex(repo, index)
+}
 
-	keptEntries := []*model.IndexEntry{}
+// 从 index 中删除 names 对应的条目
+func removePaths(index *model.Index, names []string) {
+	set := map[string]struct{}{}
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
 
+	// 同一路径冲突时有多个 stage 的条目，Remove 会全部删除
+	removed := []string{}
 	for _, e := range index.Entries {
-		fullPath := path.Join(repo.Worktree(), e.Name)
-		if _, ok := abspaths[fullPath]; ok {
-			delete(abspaths, fullPath)
-		} else {
-			keptEntries = append(keptEntries, e)
+		if _, ok := set[e.Name]; ok {
+			removed = append(removed, e.Name)
 		}
 	}
-
-	index.Entries = keptEntries
-	model.WriteIndex(repo, index)
+	for _, name := range removed {
+		index.Remove(name)
+	}
 }
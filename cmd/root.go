@@ -1,21 +1,85 @@
 package cmd
 
 import (
-	"fmt"
+	"errors"
 	"os"
+	"path/filepath"
 
+	"github.com/ignorantshr/mgit/model"
 	"github.com/spf13/cobra"
 )
 
+var (
+	_rootChdir    []string
+	_rootGitDir   string
+	_rootWorkTree string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringArrayVarP(&_rootChdir, "chdir", "C", nil, "run as if mgit was started in <path> instead of the current directory")
+	rootCmd.PersistentFlags().StringVar(&_rootGitDir, "git-dir", "", "set the path to the repository, same as "+model.EnvDir)
+	rootCmd.PersistentFlags().StringVar(&_rootWorkTree, "work-tree", "", "set the path to the working tree, same as "+model.EnvWorkTree)
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "mgit",
 	Short: "mine git",
 	Long:  "simulate a git from https://wyag.thb.lt/",
+
+	// 错误统一由 Execute 输出
+	SilenceErrors: true,
+	SilenceUsage:  true,
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// cobra 在 PersistentPreRun 之后才检查必填参数，这里提前检查，以便作为参数错误处理
+		if err := cmd.ValidateRequiredFlags(); err != nil {
+			return &usageError{cmd.CommandPath(), err}
+		}
+		if err := cmd.ValidateFlagGroups(); err != nil {
+			return &usageError{cmd.CommandPath(), err}
+		}
+		_running = true
+		return applyRootFlags()
+	},
 }
 
+// 依次切换到 -C 指定的目录，--git-dir 和 --work-tree 通过环境变量传给 model.FindRepo，
+// 相对路径都基于切换之后的目录
+func applyRootFlags() error {
+	for _, dir := range _rootChdir {
+		if dir == "" {
+			continue
+		}
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	for env, p := range map[string]string{model.EnvDir: _rootGitDir, model.EnvWorkTree: _rootWorkTree} {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Setenv(env, abs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 参数校验通过，命令已经开始执行；在此之前的错误都是参数错误
+var _running bool
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	cmd, err := rootCmd.ExecuteC()
+	if err == nil {
+		return
+	}
+	var usage *usageError
+	if !_running && !errors.As(err, &usage) {
+		err = &usageError{cmd.CommandPath(), err}
 	}
+	exitWithError(err)
 }
@@ -19,10 +19,17 @@ func init() {
 var showRefCmd = &cobra.Command{
 	Use:   "show-ref",
 	Short: "List references.",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		refs := model.ListRef(repo, "")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		refs, err := model.ListRef(repo, "")
+		if err != nil {
+			return err
+		}
 		showRef(repo, refs, true, "")
+		return nil
 	},
 }
 
@@ -1,15 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
-	"syscall"
-	"time"
 
 	"github.com/ignorantshr/mgit/model"
 	"github.com/ignorantshr/mgit/util"
@@ -28,40 +26,84 @@ func init() {
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show the working tree status.",
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
-		status(repo)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		return status(repo)
 	},
 }
 
-func status(repo *model.Repository) {
-	index := model.ReadIndex(repo)
+func status(repo *model.Repository) error {
+	index, err := model.ReadIndex(repo)
+	if err != nil {
+		return err
+	}
 
-	statusBranch(repo)
-	statusHeadIndex(repo, index)
-	statusHeadWorktree(repo, index)
+	if err := statusBranch(repo); err != nil {
+		return err
+	}
+	if err := statusHeadIndex(repo, index); err != nil {
+		return err
+	}
+	statusUnmerged(index)
+	return statusHeadWorktree(repo, index)
 }
 
-func statusBranch(repo *model.Repository) {
-	branch := model.GetActiveBranch(repo)
+func statusBranch(repo *model.Repository) error {
+	branch, err := model.GetActiveBranch(repo)
+	if err != nil {
+		return err
+	}
 	if branch != "" {
 		fmt.Printf("On branch %v.\n", branch)
-	} else {
-		fmt.Printf("HEAD detached at %v.\n", model.FindObject(repo, "HEAD", "", true))
+		return nil
 	}
+	sha, err := model.FindObject(repo, "HEAD", "", true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("HEAD detached at %v.\n", sha)
+	return nil
 }
 
 // Finding changes between HEAD and index
 // 将 index 文件和 HEAD 做对比，对比出将要提交的更改类型
-func statusHeadIndex(repo *model.Repository, index *model.Index) {
+func statusHeadIndex(repo *model.Repository, index *model.Index) error {
 	if len(index.Entries) != 0 {
 		fmt.Println("Changes to be committed:")
 	}
 
-	head := model.Tree2Map(repo, "HEAD", "")
+	// 还没有 commit 时 HEAD 为空
+	head, err := model.Tree2Map(repo, "HEAD", "")
+	if errors.Is(err, model.ErrObjectNotFound) {
+		head, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	headModes := map[string]string{}
+	if len(head) != 0 {
+		if headModes, err = model.Tree2ModeMap(repo, "HEAD", ""); err != nil {
+			return err
+		}
+	}
 	for _, v := range index.Entries {
+		// 冲突的路径在 Unmerged paths 中列出
+		if v.Stage() != model.StageMerged {
+			delete(head, v.Name)
+			continue
+		}
+		// add -N 的文件还没有内容，在 Changes not staged for commit 中列出
+		if v.IntentToAdd {
+			continue
+		}
 		if sha, ok := head[v.Name]; ok {
-			if sha != v.Sha {
+			if sha != v.Sha || headModes[v.Name] != fmt.Sprintf("%06o", v.Mode()) {
 				fmt.Printf("\tmodified: %s\n", v.Name)
 			}
 			delete(head, v.Name)
@@ -74,45 +116,83 @@ func statusHeadIndex(repo *model.Repository, index *model.Index) {
 		fmt.Printf("\tdeleted: %s", k)
 	}
 	fmt.Println()
+	return nil
+}
+
+// 冲突的类型由存在哪些 stage 决定，依次为 base、ours、theirs 是否存在
+var _unmergedLabels = map[[3]bool]string{
+	{true, false, false}: "both deleted",
+	{false, true, false}: "added by us",
+	{true, false, true}:  "deleted by us",
+	{false, false, true}: "added by them",
+	{true, true, false}:  "deleted by them",
+	{false, true, true}:  "both added",
+	{true, true, true}:   "both modified",
+}
+
+// 列出 index 中有冲突的路径
+func statusUnmerged(index *model.Index) {
+	conflicts := index.Unmerged()
+	if len(conflicts) == 0 {
+		return
+	}
+	fmt.Println("Unmerged paths:")
+	fmt.Println("  (use \"mgit add <file>...\" to mark resolution)")
+	for _, c := range conflicts {
+		var has [3]bool
+		for k, e := range c.Stages {
+			has[k] = e != nil
+		}
+		fmt.Printf("\t%s: %s\n", _unmergedLabels[has], c.Name)
+	}
+	fmt.Println()
 }
 
 // 将 index 文件和 文件系统 做对比，找出没有处于 stage 的更改
-func statusHeadWorktree(repo *model.Repository, index *model.Index) {
-	ignore := model.ReadGitignore(repo)
+func statusHeadWorktree(repo *model.Repository, index *model.Index) error {
+	ignore, err := model.ReadGitignore(repo)
+	if err != nil {
+		return err
+	}
 
-	allFiles := walkFilesystem(repo)
+	allFiles, err := walkFilesystem(repo)
+	if err != nil {
+		return err
+	}
 
 	// traverse the index, and compare real files with the cached versions.
 	if len(index.Entries) != 0 {
 		fmt.Println("Changes not staged for commit:")
 	}
 
+	added := []string{}
 	modified := []string{}
 	deleted := []string{}
 	for _, v := range index.Entries {
-		fullPath := path.Join(repo.Worktree(), v.Name)
-
-		if !util.IsFileExist(fullPath) {
+		if v.Stage() != model.StageMerged {
+			delete(allFiles, v.Name)
+			continue
+		}
+		isDeleted, isModified, err := worktreeFileChanged(repo, v)
+		if err != nil {
+			return err
+		}
+		if isDeleted {
 			deleted = append(deleted, v.Name)
-		} else {
-			stat, _ := os.Stat(fullPath)
-			ctimeNS := v.Ctime.S*int64(math.Pow10(9)) + v.Ctime.NS
-			mtimeNS := v.Mtime.S*int64(math.Pow10(9)) + v.Mtime.NS
-			fstat := stat.Sys().(*syscall.Stat_t)
-
-			// 将操作系统特定的时间戳转换为 Go 中的时间类型
-			ctime := time.Unix(int64(fstat.Ctimespec.Sec), int64(fstat.Ctimespec.Nsec))
-			if ctimeNS != ctime.UnixNano() || mtimeNS != stat.ModTime().UnixNano() {
-				newSha := hashObject(fullPath, "blob", nil)
-				if newSha != v.Sha {
-					modified = append(modified, v.Name)
-				}
-			}
+		} else if v.IntentToAdd {
+			added = append(added, v.Name)
+		} else if isModified {
+			modified = append(modified, v.Name)
 		}
 
 		delete(allFiles, v.Name)
 	}
 
+	sort.Strings(added)
+	for _, name := range added {
+		fmt.Printf("\tnew file: %v\n", name)
+	}
+
 	sort.Strings(modified)
 	for _, name := range modified {
 		fmt.Printf("\tmodified: %v\n", name)
@@ -130,7 +210,11 @@ func statusHeadWorktree(repo *model.Repository, index *model.Index) {
 		fmt.Println("Untracked files:")
 
 		for f := range allFiles {
-			if !model.CheckIgnore(f, ignore) {
+			ignored, err := model.CheckIgnore(f, ignore)
+			if err != nil {
+				return err
+			}
+			if !ignored {
 				untracked = append(untracked, f)
 			}
 		}
@@ -140,10 +224,47 @@ func statusHeadWorktree(repo *model.Repository, index *model.Index) {
 	for _, name := range untracked {
 		fmt.Printf("\t%v\n", name)
 	}
+	return nil
+}
+
+// 比较 worktree 中的文件和 index 条目，内容或 mode 不同时为 modified
+func worktreeFileChanged(repo *model.Repository, e *model.IndexEntry) (deleted, modified bool, err error) {
+	// update-index --assume-unchanged / --skip-worktree 的文件不检查
+	if e.FlagAssumValid || e.SkipWorktree {
+		return false, false, nil
+	}
+	fullPath := path.Join(repo.Worktree(), e.Name)
+	stat, err := util.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	// intent-to-add 的条目没有内容，文件存在即为修改
+	if e.IntentToAdd {
+		return false, true, nil
+	}
+	// 元数据没有变化时认为内容也没有变化，否则比较内容
+	if !e.StatChanged(stat) {
+		return false, false, nil
+	}
+	mode, err := worktreeFileMode(repo, stat, e)
+	if err != nil {
+		return false, false, err
+	}
+	if mode != e.Mode() {
+		return false, true, nil
+	}
+	sha, err := hashWorktreeFile(repo, fullPath, stat, false)
+	if err != nil {
+		return false, false, err
+	}
+	return false, sha != e.Sha, nil
 }
 
 // 记录仓库下所有的文件
-func walkFilesystem(repo *model.Repository) map[string]struct{} {
+func walkFilesystem(repo *model.Repository) (map[string]struct{}, error) {
 	allFiles := make(map[string]struct{}, 0)
 
 	var cur string
@@ -152,7 +273,9 @@ func walkFilesystem(repo *model.Repository) map[string]struct{} {
 	for len(queue) != 0 {
 		cur = queue[0]
 		subFiles, err := os.ReadDir(cur)
-		util.PanicErr(err)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, v := range subFiles {
 			if strings.HasPrefix(cur, repo.GitDir()) || v.Name() == ".git" || v.Name() == model.GitDir {
@@ -162,7 +285,9 @@ func walkFilesystem(repo *model.Repository) map[string]struct{} {
 			fullPath := path.Join(cur, v.Name())
 			if !v.IsDir() {
 				relPath, err := filepath.Rel(repo.Worktree(), fullPath) // 获取从前者到后者的相对路径
-				util.PanicErr(err)
+				if err != nil {
+					return nil, err
+				}
 				allFiles[relPath] = struct{}{}
 			} else {
 				queue = append(queue, fullPath)
@@ -171,5 +296,5 @@ func walkFilesystem(repo *model.Repository) map[string]struct{} {
 		queue = queue[1:]
 	}
 
-	return allFiles
+	return allFiles, nil
 }
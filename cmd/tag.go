@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ignorantshr/mgit/model"
 	"github.com/spf13/cobra"
@@ -25,37 +26,53 @@ var tagCmd = &cobra.Command{
 	Use:   "tag | tag <name> [object]",
 	Short: "List and create tags",
 	Args:  cobra.RangeArgs(0, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		repo := model.FindRepo(".")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
 		if len(args) != 0 {
 			if _createTagObj && _tagMsg == "" {
 				fmt.Println("annotated tag must be with a message")
 			}
 			if len(args) == 1 || args[1] == "" {
-				createTag(repo, args[0], "HEAD", _createTagObj)
-			} else {
-				createTag(repo, args[0], args[1], _createTagObj)
+				return createTag(repo, args[0], "HEAD", _createTagObj)
 			}
-		} else {
-			refs := model.ListRef(repo, "")
-			showRef(repo, refs["tags"].(map[string]any), false, "")
+			return createTag(repo, args[0], args[1], _createTagObj)
+		}
+
+		refs, err := model.ListRef(repo, "")
+		if err != nil {
+			return err
+		}
+		if tags, ok := refs["tags"].(map[string]any); ok {
+			showRef(repo, tags, false, "")
 		}
+		return nil
 	},
 }
 
-func createTag(repo *model.Repository, name, ref string, createObj bool) {
-	sha := model.FindObject(repo, ref, "", true)
+func createTag(repo *model.Repository, name, ref string, createObj bool) error {
+	sha, err := model.FindObject(repo, ref, "", true)
+	if err != nil {
+		return err
+	}
 
 	if createObj {
 		// create a tag object
 		tag := model.NewTagObj()
 		tag.KV().Object = sha
 		tag.KV().Tag = name
-		tag.KV().Tagger = readGitAuthor()
+		tagger, err := readGitAuthor(repo)
+		if err != nil {
+			return err
+		}
+		tag.KV().Tagger = model.Ident(tagger, time.Now())
 		tag.KV().Message = "A tag generated by mgit, which won't let you customize the message!"
-		tag_sha := model.WriteObject(repo, tag)
-		model.CreateRef(repo, "tags/"+name, tag_sha)
-	} else {
-		model.CreateRef(repo, "tags/"+name, sha)
+		sha, err = model.WriteObject(repo, tag)
+		if err != nil {
+			return err
+		}
 	}
+	return model.CreateRef(repo, "tags/"+name, sha)
 }
@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/ignorantshr/mgit/util"
+	"github.com/spf13/cobra"
+)
+
+/* git update-index
+
+直接修改 index 的底层命令：
+  - <file>：用 worktree 中的文件更新条目，index 中没有的文件需要 --add，已经删除的文件需要 --remove
+  - --cacheinfo <mode>,<sha>,<path>：直接写入条目，文件和对象都不需要存在
+  - --index-info：从 stdin 读取条目，格式同 ls-tree 或 ls-files -s 的输出，mode 为 0 时删除路径
+  - --refresh：只更新元数据，内容有变化的文件输出 needs update
+  - --assume-unchanged、--skip-worktree 等只修改 <file> 条目的标记，不读取文件
+
+--cacheinfo 和 --index-info 中的路径相对于 worktree 的根目录，<file> 相对于当前目录
+*/
+
+type updateIndexOptions struct {
+	add, remove     bool
+	cacheinfo       []string
+	chmod           string // "+x" 或 "-x"
+	assumeUnchanged *bool  // nil 表示不修改
+	skipWorktree    *bool
+	refresh         bool
+	indexInfo       bool
+}
+
+var (
+	_updateIndexAdd               bool
+	_updateIndexRemove            bool
+	_updateIndexCacheinfo         []string
+	_updateIndexChmod             string
+	_updateIndexAssumeUnchanged   bool
+	_updateIndexNoAssumeUnchanged bool
+	_updateIndexSkipWorktree      bool
+	_updateIndexNoSkipWorktree    bool
+	_updateIndexRefresh           bool
+	_updateIndexInfo              bool
+)
+
+func init() {
+	flags := updateIndexCmd.Flags()
+	flags.BoolVar(&_updateIndexAdd, "add", false, "add files that are not in the index yet")
+	flags.BoolVar(&_updateIndexRemove, "remove", false, "remove files that are in the index but missing from the work tree")
+	flags.StringArrayVar(&_updateIndexCacheinfo, "cacheinfo", nil, "add the specified entry to the index: <mode>,<sha>,<path>")
+	flags.StringVar(&_updateIndexChmod, "chmod", "", "override the executable bit of the listed files: (+|-)x")
+	flags.BoolVar(&_updateIndexAssumeUnchanged, "assume-unchanged", false, "mark files as \"not changing\"")
+	flags.BoolVar(&_updateIndexNoAssumeUnchanged, "no-assume-unchanged", false, "clear assumed-unchanged bit")
+	flags.BoolVar(&_updateIndexSkipWorktree, "skip-worktree", false, "mark files as \"index-only\"")
+	flags.BoolVar(&_updateIndexNoSkipWorktree, "no-skip-worktree", false, "clear skip-worktree bit")
+	flags.BoolVar(&_updateIndexRefresh, "refresh", false, "refresh stat information")
+	flags.BoolVar(&_updateIndexInfo, "index-info", false, "read list of index entries from stdin")
+	rootCmd.AddCommand(updateIndexCmd)
+}
+
+var updateIndexCmd = &cobra.Command{
+	Use:   "update-index [<options>] [--] [<file>...]",
+	Short: "Register file contents in the working tree to the index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		usage := func(msg string) error {
+			return &usageError{cmd.CommandPath(), errors.New(msg)}
+		}
+		opts := &updateIndexOptions{
+			add:       _updateIndexAdd,
+			remove:    _updateIndexRemove,
+			cacheinfo: _updateIndexCacheinfo,
+			chmod:     _updateIndexChmod,
+			refresh:   _updateIndexRefresh,
+			indexInfo: _updateIndexInfo,
+		}
+		if opts.chmod != "" && opts.chmod != "+x" && opts.chmod != "-x" {
+			return usage("option 'chmod' expects \"+x\" or \"-x\"")
+		}
+		if _updateIndexAssumeUnchanged && _updateIndexNoAssumeUnchanged {
+			return usage("--assume-unchanged and --no-assume-unchanged are mutually exclusive")
+		}
+		if _updateIndexSkipWorktree && _updateIndexNoSkipWorktree {
+			return usage("--skip-worktree and --no-skip-worktree are mutually exclusive")
+		}
+		if cmd.Flags().Changed("assume-unchanged") || cmd.Flags().Changed("no-assume-unchanged") {
+			opts.assumeUnchanged = &_updateIndexAssumeUnchanged
+		}
+		if cmd.Flags().Changed("skip-worktree") || cmd.Flags().Changed("no-skip-worktree") {
+			opts.skipWorktree = &_updateIndexSkipWorktree
+		}
+
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		if err := repo.CheckWorktree(); err != nil {
+			return err
+		}
+		return updateIndex(repo, args, opts)
+	},
+}
+
+func updateIndex(repo *model.Repository, paths []string, opts *updateIndexOptions) error {
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock()
+
+	needsUpdate := false
+	if opts.refresh {
+		if needsUpdate, err = refreshIndex(repo, index); err != nil {
+			return err
+		}
+	}
+	for _, info := range opts.cacheinfo {
+		if err := updateIndexCacheinfo(repo, index, info, opts.add); err != nil {
+			return err
+		}
+	}
+	if opts.indexInfo {
+		if err := updateIndexInfo(repo, index, os.Stdin); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if err := updateIndexPath(repo, index, p, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := model.WriteIndex(repo, index); err != nil {
+		return err
+	}
+	if needsUpdate {
+		return exitError(exitFailure)
+	}
+	return nil
+}
+
+// 元数据有变化但内容没有变化的条目更新元数据，内容有变化或者有冲突时返回 true
+func refreshIndex(repo *model.Repository, index *model.Index) (bool, error) {
+	needsUpdate := false
+	reported := map[string]bool{}
+	for _, e := range index.Entries {
+		if e.Stage() != model.StageMerged {
+			if !reported[e.Name] {
+				fmt.Printf("%s: needs merge\n", e.Name)
+				reported[e.Name] = true
+			}
+			needsUpdate = true
+			continue
+		}
+		if e.FlagAssumValid || e.SkipWorktree {
+			continue
+		}
+
+		file := path.Join(repo.Worktree(), e.Name)
+		stat, err := util.Lstat(file)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err == nil && !e.StatChanged(stat) {
+			continue
+		}
+		if err == nil {
+			mode, err := worktreeFileMode(repo, stat, e)
+			if err != nil {
+				return false, err
+			}
+			sha, err := hashWorktreeFile(repo, file, stat, false)
+			if err != nil {
+				return false, err
+			}
+			if mode == e.Mode() && sha == e.Sha {
+				e.SetStat(stat)
+				continue
+			}
+		}
+		fmt.Printf("%s: needs update\n", e.Name)
+		needsUpdate = true
+	}
+	return needsUpdate, nil
+}
+
+func updateIndexCacheinfo(repo *model.Repository, index *model.Index, info string, allowAdd bool) error {
+	parts := strings.SplitN(info, ",", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("option 'cacheinfo' expects <mode>,<sha>,<path>")
+	}
+	e, err := newCacheEntry(repo, parts[0], parts[1], parts[2])
+	if err != nil {
+		return fmt.Errorf("--cacheinfo cannot add %s: %w", parts[2], err)
+	}
+	return setIndexEntry(index, e, allowAdd)
+}
+
+// 每行为 "<mode> <sha>\t<path>"、"<mode> <type> <sha>\t<path>" 或 "<mode> <sha> <stage>\t<path>"
+func updateIndexInfo(repo *model.Repository, index *model.Index, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		meta, name, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("malformed index info %s", line)
+		}
+		if strings.HasPrefix(name, `"`) {
+			unquoted, err := strconv.Unquote(name)
+			if err != nil {
+				return fmt.Errorf("malformed index info %s", line)
+			}
+			name = unquoted
+		}
+
+		mode, sha, stage := fields[0], fields[1], model.StageMerged
+		if len(fields) == 3 {
+			if n, err := strconv.Atoi(fields[2]); err == nil && len(fields[2]) == 1 {
+				if n > model.StageTheirs {
+					return fmt.Errorf("malformed index info %s", line)
+				}
+				stage = n
+			} else {
+				sha = fields[2] // 第二列是对象类型
+			}
+		}
+
+		// mode 为 0 表示删除
+		if mode == "0" {
+			index.Remove(name)
+			continue
+		}
+		e, err := newCacheEntry(repo, mode, sha, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", line, err)
+		}
+		e.SetStage(stage)
+		if err := setIndexEntry(index, e, true); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// 命令行中的路径在 index 中的名字，worktree 本身为 "."
+func indexPath(repo *model.Repository, p string) (string, error) {
+	abs := p
+	if !filepath.IsAbs(p) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		// 与 git 相同，当前目录不在 worktree 中时（例如指定了 --work-tree），相对路径基于 worktree 的根目录
+		if _, ok := worktreeRel(repo, cwd); !ok {
+			cwd = repo.Worktree()
+		}
+		abs = filepath.Join(cwd, p)
+	}
+	rel, ok := worktreeRel(repo, abs)
+	if !ok {
+		return "", fmt.Errorf("'%s' is outside repository", p)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// abs 相对于 worktree 根目录的路径，不在 worktree 中时 ok 为 false
+func worktreeRel(repo *model.Repository, abs string) (string, bool) {
+	rel, err := filepath.Rel(repo.Worktree(), abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func updateIndexPath(repo *model.Repository, index *model.Index, p string, opts *updateIndexOptions) error {
+	name, err := indexPath(repo, p)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return fmt.Errorf("'%s' is outside repository", p)
+	}
+	abs := filepath.Join(repo.Worktree(), name)
+	if err := verifyIndexPath(name); err != nil {
+		return fmt.Errorf("Unable to process path %s: %w", name, err)
+	}
+
+	inIndex := slices.ContainsFunc(index.Entries, func(e *model.IndexEntry) bool { return e.Name == name })
+
+	// 只修改标记
+	if opts.assumeUnchanged != nil || opts.skipWorktree != nil {
+		if !inIndex {
+			return fmt.Errorf("Unable to mark file %s", name)
+		}
+		for _, e := range index.Entries {
+			if e.Name != name {
+				continue
+			}
+			if opts.assumeUnchanged != nil {
+				e.FlagAssumValid = *opts.assumeUnchanged
+			}
+			if opts.skipWorktree != nil {
+				e.SkipWorktree = *opts.skipWorktree
+			}
+		}
+		return nil
+	}
+
+	stat, err := os.Lstat(abs)
+	switch {
+	case os.IsNotExist(err):
+		if !opts.remove {
+			return fmt.Errorf("%s: does not exist and --remove not passed", name)
+		}
+		index.Remove(name)
+		return nil
+	case err != nil:
+		return err
+	case stat.IsDir():
+		return fmt.Errorf("%s: is a directory - add individual files instead", name)
+	}
+
+	old := index.Entry(name, model.StageMerged)
+	if old == nil {
+		old = index.Entry(name, model.StageOurs)
+	}
+	e, err := worktreeEntry(repo, abs, name, old)
+	if err != nil {
+		return err
+	}
+	if opts.chmod != "" {
+		if e.ModeType != model.ModeTypeRegular {
+			return fmt.Errorf("cannot chmod %s '%s'", opts.chmod, name)
+		}
+		e.ModePerms = 0o644
+		if opts.chmod == "+x" {
+			e.ModePerms = 0o755
+		}
+	}
+	return setIndexEntry(index, e, opts.add)
+}
+
+// 根据 mode、sha、路径生成条目，mode 按 git 的规则规范化为 100644、100755、120000 或 160000
+func newCacheEntry(repo *model.Repository, modeStr, sha, name string) (*model.IndexEntry, error) {
+	mode, err := strconv.ParseInt(modeStr, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode %s", modeStr)
+	}
+	switch mode >> 12 {
+	case model.ModeTypeRegular:
+		if mode&0o100 != 0 {
+			mode = 0o100755
+		} else {
+			mode = 0o100644
+		}
+	case model.ModeTypeSymlink, model.ModeTypeGitlink:
+		mode &^= 0o7777
+	default:
+		return nil, fmt.Errorf("invalid mode %s", modeStr)
+	}
+	if !repo.IsFullSha(sha) {
+		return nil, fmt.Errorf("invalid object name %s", sha)
+	}
+	if err := verifyIndexPath(name); err != nil {
+		return nil, err
+	}
+
+	e := &model.IndexEntry{Sha: sha, Name: name}
+	e.SetMode(int(mode))
+	return e, nil
+}
+
+// index 中的路径不能为空、不能以 / 开头或结尾，也不能包含 .、.. 和仓库目录
+func verifyIndexPath(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("invalid path '%s'", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".", "..", ".git", model.GitDir:
+			return fmt.Errorf("invalid path '%s'", name)
+		}
+	}
+	return nil
+}
+
+// 加入或替换条目；allowAdd 为 false 时只能更新 index 中已有的路径
+func setIndexEntry(index *model.Index, e *model.IndexEntry, allowAdd bool) error {
+	if !slices.ContainsFunc(index.Entries, func(old *model.IndexEntry) bool { return old.Name == e.Name }) {
+		if !allowAdd {
+			return fmt.Errorf("%s: cannot add to the index - missing --add option?", e.Name)
+		}
+		// 不能同时作为文件和目录
+		for _, old := range index.Entries {
+			if strings.HasPrefix(old.Name, e.Name+"/") || strings.HasPrefix(e.Name, old.Name+"/") {
+				return fmt.Errorf("'%s' appears as both a file and as a directory", e.Name)
+			}
+		}
+	}
+	index.Set(e)
+	return nil
+}
@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/ignorantshr/mgit/util"
+	"github.com/spf13/cobra"
+)
+
+/* git worktree
+
+管理 linked worktree：多个 worktree 共享同一个仓库的 objects 和 refs，各自有独立的 HEAD 和 index。
+同一个分支只能被一个 worktree 检出
+*/
+
+var (
+	_worktreeBranch    string
+	_worktreeDetach    bool
+	_worktreeForce     int
+	_worktreePorcelain bool
+	_worktreeDryRun    bool
+	_worktreeVerbose   bool
+	_worktreeReason    string
+)
+
+func init() {
+	worktreeAddCmd.Flags().StringVarP(&_worktreeBranch, "branch", "b", "", "create a new branch and check it out")
+	worktreeAddCmd.Flags().BoolVar(&_worktreeDetach, "detach", false, "detach HEAD at the commit")
+	worktreeAddCmd.Flags().CountVarP(&_worktreeForce, "force", "f", "check out a branch even if already checked out in another worktree")
+	worktreeAddCmd.MarkFlagsMutuallyExclusive("branch", "detach")
+	worktreeListCmd.Flags().BoolVar(&_worktreePorcelain, "porcelain", false, "machine-readable output")
+	worktreeRemoveCmd.Flags().CountVarP(&_worktreeForce, "force", "f", "remove a dirty worktree, twice to remove a locked one")
+	worktreePruneCmd.Flags().BoolVarP(&_worktreeDryRun, "dry-run", "n", false, "do not remove, show only")
+	worktreePruneCmd.Flags().BoolVarP(&_worktreeVerbose, "verbose", "v", false, "report pruned working trees")
+	worktreeLockCmd.Flags().StringVar(&_worktreeReason, "reason", "", "reason for locking")
+
+	worktreeCmd.AddCommand(worktreeAddCmd, worktreeListCmd, worktreeRemoveCmd, worktreePruneCmd,
+		worktreeLockCmd, worktreeUnlockCmd)
+	rootCmd.AddCommand(worktreeCmd)
+}
+
+var worktreeCmd = &cobra.Command{
+	Use:   "worktree",
+	Short: "Manage multiple working trees.",
+}
+
+var worktreeAddCmd = &cobra.Command{
+	Use:   "add [-f] [--detach | -b <new-branch>] <path> [<commit-ish>]",
+	Short: "Create a working tree at <path> and check out <commit-ish> into it.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		commitish := ""
+		if len(args) == 2 {
+			commitish = args[1]
+		}
+		return worktreeAdd(repo, args[0], commitish, _worktreeBranch, _worktreeDetach, _worktreeForce > 0)
+	},
+}
+
+var worktreeListCmd = &cobra.Command{
+	Use:   "list [--porcelain]",
+	Short: "List details of each working tree.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return worktreeList(repo, _worktreePorcelain)
+	},
+}
+
+var worktreeRemoveCmd = &cobra.Command{
+	Use:   "remove [-f] <worktree>",
+	Short: "Remove a working tree.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		return worktreeRemove(repo, args[0], _worktreeForce)
+	},
+}
+
+var worktreePruneCmd = &cobra.Command{
+	Use:   "prune [-n] [-v]",
+	Short: "Prune administrative files of working trees that no longer exist.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		pruned, err := model.PruneWorktrees(repo, _worktreeDryRun)
+		if err != nil {
+			return err
+		}
+		if _worktreeVerbose || _worktreeDryRun {
+			for _, wt := range pruned {
+				fmt.Printf("Removing worktrees/%s: %s\n", wt.Name, wt.Prunable)
+			}
+		}
+		return nil
+	},
+}
+
+var worktreeLockCmd = &cobra.Command{
+	Use:   "lock [--reason <string>] <worktree>",
+	Short: "Prevent a working tree from being pruned or removed.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		wt, err := model.FindWorktree(repo, args[0])
+		if err != nil {
+			return err
+		}
+		return model.LockWorktree(wt, _worktreeReason)
+	},
+}
+
+var worktreeUnlockCmd = &cobra.Command{
+	Use:   "unlock <worktree>",
+	Short: "Unlock a working tree.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		wt, err := model.FindWorktree(repo, args[0])
+		if err != nil {
+			return err
+		}
+		return model.UnlockWorktree(wt)
+	},
+}
+
+// 没有 commit-ish 时检出（或基于 HEAD 新建）与目录同名的分支；commit-ish 是分支名时检出该分支，
+// 否则 detached HEAD
+func worktreeAdd(repo *model.Repository, dest, commitish, newBranch string, detach, force bool) error {
+	if util.IsFile(dest) || (util.IsDir(dest) && !util.IsDirEmpty(dest)) {
+		return fmt.Errorf("'%s' already exists", dest)
+	}
+
+	branch := ""
+	switch {
+	case newBranch != "":
+		branch = newBranch
+	case commitish == "" && !detach:
+		branch = filepath.Base(dest)
+	case commitish != "" && !detach:
+		if sha, err := model.GetRefSha(repo, model.BranchDir+commitish); err != nil {
+			return err
+		} else if sha != "" {
+			branch = commitish
+		}
+	}
+	if commitish == "" {
+		commitish = "HEAD"
+	}
+
+	exist := ""
+	if branch != "" {
+		var err error
+		if exist, err = model.GetRefSha(repo, model.BranchDir+branch); err != nil {
+			return err
+		}
+		if exist != "" && newBranch != "" {
+			return fmt.Errorf("a branch named '%s' already exists", branch)
+		}
+	}
+
+	var sha, head, msg string
+	if exist != "" {
+		if wt, err := model.WorktreeOfBranch(repo, branch); err != nil {
+			return err
+		} else if wt != nil && !force {
+			return fmt.Errorf("'%s' is already checked out at '%s'", branch, wt.Path)
+		}
+		sha, head = exist, "ref: "+model.BranchDir+branch
+		msg = fmt.Sprintf("checking out '%s'", branch)
+	} else {
+		var err error
+		if sha, err = model.FindObject(repo, commitish, "commit", true); err != nil {
+			return err
+		}
+		if branch != "" {
+			if err := model.CreateRef(repo, "heads/"+branch, sha); err != nil {
+				return err
+			}
+			head = "ref: " + model.BranchDir + branch
+			msg = fmt.Sprintf("new branch '%s'", branch)
+		} else {
+			head = sha
+			msg = "detached HEAD " + shortSha(sha)
+		}
+	}
+	fmt.Printf("Preparing worktree (%s)\n", msg)
+
+	wtRepo, err := model.AddWorktree(repo, dest, head, func(wtRepo *model.Repository) error {
+		tree, err := model.FindObject(wtRepo, sha, "tree", true)
+		if err != nil {
+			return err
+		}
+		obj, err := model.ReadObject(wtRepo, tree)
+		if err != nil {
+			return err
+		}
+		// 检出的同时生成 index
+		index, err := model.ReadIndexLocked(wtRepo)
+		if err != nil {
+			return err
+		}
+		defer index.Unlock()
+		if err := checkoutTree(wtRepo, index, wtRepo.Worktree(), "", obj.(*model.TreeObj)); err != nil {
+			return err
+		}
+		return model.WriteIndex(wtRepo, index)
+	})
+	if err != nil {
+		return err
+	}
+	return model.RunHook(wtRepo, model.HookPostCheckout, wtRepo.NullSha(), sha, "1")
+}
+
+func worktreeList(repo *model.Repository, porcelain bool) error {
+	worktrees, err := model.ListWorktrees(repo)
+	if err != nil {
+		return err
+	}
+
+	if porcelain {
+		for _, wt := range worktrees {
+			fmt.Printf("worktree %s\n", wt.Path)
+			switch {
+			case wt.Bare:
+				fmt.Println("bare")
+			case wt.Branch != "":
+				fmt.Printf("HEAD %s\nbranch %s%s\n", wt.Head, model.BranchDir, wt.Branch)
+			default:
+				fmt.Printf("HEAD %s\ndetached\n", wt.Head)
+			}
+			if wt.Locked {
+				printPorcelainAttr("locked", wt.Reason)
+			}
+			if wt.Prunable != "" {
+				printPorcelainAttr("prunable", wt.Prunable)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	width := 0
+	for _, wt := range worktrees {
+		width = max(width, len(wt.Path))
+	}
+	for _, wt := range worktrees {
+		line := fmt.Sprintf("%-*s ", width, wt.Path)
+		switch {
+		case wt.Bare:
+			line += "(bare)"
+		case wt.Branch != "":
+			line += fmt.Sprintf("%-7s [%s]", shortSha(wt.Head), wt.Branch)
+		default:
+			line += fmt.Sprintf("%-7s (detached HEAD)", shortSha(wt.Head))
+		}
+		if wt.Locked {
+			line += " locked"
+		}
+		if wt.Prunable != "" {
+			line += " prunable"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func printPorcelainAttr(name, reason string) {
+	if reason != "" {
+		fmt.Printf("%s %s\n", name, reason)
+	} else {
+		fmt.Println(name)
+	}
+}
+
+// force 为 1 时可以删除有修改的 worktree，为 2 时还可以删除锁定的 worktree
+func worktreeRemove(repo *model.Repository, p string, force int) error {
+	wt, err := model.FindWorktree(repo, p)
+	if err != nil {
+		return err
+	}
+	if wt.IsMain() {
+		return fmt.Errorf("'%s' is a main working tree", wt.Path)
+	}
+	if wt.Locked && force < 2 {
+		msg := "cannot remove a locked working tree"
+		if wt.Reason != "" {
+			msg += ", lock reason: " + wt.Reason
+		}
+		return errors.New(msg + "\nuse 'remove -f -f' to override or unlock first")
+	}
+	if force < 1 && util.IsDir(wt.Path) {
+		dirty, err := worktreeDirty(wt)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("'%s' contains modified or untracked files, use --force to delete it", wt.Path)
+		}
+	}
+	return model.RemoveWorktree(wt)
+}
+
+// index 中的文件被修改、删除，或者有未被忽略的未跟踪文件
+func worktreeDirty(wt *model.WorktreeInfo) (bool, error) {
+	repo, err := model.FindRepo(wt.Path)
+	if err != nil {
+		return false, err
+	}
+	index, err := model.ReadIndex(repo)
+	if err != nil {
+		return false, err
+	}
+
+	ignore, err := model.ReadGitignore(repo)
+	if err != nil {
+		return false, err
+	}
+
+	allFiles, err := walkFilesystem(repo)
+	if err != nil {
+		return false, err
+	}
+	// 有未解决的冲突
+	if index.HasUnmerged() {
+		return true, nil
+	}
+	for _, v := range index.Entries {
+		deleted, modified, err := worktreeFileChanged(repo, v)
+		if err != nil {
+			return false, err
+		}
+		if deleted || modified {
+			return true, nil
+		}
+		delete(allFiles, v.Name)
+	}
+	for f := range allFiles {
+		ignored, err := model.CheckIgnore(f, ignore)
+		if err != nil {
+			return false, err
+		}
+		if !ignored {
+			return true, nil
+		}
+	}
+	return false, nil
+}
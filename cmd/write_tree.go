@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ignorantshr/mgit/model"
+	"github.com/spf13/cobra"
+)
+
+/* git write-tree
+
+用 index 生成 tree 对象并输出 sha，index 中有冲突条目或者引用的对象不存在时失败
+*/
+
+func init() {
+	rootCmd.AddCommand(writeTreeCmd)
+}
+
+var writeTreeCmd = &cobra.Command{
+	Use:   "write-tree",
+	Short: "Create a tree object from the current index",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := model.FindRepo(".")
+		if err != nil {
+			return err
+		}
+		sha, err := writeTree(repo)
+		if err != nil {
+			return err
+		}
+		fmt.Println(sha)
+		return nil
+	},
+}
+
+func writeTree(repo *model.Repository) (string, error) {
+	index, err := model.ReadIndexLocked(repo)
+	if err != nil {
+		return "", err
+	}
+	defer index.Unlock()
+
+	failed := false
+	for _, e := range index.Entries {
+		switch {
+		case e.Stage() != model.StageMerged:
+			fmt.Fprintf(os.Stderr, "error: %s: unmerged (%s)\n", e.Name, e.Sha)
+			failed = true
+		case e.IntentToAdd, e.ModeType == model.ModeTypeGitlink:
+			// 没有内容或者是其他仓库中的 commit
+		case !repo.Objects().Has(e.Sha):
+			fmt.Fprintf(os.Stderr, "error: invalid object %06o %s for '%s'\n", e.Mode(), e.Sha, e.Name)
+			failed = true
+		}
+	}
+	if failed {
+		return "", errors.New("mgit write-tree: error building trees")
+	}
+
+	sha, err := model.Index2Tree(repo, index)
+	if err != nil {
+		return "", err
+	}
+	// 保存更新后的 cached tree
+	if err := model.WriteIndex(repo, index); err != nil {
+		return "", err
+	}
+	return sha, nil
+}
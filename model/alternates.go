@@ -0,0 +1,102 @@
+package model
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ignorantshr/mgit/util"
+)
+
+/*
+objects/info/alternates 每行记录一个其他仓库的 objects 目录（绝对路径，或相对于本仓库 objects 目录的路径），
+读取对象时会依次查找这些目录，从而在多个仓库之间共享对象而不必复制。
+*/
+
+const maxAlternateDepth = 5 // 与 git 相同，防止循环引用
+
+// 递归地读取 objectsDir 的 alternates，返回去重后的绝对路径
+func readAlternates(objectsDir string) ([]string, error) {
+	res := []string{}
+	seen := map[string]bool{filepath.Clean(objectsDir): true}
+
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		if depth > maxAlternateDepth {
+			return nil
+		}
+		f, err := os.Open(path.Join(dir, "info", "alternates"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dir, line)
+			}
+			line = filepath.Clean(line)
+			if seen[line] || !util.IsDir(line) {
+				continue
+			}
+			seen[line] = true
+			res = append(res, line)
+			if err := walk(line, depth+1); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+	if err := walk(objectsDir, 1); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 仓库中记录的 alternate objects 目录
+func Alternates(repo *Repository) ([]string, error) {
+	return readAlternates(repo.repoPath("objects"))
+}
+
+// 追加一个 alternate objects 目录
+func AddAlternate(repo *Repository, objectsDir string) error {
+	abs, err := filepath.Abs(objectsDir)
+	if err != nil {
+		return err
+	}
+
+	p, err := repo.RepoFile(true, "objects", "info", "alternates")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(abs + "\n"); err != nil {
+		return err
+	}
+
+	// 重新构建对象数据库
+	repo.objects = nil
+	return f.Close()
+}
+
+// 对象是否存放在本仓库中（而不是来自 alternates）
+func (r *Repository) HasLocalObject(sha string) bool {
+	if r.Objects(); r.loose == nil {
+		return r.objects.Has(sha)
+	}
+	return r.loose.Has(sha) || r.pack.Has(sha)
+}
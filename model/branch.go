@@ -4,23 +4,26 @@ import (
 	"bytes"
 	"os"
 	"strings"
-
-	"github.com/ignorantshr/mgit/util"
 )
 
 const (
 	BranchDir = "refs/heads/"
 )
 
-func GetActiveBranch(repo *Repository) string {
+// HEAD 指向的分支名，detached HEAD 时返回空字符串
+func GetActiveBranch(repo *Repository) (string, error) {
 	rf, err := repo.RepoFile(false, "HEAD")
-	util.PanicErr(err)
+	if err != nil {
+		return "", err
+	}
 
 	head, err := os.ReadFile(rf)
-	util.PanicErr(err)
+	if err != nil {
+		return "", err
+	}
 
 	if bytes.HasPrefix(head, []byte("ref: "+BranchDir)) {
-		return strings.TrimSpace(string(head[16:])) // remove \n
+		return strings.TrimSpace(string(head[16:])), nil // remove \n
 	}
-	return ""
+	return "", nil
 }
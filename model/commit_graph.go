@@ -0,0 +1,539 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+objects/info/commit-graph，与 git 的格式相同：
+
+	header:  "CGPH" version(1) hashVersion(1=sha1, 2=sha256) chunkCount baseGraphCount(0)
+	chunk table: (chunkCount+1) 个 4 字节 id + 8 字节 offset，最后一项 id 为 0，offset 指向最后一个 chunk 的结尾
+	OIDF: 256 个 fanout
+	OIDL: 排好序的 commit sha
+	CDAT: 每个 commit 的 root tree、两个 parent 的位置、generation(30 bit) 和提交时间(34 bit)
+	EDGE: 多于两个 parent 的 commit 的其余 parent
+	trailer: 以上内容的 hash
+
+读取 commit 时优先查 graph，不在 graph 中的（graph 写入之后才产生的）commit 再去解析对象。
+*/
+
+const (
+	commitGraphSignature = "CGPH"
+
+	graphChunkFanout     = 0x4f494446 // "OIDF"
+	graphChunkOidLookup  = 0x4f49444c // "OIDL"
+	graphChunkCommitData = 0x43444154 // "CDAT"
+	graphChunkExtraEdges = 0x45444745 // "EDGE"
+
+	graphParentNone    = 0x70000000
+	graphExtraEdgeFlag = 0x80000000
+	graphLastEdge      = 0x80000000
+
+	generationMax      = 0x3fffffff
+	GenerationInfinity = 0xffffffff // 不在 graph 中的 commit
+)
+
+var graphHashVersions = map[string]byte{
+	ObjectFormatSHA1:   1,
+	ObjectFormatSHA256: 2,
+}
+
+// commit 在遍历历史时需要的信息
+type CommitInfo struct {
+	Sha        string
+	Tree       string
+	Parents    []string
+	Time       int64 // committer 的时间戳
+	Generation uint32
+}
+
+type CommitGraph struct {
+	hashSize int
+	fanout   []byte
+	oids     []byte
+	data     []byte
+	edges    []byte
+}
+
+func commitGraphPath(repo *Repository) string {
+	return repo.repoPath("objects", "info", "commit-graph")
+}
+
+// 文件不存在时返回 nil, nil
+func ReadCommitGraph(repo *Repository) (*CommitGraph, error) {
+	raw, err := os.ReadFile(commitGraphPath(repo))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseCommitGraph(raw, repo)
+}
+
+func parseCommitGraph(raw []byte, repo *Repository) (*CommitGraph, error) {
+	hashSize := repo.HashSize()
+	if len(raw) < 8+12+hashSize || string(raw[:4]) != commitGraphSignature {
+		return nil, corruptCommitGraphErr("commit-graph signature mismatch")
+	}
+	if raw[4] != 1 {
+		return nil, fmt.Errorf("commit-graph version %d does not match version 1", raw[4])
+	}
+	if raw[5] != graphHashVersions[repo.ObjectFormat()] {
+		return nil, fmt.Errorf("commit-graph hash version %d does not match %s", raw[5], repo.ObjectFormat())
+	}
+	if raw[7] != 0 {
+		return nil, fmt.Errorf("split commit-graph is not supported")
+	}
+
+	g := &CommitGraph{hashSize: hashSize}
+	n := int(raw[6])
+	end := len(raw) - hashSize
+	if 8+(n+1)*12 > end {
+		return nil, corruptCommitGraphErr("commit-graph chunk table is truncated")
+	}
+	for i := 0; i < n; i++ {
+		entry := raw[8+i*12:]
+		id := binary.BigEndian.Uint32(entry)
+		start := binary.BigEndian.Uint64(entry[4:])
+		stop := binary.BigEndian.Uint64(entry[16:])
+		if start > stop || stop > uint64(end) {
+			return nil, corruptCommitGraphErr("commit-graph chunk %08x is out of bounds", id)
+		}
+		chunk := raw[start:stop]
+		switch id {
+		case graphChunkFanout:
+			g.fanout = chunk
+		case graphChunkOidLookup:
+			g.oids = chunk
+		case graphChunkCommitData:
+			g.data = chunk
+		case graphChunkExtraEdges:
+			g.edges = chunk
+		}
+	}
+
+	if len(g.fanout) != 256*4 {
+		return nil, corruptCommitGraphErr("commit-graph fanout chunk is wrong size")
+	}
+	// lookup 按 fanout 划分查找范围，值必须单调不减（最后一个即 commit 数）
+	for i := 1; i < 256; i++ {
+		if binary.BigEndian.Uint32(g.fanout[i*4:]) < binary.BigEndian.Uint32(g.fanout[(i-1)*4:]) {
+			return nil, corruptCommitGraphErr("commit-graph fanout has non-monotonic value at %d", i)
+		}
+	}
+	count := g.Count()
+	if len(g.oids) != count*hashSize {
+		return nil, corruptCommitGraphErr("commit-graph OID lookup chunk is wrong size")
+	}
+	if len(g.data) != count*(hashSize+16) {
+		return nil, corruptCommitGraphErr("commit-graph commit data chunk is wrong size")
+	}
+	return g, nil
+}
+
+func (g *CommitGraph) Count() int {
+	return int(binary.BigEndian.Uint32(g.fanout[255*4:]))
+}
+
+func (g *CommitGraph) oid(i int) string {
+	return hex.EncodeToString(g.oids[i*g.hashSize : (i+1)*g.hashSize])
+}
+
+func (g *CommitGraph) lookup(sha string) (int, bool) {
+	rawsha, err := hex.DecodeString(sha)
+	if err != nil || len(rawsha) != g.hashSize {
+		return 0, false
+	}
+	lo := 0
+	if rawsha[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(g.fanout[(int(rawsha[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(g.fanout[int(rawsha[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(g.oids[(lo+i)*g.hashSize:(lo+i+1)*g.hashSize], rawsha) >= 0
+	})
+	if i < hi && bytes.Equal(g.oids[i*g.hashSize:(i+1)*g.hashSize], rawsha) {
+		return i, true
+	}
+	return 0, false
+}
+
+// graph 中的第 i 个 commit
+func (g *CommitGraph) commit(i int) (*CommitInfo, error) {
+	entry := g.data[i*(g.hashSize+16):]
+	info := &CommitInfo{
+		Sha:  g.oid(i),
+		Tree: hex.EncodeToString(entry[:g.hashSize]),
+	}
+	entry = entry[g.hashSize:]
+
+	parent := func(pos uint32) error {
+		if int(pos) >= g.Count() {
+			return fmt.Errorf("commit-graph parent position %d is out of range", pos)
+		}
+		info.Parents = append(info.Parents, g.oid(int(pos)))
+		return nil
+	}
+	if p1 := binary.BigEndian.Uint32(entry); p1 != graphParentNone {
+		if err := parent(p1); err != nil {
+			return nil, err
+		}
+	}
+	if p2 := binary.BigEndian.Uint32(entry[4:]); p2&graphExtraEdgeFlag != 0 {
+		for e := int(p2 &^ graphExtraEdgeFlag); ; e++ {
+			if (e+1)*4 > len(g.edges) {
+				return nil, fmt.Errorf("commit-graph extra edge list is truncated")
+			}
+			pos := binary.BigEndian.Uint32(g.edges[e*4:])
+			if err := parent(pos &^ graphLastEdge); err != nil {
+				return nil, err
+			}
+			if pos&graphLastEdge != 0 {
+				break
+			}
+		}
+	} else if p2 != graphParentNone {
+		if err := parent(p2); err != nil {
+			return nil, err
+		}
+	}
+
+	high := binary.BigEndian.Uint32(entry[8:])
+	info.Generation = high >> 2
+	info.Time = int64(high&3)<<32 | int64(binary.BigEndian.Uint32(entry[12:]))
+	return info, nil
+}
+
+// 仓库的 commit-graph，读取失败时当作不存在
+func (r *Repository) commitGraph() *CommitGraph {
+	if r.gitdir == "" {
+		return nil
+	}
+	if !r.graphLoaded {
+		r.graph, _ = ReadCommitGraph(r)
+		r.graphLoaded = true
+	}
+	return r.graph
+}
+
+// 获取 commit 的信息，优先使用 commit-graph，graph 中没有时解析对象
+func GetCommitInfo(repo *Repository, sha string) (*CommitInfo, error) {
+	if g := repo.commitGraph(); g != nil {
+		if i, ok := g.lookup(sha); ok {
+			if info, err := g.commit(i); err == nil {
+				return info, nil
+			}
+		}
+	}
+	return commitInfoFromObject(repo, sha)
+}
+
+func commitInfoFromObject(repo *Repository, sha string) (*CommitInfo, error) {
+	obj, err := ReadObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := obj.(*CommitObj)
+	if !ok {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", sha, obj.Format())
+	}
+	return &CommitInfo{
+		Sha:        sha,
+		Tree:       commit.Tree,
+		Parents:    commit.Parents(),
+		Time:       identTime(commit.Commiter),
+		Generation: GenerationInfinity,
+	}, nil
+}
+
+// "name <email> 1700000000 +0800" 中的时间戳
+func identTime(ident string) int64 {
+	_, ts, err := ParseIdent(ident)
+	if err != nil {
+		return 0
+	}
+	return ts.Unix()
+}
+
+// 把 sha 解引用到 commit（跟随 tag），不是 commit 时返回空字符串
+func peelToCommit(repo *Repository, sha string) (string, error) {
+	for sha != "" {
+		format, _, r, err := OpenObjectStream(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		r.Close()
+		switch format {
+		case "commit":
+			return sha, nil
+		case "tag":
+			obj, err := ReadObject(repo, sha)
+			if err != nil {
+				return "", err
+			}
+			sha = obj.(*TagObj).Object
+		default:
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// 为所有可达的 commit 写入 commit-graph，返回 commit 的数量
+func WriteCommitGraph(repo *Repository) (int, error) {
+	roots, err := RootObjects(repo)
+	if err != nil {
+		return 0, err
+	}
+	infos := make(map[string]*CommitInfo)
+	queue := []string{}
+	for _, root := range roots {
+		sha, err := peelToCommit(repo, root)
+		if err != nil {
+			return 0, err
+		}
+		if sha != "" {
+			queue = append(queue, sha)
+		}
+	}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if _, ok := infos[sha]; ok {
+			continue
+		}
+		info, err := GetCommitInfo(repo, sha)
+		if err != nil {
+			return 0, err
+		}
+		infos[sha] = info
+		queue = append(queue, info.Parents...)
+	}
+
+	shas := make([]string, 0, len(infos))
+	for sha := range infos {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	computeGenerations(infos)
+
+	raw := encodeCommitGraph(repo, shas, infos)
+	p, err := repo.RepoFile(true, "objects", "info", "commit-graph")
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(path.Dir(p), "tmp_graph_")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(raw); err != nil {
+		return 0, err
+	}
+	if err := tmp.Chmod(0444); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return 0, err
+	}
+
+	repo.graph, repo.graphLoaded = nil, false
+	return len(shas), nil
+}
+
+// generation = 1 + max(parents' generation)，没有 parent 的为 1
+func computeGenerations(infos map[string]*CommitInfo) {
+	gens := make(map[string]uint32)
+	for sha := range infos {
+		stack := []string{sha}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if _, ok := gens[top]; ok {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			gen, ready := uint32(1), true
+			for _, p := range infos[top].Parents {
+				if g, ok := gens[p]; !ok {
+					stack = append(stack, p)
+					ready = false
+				} else if g+1 > gen {
+					gen = g + 1
+				}
+			}
+			if ready {
+				gens[top] = min(gen, generationMax)
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	for sha, info := range infos {
+		info.Generation = gens[sha]
+	}
+}
+
+func encodeCommitGraph(repo *Repository, shas []string, infos map[string]*CommitInfo) []byte {
+	pos := make(map[string]uint32, len(shas))
+	for i, sha := range shas {
+		pos[sha] = uint32(i)
+	}
+
+	fanout := make([]byte, 256*4)
+	oids := []byte{}
+	data := []byte{}
+	edges := []byte{}
+	counts := [256]uint32{}
+	for _, sha := range shas {
+		rawsha, _ := hex.DecodeString(sha)
+		counts[rawsha[0]]++
+		oids = append(oids, rawsha...)
+
+		info := infos[sha]
+		tree, _ := hex.DecodeString(info.Tree)
+		data = append(data, tree...)
+
+		p1, p2 := uint32(graphParentNone), uint32(graphParentNone)
+		switch len(info.Parents) {
+		case 0:
+		case 1:
+			p1 = pos[info.Parents[0]]
+		case 2:
+			p1, p2 = pos[info.Parents[0]], pos[info.Parents[1]]
+		default:
+			p1 = pos[info.Parents[0]]
+			p2 = graphExtraEdgeFlag | uint32(len(edges)/4)
+			for i, p := range info.Parents[1:] {
+				v := pos[p]
+				if i == len(info.Parents)-2 {
+					v |= graphLastEdge
+				}
+				edges = binary.BigEndian.AppendUint32(edges, v)
+			}
+		}
+		data = binary.BigEndian.AppendUint32(data, p1)
+		data = binary.BigEndian.AppendUint32(data, p2)
+		data = binary.BigEndian.AppendUint32(data, info.Generation<<2|uint32(info.Time>>32)&3)
+		data = binary.BigEndian.AppendUint32(data, uint32(info.Time))
+	}
+	total := uint32(0)
+	for i, c := range counts {
+		total += c
+		binary.BigEndian.PutUint32(fanout[i*4:], total)
+	}
+
+	type chunk struct {
+		id   uint32
+		data []byte
+	}
+	chunks := []chunk{
+		{graphChunkFanout, fanout},
+		{graphChunkOidLookup, oids},
+		{graphChunkCommitData, data},
+	}
+	if len(edges) > 0 {
+		chunks = append(chunks, chunk{graphChunkExtraEdges, edges})
+	}
+
+	buf := []byte(commitGraphSignature)
+	buf = append(buf, 1, graphHashVersions[repo.ObjectFormat()], byte(len(chunks)), 0)
+	offset := uint64(len(buf) + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		buf = binary.BigEndian.AppendUint32(buf, c.id)
+		buf = binary.BigEndian.AppendUint64(buf, offset)
+		offset += uint64(len(c.data))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, offset)
+	for _, c := range chunks {
+		buf = append(buf, c.data...)
+	}
+
+	h := repo.newHash()
+	h.Write(buf)
+	return h.Sum(buf)
+}
+
+// 校验 commit-graph 的 checksum、结构，以及每个 commit 是否与对象一致
+func VerifyCommitGraph(repo *Repository) []string {
+	errs := []string{}
+	raw, err := os.ReadFile(commitGraphPath(repo))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errs
+		}
+		return append(errs, err.Error())
+	}
+	g, err := parseCommitGraph(raw, repo)
+	if err != nil {
+		return append(errs, err.Error())
+	}
+
+	h := repo.newHash()
+	h.Write(raw[:len(raw)-repo.HashSize()])
+	if !bytes.Equal(h.Sum(nil), raw[len(raw)-repo.HashSize():]) {
+		errs = append(errs, "commit-graph has incorrect checksum and is likely corrupt")
+	}
+
+	for i := 1; i < g.Count(); i++ {
+		if g.oid(i-1) >= g.oid(i) {
+			errs = append(errs, fmt.Sprintf("commit-graph has incorrect OID order: %s then %s", g.oid(i-1), g.oid(i)))
+		}
+	}
+
+	infos := make(map[string]*CommitInfo)
+	for i := 0; i < g.Count(); i++ {
+		info, err := g.commit(i)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", g.oid(i), err))
+			continue
+		}
+		infos[info.Sha] = info
+	}
+
+	for i := 0; i < g.Count(); i++ {
+		sha := g.oid(i)
+		info, ok := infos[sha]
+		if !ok {
+			continue
+		}
+		obj, err := commitInfoFromObject(repo, sha)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to parse commit %s from object database for commit-graph: %v", sha, err))
+			continue
+		}
+
+		if obj.Tree != info.Tree {
+			errs = append(errs, fmt.Sprintf("root tree OID for commit %s in commit-graph is %s != %s", sha, info.Tree, obj.Tree))
+		}
+		if strings.Join(obj.Parents, " ") != strings.Join(info.Parents, " ") {
+			errs = append(errs, fmt.Sprintf("commit-graph parent list for commit %s does not match", sha))
+		}
+		if obj.Time != info.Time {
+			errs = append(errs, fmt.Sprintf("commit date for commit %s in commit-graph is %d != %d", sha, info.Time, obj.Time))
+		}
+
+		gen := uint32(1)
+		for _, p := range info.Parents {
+			if pi, ok := infos[p]; ok && pi.Generation+1 > gen {
+				gen = pi.Generation + 1
+			}
+		}
+		if min(gen, generationMax) != info.Generation {
+			errs = append(errs, fmt.Sprintf("commit-graph generation for commit %s is %d != %d", sha, info.Generation, gen))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommitGraphMalformed(t *testing.T) {
+	repo := newTestRepo(t, ObjectFormatSHA1)
+	tree := strings.Repeat("ee", 20)
+	shas := []string{strings.Repeat("11", 20), strings.Repeat("80", 20), strings.Repeat("f0", 20)}
+	infos := map[string]*CommitInfo{
+		shas[0]: {Sha: shas[0], Tree: tree, Time: 1700000000},
+		shas[1]: {Sha: shas[1], Tree: tree, Parents: shas[:1], Time: 1700000001},
+		shas[2]: {Sha: shas[2], Tree: tree, Parents: shas[1:2], Time: 1700000002},
+	}
+	computeGenerations(infos)
+	raw := encodeCommitGraph(repo, shas, infos)
+	if _, err := parseCommitGraph(raw, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 个 chunk 加上结束标记，fanout 紧跟在 chunk 表之后
+	fanout := 8 + 4*12
+	modify := func(fn func(b []byte)) []byte {
+		b := append([]byte{}, raw...)
+		fn(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"bad signature", modify(func(b []byte) { b[0] = 0 }), "signature mismatch"},
+		{"truncated chunk table", raw[:40], "chunk table is truncated"},
+		{"chunk out of bounds", modify(func(b []byte) { binary.BigEndian.PutUint64(b[8+12+4:], 1<<20) }), "out of bounds"},
+		{"decreasing fanout", modify(func(b []byte) { binary.BigEndian.PutUint32(b[fanout+4*0x20:], 3) }), "non-monotonic value at 33"},
+		{"count too large", modify(func(b []byte) { binary.BigEndian.PutUint32(b[fanout+4*255:], 1<<30) }), "OID lookup chunk is wrong size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCommitGraph(tt.raw, repo)
+			if !errors.Is(err, ErrCorruptObject) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseCommitGraph() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,746 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+git 风格的配置文件：
+
+	[section]
+		key = value
+	[section "subsection"]
+		key = "quoted value" ; comment
+
+section 和 key 不区分大小写，subsection 区分；同一个 key 可以出现多次（多值），按单值读取时以最后一个为准。
+依次读取 system、global、local、worktree 四个 scope，后面的覆盖前面的；
+include.path 和 includeIf.<condition>.path 引入的文件在所在位置展开。
+*/
+
+type ConfigScope int
+
+const (
+	ScopeSystem   ConfigScope = iota // /etc/gitconfig
+	ScopeGlobal                      // ~/.gitconfig 和 $XDG_CONFIG_HOME/git/config
+	ScopeLocal                       // .mgit/conf，兼容模式下为 .git/config
+	ScopeWorktree                    // conf.worktree，extensions.worktreeConfig 开启时才读取
+	ScopeFile                        // 命令行指定的文件
+)
+
+func (s ConfigScope) String() string {
+	switch s {
+	case ScopeSystem:
+		return "system"
+	case ScopeGlobal:
+		return "global"
+	case ScopeLocal:
+		return "local"
+	case ScopeWorktree:
+		return "worktree"
+	}
+	return "file"
+}
+
+// 用于覆盖 system、global 配置文件的环境变量
+const (
+	EnvConfigSystem   = "MGIT_CONFIG_SYSTEM"
+	EnvConfigGlobal   = "MGIT_CONFIG_GLOBAL"
+	EnvConfigNoSystem = "MGIT_CONFIG_NOSYSTEM"
+)
+
+const maxConfigIncludeDepth = 10 // 与 git 相同
+
+type ConfigEntry struct {
+	Section    string // 小写
+	Subsection string
+	Key        string // 小写
+	Value      string
+	NoValue    bool // 只有 key 没有 "="，作为布尔值时为 true
+	Scope      ConfigScope
+	File       string
+	Line       int
+
+	start, end int // 在文件中的字节范围，修改配置时使用
+}
+
+// section[.subsection].key
+func (e *ConfigEntry) Name() string {
+	if e.Subsection != "" {
+		return e.Section + "." + e.Subsection + "." + e.Key
+	}
+	return e.Section + "." + e.Key
+}
+
+type Config struct {
+	Entries []*ConfigEntry // 按读取顺序
+}
+
+// 拆分 section.subsection.key，section 和 key 转为小写
+func parseConfigName(name string) (section, subsection, key string, err error) {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first <= 0 || last == len(name)-1 {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	section = strings.ToLower(name[:first])
+	key = strings.ToLower(name[last+1:])
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+
+	for _, c := range section {
+		if !isConfigNameChar(c) && c != '.' {
+			return "", "", "", fmt.Errorf("invalid key: %s", name)
+		}
+	}
+	if !isLetter(rune(key[0])) {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	for _, c := range key {
+		if !isConfigNameChar(c) {
+			return "", "", "", fmt.Errorf("invalid key: %s", name)
+		}
+	}
+	return section, subsection, key, nil
+}
+
+func isLetter(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isConfigNameChar(c rune) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || c == '-'
+}
+
+func (e *ConfigEntry) is(section, subsection, key string) bool {
+	return e.Section == section && e.Subsection == subsection && e.Key == key
+}
+
+// name 的所有条目，按读取顺序
+func (c *Config) lookup(name string) []*ConfigEntry {
+	if c == nil {
+		return nil
+	}
+	section, subsection, key, err := parseConfigName(name)
+	if err != nil {
+		return nil
+	}
+	res := []*ConfigEntry{}
+	for _, e := range c.Entries {
+		if e.is(section, subsection, key) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// name 的值，多值时返回最后一个
+func (c *Config) Get(name string) (string, bool) {
+	entries := c.lookup(name)
+	if len(entries) == 0 {
+		return "", false
+	}
+	return entries[len(entries)-1].Value, true
+}
+
+// name 的条目，多值时返回最后一个
+func (c *Config) GetEntry(name string) *ConfigEntry {
+	entries := c.lookup(name)
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[len(entries)-1]
+}
+
+func (c *Config) GetAll(name string) []string {
+	res := []string{}
+	for _, e := range c.lookup(name) {
+		res = append(res, e.Value)
+	}
+	return res
+}
+
+func (c *Config) GetAllEntries(name string) []*ConfigEntry {
+	return c.lookup(name)
+}
+
+// true/yes/on/1 和 false/no/off/0/空，只有 key 没有值时为 true
+func (c *Config) GetBool(name string, def bool) (bool, error) {
+	e := c.GetEntry(name)
+	if e == nil {
+		return def, nil
+	}
+	if e.NoValue {
+		return true, nil
+	}
+	switch strings.ToLower(e.Value) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+	n, err := parseConfigInt(e.Value)
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s' for '%s'", e.Value, name)
+	}
+	return n != 0, nil
+}
+
+// 整数，支持 k/m/g 后缀
+func (c *Config) GetInt(name string, def int64) (int64, error) {
+	e := c.GetEntry(name)
+	if e == nil {
+		return def, nil
+	}
+	n, err := parseConfigInt(e.Value)
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s'", e.Value, name)
+	}
+	return n, nil
+}
+
+func parseConfigInt(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+// ---------------- 解析 ----------------
+
+// 配置文件中的一节，修改配置时用来决定新条目插入的位置
+type configSection struct {
+	name       string // 小写
+	subsection string
+	end        int // 本节最后一个条目（没有条目时为 header 所在行）之后的位置
+}
+
+type configFile struct {
+	path     string
+	raw      []byte
+	entries  []*ConfigEntry // 不展开 include
+	sections []*configSection
+}
+
+type configParser struct {
+	file string
+	raw  []byte
+	pos  int
+	line int
+}
+
+func (p *configParser) errorf() error {
+	return fmt.Errorf("bad config line %d in file %s", p.line, p.file)
+}
+
+func (p *configParser) eof() bool {
+	return p.pos >= len(p.raw)
+}
+
+func (p *configParser) peek() byte {
+	return p.raw[p.pos]
+}
+
+func (p *configParser) skipBlank() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r') {
+		p.pos++
+	}
+}
+
+// 跳到下一行的开头
+func (p *configParser) skipLine() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+	if !p.eof() {
+		p.pos++
+		p.line++
+	}
+}
+
+func parseConfig(file string, raw []byte, scope ConfigScope) (*configFile, error) {
+	cf := &configFile{path: file, raw: raw}
+	p := &configParser{file: file, raw: raw, line: 1}
+	if strings.HasPrefix(string(raw), "\xef\xbb\xbf") { // UTF-8 BOM
+		p.pos = 3
+	}
+
+	var cur *configSection
+	lineStart := p.pos
+	for {
+		if p.pos > 0 && p.raw[p.pos-1] == '\n' {
+			lineStart = p.pos
+		}
+		p.skipBlank()
+		if p.eof() {
+			break
+		}
+
+		c := p.peek()
+		switch {
+		case c == '\n':
+			p.pos++
+			p.line++
+		case c == '#' || c == ';':
+			p.skipLine()
+		case c == '[':
+			name, subsection, err := p.parseSectionHeader()
+			if err != nil {
+				return nil, err
+			}
+			cur = &configSection{name: name, subsection: subsection}
+			cf.sections = append(cf.sections, cur)
+			// header 后面可以直接跟条目或注释
+			p.skipBlank()
+			if p.eof() || p.peek() == '\n' || p.peek() == '#' || p.peek() == ';' {
+				p.skipLine()
+			}
+			cur.end = p.pos
+		case isLetter(rune(c)):
+			if cur == nil {
+				return nil, p.errorf()
+			}
+			start := p.pos
+			if strings.TrimSpace(string(p.raw[lineStart:p.pos])) == "" {
+				start = lineStart // 条目独占一行时包括缩进
+			}
+			line := p.line
+			key, value, noValue, err := p.parseEntry()
+			if err != nil {
+				return nil, err
+			}
+			cf.entries = append(cf.entries, &ConfigEntry{
+				Section:    cur.name,
+				Subsection: cur.subsection,
+				Key:        key,
+				Value:      value,
+				NoValue:    noValue,
+				Scope:      scope,
+				File:       file,
+				Line:       line,
+				start:      start,
+				end:        p.pos,
+			})
+			cur.end = p.pos
+		default:
+			return nil, p.errorf()
+		}
+	}
+	return cf, nil
+}
+
+// [section]、[section "subsection"] 或者过时的 [section.subsection]
+func (p *configParser) parseSectionHeader() (string, string, error) {
+	p.pos++ // [
+	start := p.pos
+	for !p.eof() && (isConfigNameChar(rune(p.peek())) || p.peek() == '.') {
+		p.pos++
+	}
+	name := strings.ToLower(string(p.raw[start:p.pos]))
+	if name == "" || p.eof() {
+		return "", "", p.errorf()
+	}
+
+	if p.peek() == ']' {
+		p.pos++
+		if section, subsection, ok := strings.Cut(name, "."); ok {
+			return section, subsection, nil
+		}
+		return name, "", nil
+	}
+
+	p.skipBlank()
+	if p.eof() || p.peek() != '"' {
+		return "", "", p.errorf()
+	}
+	p.pos++
+	var sub strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", "", p.errorf()
+		}
+		c := p.peek()
+		p.pos++
+		if c == '"' {
+			break
+		}
+		if c == '\\' {
+			if p.eof() || p.peek() == '\n' {
+				return "", "", p.errorf()
+			}
+			c = p.peek() // 其他转义字符只保留字符本身
+			p.pos++
+		}
+		sub.WriteByte(c)
+	}
+	if p.eof() || p.peek() != ']' {
+		return "", "", p.errorf()
+	}
+	p.pos++
+	return name, sub.String(), nil
+}
+
+// key [= value]，解析到行尾（包括换行符）
+func (p *configParser) parseEntry() (string, string, bool, error) {
+	start := p.pos
+	for !p.eof() && isConfigNameChar(rune(p.peek())) {
+		p.pos++
+	}
+	key := strings.ToLower(string(p.raw[start:p.pos]))
+
+	p.skipBlank()
+	if p.eof() || p.peek() == '\n' || p.peek() == '#' || p.peek() == ';' {
+		p.skipLine()
+		return key, "", true, nil
+	}
+	if p.peek() != '=' {
+		return "", "", false, p.errorf()
+	}
+	p.pos++
+	p.skipBlank()
+
+	var value strings.Builder
+	quoted := false
+	spaces := 0 // 引号外的空白，后面还有内容时才写入，从而去掉末尾的空白
+	for {
+		if p.eof() {
+			if quoted {
+				return "", "", false, p.errorf()
+			}
+			break
+		}
+		c := p.peek()
+		if c == '\n' {
+			if quoted {
+				return "", "", false, p.errorf()
+			}
+			p.pos++
+			p.line++
+			break
+		}
+		if !quoted && (c == '#' || c == ';') {
+			p.skipLine()
+			break
+		}
+		p.pos++
+		if !quoted && (c == ' ' || c == '\t' || c == '\r') {
+			if value.Len() > 0 {
+				spaces++
+			}
+			continue
+		}
+		for ; spaces > 0; spaces-- {
+			value.WriteByte(' ')
+		}
+
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if p.eof() {
+				return "", "", false, p.errorf()
+			}
+			e := p.peek()
+			p.pos++
+			switch e {
+			case '\n': // 续行
+				p.line++
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case '"', '\\':
+				value.WriteByte(e)
+			default:
+				return "", "", false, p.errorf()
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return key, value.String(), false, nil
+}
+
+// ---------------- 读取 ----------------
+
+// 读取单个配置文件，不展开 include，文件不存在时返回空配置
+func ReadConfigFile(file string, scope ConfigScope) (*Config, error) {
+	cf, err := readConfigFile(file, scope)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{Entries: cf.entries}, nil
+}
+
+func readConfigFile(file string, scope ConfigScope) (*configFile, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &configFile{path: file}, nil
+		}
+		return nil, err
+	}
+	return parseConfig(file, raw, scope)
+}
+
+// scope 对应的配置文件，global 有两个文件时返回 ~/.gitconfig（写入的目标）
+func ConfigFile(repo *Repository, scope ConfigScope) (string, error) {
+	switch scope {
+	case ScopeSystem:
+		if p, ok := os.LookupEnv(EnvConfigSystem); ok {
+			return p, nil
+		}
+		return "/etc/gitconfig", nil
+	case ScopeGlobal:
+		if p, ok := os.LookupEnv(EnvConfigGlobal); ok {
+			return p, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".gitconfig"), nil
+	case ScopeLocal, ScopeWorktree:
+		if repo == nil {
+			return "", fmt.Errorf("%w: %s config requires a repository", ErrNotARepository, scope)
+		}
+		if scope == ScopeWorktree {
+			return repo.repoPath(repo.configFile() + ".worktree"), nil
+		}
+		return repo.repoPath(repo.configFile()), nil
+	}
+	return "", fmt.Errorf("no config file for scope %s", scope)
+}
+
+// global scope 的所有文件，按读取顺序
+func globalConfigFiles() ([]string, error) {
+	if p, ok := os.LookupEnv(EnvConfigGlobal); ok {
+		return []string{p}, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	xdg, ok := os.LookupEnv("XDG_CONFIG_HOME")
+	if !ok || xdg == "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	return []string{filepath.Join(xdg, "git", "config"), filepath.Join(home, ".gitconfig")}, nil
+}
+
+// 按 system、global、local、worktree 的顺序读取配置，repo 为 nil 时只读取 system 和 global
+func LoadConfig(repo *Repository) (*Config, error) {
+	cfg := &Config{}
+	l := &configLoader{repo: repo}
+
+	if noSystem, _ := strconv.ParseBool(os.Getenv(EnvConfigNoSystem)); !noSystem {
+		p, err := ConfigFile(repo, ScopeSystem)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.load(cfg, p, ScopeSystem, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	globals, err := globalConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range globals {
+		if err := l.load(cfg, p, ScopeGlobal, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if repo == nil || repo.gitdir == "" {
+		return cfg, nil
+	}
+	local, err := ConfigFile(repo, ScopeLocal)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(cfg, local, ScopeLocal, 0); err != nil {
+		return nil, err
+	}
+
+	// 与 git 一样，只认 local 中的 extensions.worktreeConfig
+	localCfg := &Config{}
+	for _, e := range cfg.Entries {
+		if e.Scope == ScopeLocal {
+			localCfg.Entries = append(localCfg.Entries, e)
+		}
+	}
+	if enabled, err := localCfg.GetBool("extensions.worktreeconfig", false); err != nil {
+		return nil, err
+	} else if enabled {
+		p, err := ConfigFile(repo, ScopeWorktree)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.load(cfg, p, ScopeWorktree, 0); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+type configLoader struct {
+	repo *Repository // 用于 includeIf 的 gitdir 和 onbranch 条件，可以为 nil
+}
+
+// 读取 file 追加到 cfg，遇到 include 时在原位置展开
+func (l *configLoader) load(cfg *Config, file string, scope ConfigScope, depth int) error {
+	cf, err := readConfigFile(file, scope)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range cf.entries {
+		cfg.Entries = append(cfg.Entries, e)
+		if e.Key != "path" || e.NoValue {
+			continue
+		}
+
+		include := e.Section == "include" && e.Subsection == ""
+		if e.Section == "includeif" {
+			if include, err = l.matchCondition(e.Subsection, file); err != nil {
+				return err
+			}
+		}
+		if !include {
+			continue
+		}
+		if depth >= maxConfigIncludeDepth {
+			return fmt.Errorf("exceeded maximum include depth (%d) while including %s from %s", maxConfigIncludeDepth, e.Value, file)
+		}
+
+		p, err := expandConfigPath(e.Value, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		if err := l.load(cfg, p, scope, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeIf 的条件：gitdir:、gitdir/i: 和 onbranch:
+func (l *configLoader) matchCondition(cond, file string) (bool, error) {
+	kind, pattern, ok := strings.Cut(cond, ":")
+	if !ok || l.repo == nil || l.repo.gitdir == "" {
+		return false, nil
+	}
+
+	switch kind {
+	case "gitdir", "gitdir/i":
+		if strings.HasPrefix(pattern, "./") {
+			pattern = filepath.Join(filepath.Dir(file), pattern[2:])
+		} else {
+			var err error
+			if pattern, err = expandConfigPath(pattern, ""); err != nil {
+				return false, err
+			}
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		gitdir, err := filepath.Abs(l.repo.gitdir)
+		if err != nil {
+			return false, err
+		}
+		return configGlobMatch(pattern, filepath.ToSlash(gitdir), kind == "gitdir/i"), nil
+	case "onbranch":
+		branch, err := GetActiveBranch(l.repo)
+		if err != nil || branch == "" {
+			return false, err
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		return configGlobMatch(pattern, branch, false), nil
+	}
+	return false, nil
+}
+
+// 展开 ~/，相对路径基于 dir（包含它的配置文件所在的目录）
+func expandConfigPath(p, dir string) (string, error) {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	if !filepath.IsAbs(p) && dir != "" {
+		p = filepath.Join(dir, p)
+	}
+	return p, nil
+}
+
+// 支持 *、?、[...] 和 **
+func configGlobMatch(pattern, s string, foldCase bool) bool {
+	var re strings.Builder
+	re.WriteString("^")
+	if foldCase {
+		re.WriteString("(?i)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	ok, err := regexp.MatchString(re.String(), s)
+	return err == nil && ok
+}
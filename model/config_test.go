@@ -0,0 +1,203 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 把条目表示成 git config --list 的格式，没有值时只有名称
+func formatConfigEntries(entries []*ConfigEntry) []string {
+	res := []string{}
+	for _, e := range entries {
+		if e.NoValue {
+			res = append(res, e.Name())
+		} else {
+			res = append(res, e.Name()+"="+e.Value)
+		}
+	}
+	return res
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{"simple", "[core]\n\tbare = false\n\tfilemode=true\n", []string{"core.bare=false", "core.filemode=true"}},
+		{"case of names", "[Core]\n\tIgnoreCase = True\n", []string{"core.ignorecase=True"}},
+		{"subsection", "[remote \"Origin\"]\n\turl = /tmp/x\n", []string{"remote.Origin.url=/tmp/x"}},
+		{"escaped subsection", "[a \"b\\\"c\\\\d\\e\"]\n\tk = v\n", []string{"a.b\"c\\de.k=v"}},
+		{"deprecated subsection", "[branch.Main]\n\tremote = origin\n", []string{"branch.main.remote=origin"}},
+		{"no value", "[core]\n\tbare\n\tx ; comment\n", []string{"core.bare", "core.x"}},
+		{"empty value", "[core]\n\tx =\n", []string{"core.x="}},
+		{"comments", "# top\n; top\n[core] # header\n\tx = 1 # trailing\n\ty = 2;trailing\n", []string{"core.x=1", "core.y=2"}},
+		{"entry after header", "[core] x = 1\n", []string{"core.x=1"}},
+		{"quotes", "[a]\n\tk = \" lead\" mid \"# not comment \" \n", []string{"a.k= lead mid # not comment "}},
+		{"inner spaces", "[a]\n\tk = x   y\t z  \n", []string{"a.k=x   y  z"}},
+		{"escapes", "[a]\n\tk = a\\tb\\nc\\\\d\\\"e\\bf\n", []string{"a.k=a\tb\nc\\d\"e\bf"}},
+		{"continuation", "[a]\n\tk = one \\\n  two\n\tl = 3\n", []string{"a.k=one   two", "a.l=3"}},
+		{"crlf", "[a]\r\n\tk = v\r\n", []string{"a.k=v"}},
+		{"bom", "\xef\xbb\xbf[a]\n\tk = v\n", []string{"a.k=v"}},
+		{"no trailing newline", "[a]\n\tk = v", []string{"a.k=v"}},
+		{"repeated keys", "[a]\n\tk = 1\n[b]\n[a]\n\tk = 2\n", []string{"a.k=1", "a.k=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, err := parseConfig("config", []byte(tt.raw), ScopeLocal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatConfigEntries(cf.entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigLines(t *testing.T) {
+	raw := "# comment\n[a]\n\tk = one \\\n two\n\n\tl\n"
+	cf, err := parseConfig("config", []byte(raw), ScopeGlobal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.entries) != 2 || cf.entries[0].Line != 3 || cf.entries[1].Line != 6 {
+		t.Fatalf("entries = %+v, want lines 3 and 6", cf.entries)
+	}
+	if e := cf.entries[0]; e.Scope != ScopeGlobal || e.File != "config" {
+		t.Errorf("entry = %+v, want global scope in file config", e)
+	}
+	// start/end 覆盖条目所在的完整行，修改配置时据此替换
+	if got := raw[cf.entries[0].start:cf.entries[0].end]; got != "\tk = one \\\n two\n" {
+		t.Errorf("entry text = %q", got)
+	}
+}
+
+func TestParseConfigMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		line string
+	}{
+		{"entry before section", "k = v\n", "line 1"},
+		{"unterminated header", "[core\n", "line 1"},
+		{"empty section", "[]\n", "line 1"},
+		{"bad section name", "[co_re]\n", "line 1"},
+		{"unquoted subsection", "[a b]\n", "line 1"},
+		{"unterminated subsection", "[a \"b]\n", "line 1"},
+		{"text after subsection", "[a \"b\" c]\n", "line 1"},
+		{"bad key", "[a]\n\tk_x = 1\n", "line 2"},
+		{"unterminated quote", "[a]\n\tk = \"v\n", "line 2"},
+		{"bad escape", "[a]\n\tk = \\x\n", "line 2"},
+		{"escape at eof", "[a]\n\tk = v\\", "line 2"},
+		{"line after continuation", "[a]\n\tk = 1 \\\n2\n\t=\n", "line 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig("config", []byte(tt.raw), ScopeLocal)
+			if err == nil || !strings.Contains(err.Error(), "bad config "+tt.line+" in file config") {
+				t.Errorf("parseConfig(%q) error = %v, want bad config %s", tt.raw, err, tt.line)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	gitdir := filepath.Join(dir, "work", ".git")
+	writeTestFile(t, filepath.Join(gitdir, "HEAD"), "ref: refs/heads/feature/x\n")
+
+	writeTestFile(t, filepath.Join(dir, "inc", "a"), "[a]\n\tk = a\n[include]\n\tpath = b\n")
+	writeTestFile(t, filepath.Join(dir, "inc", "b"), "[b]\n\tk = b\n")
+	writeTestFile(t, filepath.Join(dir, "self"), "[include]\n\tpath = self\n")
+
+	tests := []struct {
+		name    string
+		config  string
+		want    []string
+		wantErr string
+	}{
+		{"relative and nested", "[x]\n\tk = 1\n[include]\n\tpath = inc/a\n[x]\n\tk = 2\n",
+			[]string{"x.k=1", "include.path=inc/a", "a.k=a", "include.path=b", "b.k=b", "x.k=2"}, ""},
+		{"absolute", "[include]\n\tpath = " + filepath.Join(dir, "inc", "b") + "\n",
+			[]string{"include.path=" + filepath.Join(dir, "inc", "b"), "b.k=b"}, ""},
+		{"missing file", "[include]\n\tpath = nothing\n[x]\n\tk = 1\n",
+			[]string{"include.path=nothing", "x.k=1"}, ""},
+		{"no value", "[include]\n\tpath\n", []string{"include.path"}, ""},
+		{"include subsection is ignored", "[include \"x\"]\n\tpath = inc/b\n", []string{"include.x.path=inc/b"}, ""},
+		{"gitdir", "[includeIf \"gitdir:" + filepath.Join(dir, "work") + "/\"]\n\tpath = inc/b\n",
+			[]string{"includeif.gitdir:" + filepath.Join(dir, "work") + "/.path=inc/b", "b.k=b"}, ""},
+		{"gitdir glob", "[includeIf \"gitdir:work/.git\"]\n\tpath = inc/b\n",
+			[]string{"includeif.gitdir:work/.git.path=inc/b", "b.k=b"}, ""},
+		{"gitdir no match", "[includeIf \"gitdir:/elsewhere/\"]\n\tpath = inc/b\n",
+			[]string{"includeif.gitdir:/elsewhere/.path=inc/b"}, ""},
+		{"gitdir case", "[includeIf \"gitdir:WORK/\"]\n\tpath = inc/b\n",
+			[]string{"includeif.gitdir:WORK/.path=inc/b"}, ""},
+		{"gitdir/i", "[includeIf \"gitdir/i:WORK/\"]\n\tpath = inc/b\n",
+			[]string{"includeif.gitdir/i:WORK/.path=inc/b", "b.k=b"}, ""},
+		{"onbranch", "[includeIf \"onbranch:feature/\"]\n\tpath = inc/b\n",
+			[]string{"includeif.onbranch:feature/.path=inc/b", "b.k=b"}, ""},
+		{"onbranch no match", "[includeIf \"onbranch:main\"]\n\tpath = inc/b\n",
+			[]string{"includeif.onbranch:main.path=inc/b"}, ""},
+		{"unknown condition", "[includeIf \"hasconfig:remote.*.url:x\"]\n\tpath = inc/b\n",
+			[]string{"includeif.hasconfig:remote.*.url:x.path=inc/b"}, ""},
+		{"include loop", "[include]\n\tpath = self\n", nil, "exceeded maximum include depth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "config")
+			writeTestFile(t, file, tt.config)
+
+			cfg := &Config{}
+			l := &configLoader{repo: &Repository{gitdir: gitdir, commondir: gitdir}}
+			err := l.load(cfg, file, ScopeGlobal, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatConfigEntries(cfg.Entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("load() = %q, want %q", got, tt.want)
+			}
+			for _, e := range cfg.Entries {
+				if e.Scope != ScopeGlobal {
+					t.Errorf("%s has scope %v, want global", e.Name(), e.Scope)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigIncludeWithoutRepo(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config")
+	writeTestFile(t, file, "[includeIf \"gitdir:/\"]\n\tpath = b\n[includeIf \"onbranch:*\"]\n\tpath = b\n")
+	writeTestFile(t, filepath.Join(dir, "b"), "[b]\n\tk = b\n")
+
+	// 不在仓库中时条件都不满足
+	cfg := &Config{}
+	if err := (&configLoader{}).load(cfg, file, ScopeGlobal, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Entries) != 2 {
+		t.Errorf("load() = %q, want only the includeIf entries", formatConfigEntries(cfg.Entries))
+	}
+}
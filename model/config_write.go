@@ -0,0 +1,176 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+修改单个配置文件：只替换或删除对应条目所在的行，其他内容（注释、缩进、顺序）保持不变；
+新条目追加到同名 section 的最后，没有该 section 时在文件末尾新建
+*/
+
+// 设置 name 的值，文件不存在时创建；name 已有多个值时返回错误
+func SetConfigValue(file, name, value string) error {
+	section, subsection, key, err := parseConfigName(name)
+	if err != nil {
+		return err
+	}
+	l, err := lockConfigFile(file)
+	if err != nil {
+		return err
+	}
+	defer l.Rollback()
+	cf, err := readConfigFile(file, ScopeFile)
+	if err != nil {
+		return err
+	}
+
+	existing := []*ConfigEntry{}
+	for _, e := range cf.entries {
+		if e.is(section, subsection, key) {
+			existing = append(existing, e)
+		}
+	}
+	if len(existing) > 1 {
+		return fmt.Errorf("cannot overwrite multiple values of %s with a single value", name)
+	}
+
+	// 保留用户输入的 key 的大小写
+	rawKey := name[strings.LastIndexByte(name, '.')+1:]
+	line := "\t" + rawKey + " = " + quoteConfigValue(value) + "\n"
+
+	raw := cf.raw
+	var res []byte
+	if len(existing) == 1 {
+		e := existing[0]
+		if e.start > 0 && raw[e.start-1] != '\n' { // 与 section header 在同一行
+			line = line[1:]
+		}
+		res = splice(raw, e.start, e.end, line)
+	} else {
+		var sec *configSection
+		for _, s := range cf.sections {
+			if s.name == section && s.subsection == subsection {
+				sec = s
+			}
+		}
+		if sec != nil {
+			if sec.end > 0 && raw[sec.end-1] != '\n' {
+				line = "\n" + line
+			}
+			res = splice(raw, sec.end, sec.end, line)
+		} else {
+			prefix := ""
+			if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+				prefix = "\n"
+			}
+			header := "[" + section + "]\n"
+			if subsection != "" {
+				header = "[" + section + " \"" + escapeSubsection(subsection) + "\"]\n"
+			}
+			res = splice(raw, len(raw), len(raw), prefix+header+line)
+		}
+	}
+	return writeConfigFile(l, res)
+}
+
+// 删除 name，返回删除的条目数；all 为 false 且有多个值时返回错误
+func UnsetConfigValue(file, name string, all bool) (int, error) {
+	section, subsection, key, err := parseConfigName(name)
+	if err != nil {
+		return 0, err
+	}
+	l, err := lockConfigFile(file)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Rollback()
+	cf, err := readConfigFile(file, ScopeFile)
+	if err != nil {
+		return 0, err
+	}
+
+	existing := []*ConfigEntry{}
+	for _, e := range cf.entries {
+		if e.is(section, subsection, key) {
+			existing = append(existing, e)
+		}
+	}
+	if len(existing) == 0 {
+		return 0, nil
+	}
+	if len(existing) > 1 && !all {
+		return 0, fmt.Errorf("%s has multiple values", name)
+	}
+
+	raw := cf.raw
+	for i := len(existing) - 1; i >= 0; i-- {
+		e := existing[i]
+		end := e.end
+		if e.start > 0 && raw[e.start-1] != '\n' && end > 0 && raw[end-1] == '\n' {
+			end-- // 与 section header 在同一行，保留换行
+		}
+		raw = splice(raw, e.start, end, "")
+	}
+	return len(existing), writeConfigFile(l, raw)
+}
+
+func splice(raw []byte, start, end int, s string) []byte {
+	res := make([]byte, 0, len(raw)-(end-start)+len(s))
+	res = append(res, raw[:start]...)
+	res = append(res, s...)
+	return append(res, raw[end:]...)
+}
+
+// 读取之前锁定配置文件，避免并发修改时丢失其他进程的修改
+func lockConfigFile(file string) (*LockFile, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	return AcquireLock(file, 0)
+}
+
+// 写入 lock 文件再重命名，避免写到一半时损坏配置
+func writeConfigFile(l *LockFile, data []byte) error {
+	if _, err := l.Write(data); err != nil {
+		return err
+	}
+	return l.Commit()
+}
+
+// 首尾有空白或者包含注释符号时加引号；\、"、换行和 tab 总是转义
+func quoteConfigValue(v string) string {
+	var b strings.Builder
+	quote := v != "" && (v[0] == ' ' || v[0] == '\t' || v[len(v)-1] == ' ' || v[len(v)-1] == '\t' ||
+		strings.ContainsAny(v, "#;"))
+	if quote {
+		b.WriteByte('"')
+	}
+	for _, c := range []byte(v) {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func escapeSubsection(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -1,7 +1,47 @@
 package model
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
+// model 中的函数通过返回值报告错误，调用方可以用 errors.Is / errors.As 判断下面这些错误
 var (
-	ERROR_READ_OBJECT = errors.New("failed to read object's format")
+	ErrNotARepository = errors.New("not a mgit repository")
+	ErrObjectNotFound = errors.New("object not found")
+	ErrCorruptObject  = errors.New("corrupt object")
+	ErrCorruptIndex   = errors.New("corrupt index")
+	ErrNoWorktree     = errors.New("this operation must be run in a work tree") // bare 仓库
+	ErrUnmerged       = errors.New("unmerged paths")                            // index 中有冲突条目
 )
+
+// 名称（短 hash、分支、标签）匹配到了多个对象
+type AmbiguousRefError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousRefError) Error() string {
+	return fmt.Sprintf("ambiguous argument '%s': candidates are:\n - %s", e.Name, strings.Join(e.Candidates, "\n - "))
+}
+
+func objectNotFoundErr(sha string) error {
+	return fmt.Errorf("%w: %s", ErrObjectNotFound, sha)
+}
+
+// err 可以为 nil
+func corruptObjectErr(sha string, err error, reason string) error {
+	if err != nil {
+		return fmt.Errorf("%w %s: %s: %w", ErrCorruptObject, sha, reason, err)
+	}
+	return fmt.Errorf("%w %s: %s", ErrCorruptObject, sha, reason)
+}
+
+func corruptCommitGraphErr(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorruptObject, fmt.Sprintf(format, a...))
+}
+
+func corruptIndexErr(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorruptIndex, fmt.Sprintf(format, a...))
+}
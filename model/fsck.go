@@ -0,0 +1,375 @@
+package model
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+fsck 检查对象数据库：
+
+ 1. 重新计算每个对象的 hash，与其名称比对
+ 2. 严格地解析 tree、commit、tag
+ 3. 从 refs、HEAD 和 index 出发检查所有被引用的对象都存在
+ 4. 找出不可达（unreachable）和悬空（dangling，不可达且没有被任何对象引用）的对象
+*/
+
+type FsckReport struct {
+	Errors      []string // 损坏的对象、缺失的对象，出现任何一个都说明仓库已损坏
+	Dangling    []string // "<type> <sha>"
+	Unreachable []string // "<type> <sha>"
+}
+
+func (r *FsckReport) Corrupt() bool {
+	return len(r.Errors) > 0
+}
+
+// 对象之间的引用
+type fsckLink struct {
+	sha    string
+	format string // 期望的类型
+}
+
+var (
+	identRegx   = regexp.MustCompile(`^[^<>\n]* <[^<>\n]*> [0-9]+ [+-][0-9]{4}$`)
+	validModes  = []string{"100644", "100755", "120000", "040000", "160000"}
+	validFormat = map[string]bool{"blob": true, "tree": true, "commit": true, "tag": true}
+)
+
+// 对象本身的问题记录在报告中，只有无法遍历对象数据库、refs 或 index 时才返回 error
+func Fsck(repo *Repository) (*FsckReport, error) {
+	report := &FsckReport{}
+	errorf := func(format string, a ...any) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, a...))
+	}
+
+	all := []string{}
+	err := repo.Objects().Iterate(func(sha string) {
+		all = append(all, sha)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(all)
+
+	types := make(map[string]string)
+	links := make(map[string][]fsckLink)
+	for _, sha := range all {
+		format, l, err := fsckObject(repo, sha)
+		if format != "" {
+			types[sha] = format
+		}
+		if err != nil {
+			if format == "" {
+				errorf("error: %s: %v", sha, err)
+			} else {
+				errorf("error in %s %s: %v", format, sha, err)
+			}
+			continue
+		}
+		links[sha] = l
+	}
+
+	// 连通性检查
+	reached := make(map[string]bool)
+	queue := []fsckLink{}
+	roots, err := fsckRoots(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if _, ok := types[root[1]]; !ok {
+			errorf("error: %s: invalid pointer %s", root[0], root[1])
+			continue
+		}
+		queue = append(queue, fsckLink{root[1], ""})
+	}
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		if reached[l.sha] {
+			continue
+		}
+		reached[l.sha] = true
+
+		format, ok := types[l.sha]
+		if !ok {
+			errorf("missing %s %s", l.format, l.sha)
+			continue
+		}
+		if l.format != "" && l.format != format {
+			errorf("error: object %s is a %s, not a %s", l.sha, format, l.format)
+		}
+		queue = append(queue, links[l.sha]...)
+	}
+
+	// 被其他对象引用的对象即使不可达，也不算悬空
+	referenced := make(map[string]bool)
+	for _, l := range links {
+		for _, v := range l {
+			referenced[v.sha] = true
+		}
+	}
+	for _, sha := range all {
+		format, ok := types[sha]
+		// alternates 中的对象可能被其他仓库引用，不报告
+		if !ok || reached[sha] || !repo.HasLocalObject(sha) {
+			continue
+		}
+		report.Unreachable = append(report.Unreachable, format+" "+sha)
+		if !referenced[sha] {
+			report.Dangling = append(report.Dangling, format+" "+sha)
+		}
+	}
+
+	return report, nil
+}
+
+// [名称, sha]
+func fsckRoots(repo *Repository) ([][2]string, error) {
+	roots := [][2]string{}
+	var collect func(prefix string, refs map[string]any)
+	collect = func(prefix string, refs map[string]any) {
+		for k, v := range refs {
+			switch v := v.(type) {
+			case string:
+				if v != "" {
+					roots = append(roots, [2]string{path.Join(prefix, k), v})
+				}
+			case map[string]any:
+				collect(path.Join(prefix, k), v)
+			}
+		}
+	}
+	refs, err := ListRef(repo, "")
+	if err != nil {
+		return nil, err
+	}
+	collect("refs", refs)
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i][0] < roots[j][0]
+	})
+
+	head, err := GetRefSha(repo, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		roots = append(roots, [2]string{"HEAD", head})
+	}
+	index, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	roots = append(roots, indexRoots(index, "")...)
+
+	others, err := linkedWorktreeRoots(repo)
+	if err != nil {
+		return nil, err
+	}
+	return append(roots, others...), nil
+}
+
+// 校验单个对象，返回其类型和引用的其他对象
+func fsckObject(repo *Repository, sha string) (format string, links []fsckLink, err error) {
+	format, size, r, err := OpenObjectStream(repo, sha)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	if !validFormat[format] {
+		return "", nil, fmt.Errorf("unknown object type %q", format)
+	}
+
+	h := repo.newHash()
+	h.Write(objectHeader(format, int(size)))
+	var data []byte
+	if format == "blob" {
+		_, err = io.Copy(h, r)
+	} else {
+		data, err = io.ReadAll(r)
+		h.Write(data)
+	}
+	if err != nil {
+		return format, nil, err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sha {
+		return format, nil, fmt.Errorf("hash mismatch, content hashes to %s", actual)
+	}
+
+	hexSize := repo.HashSize() * 2
+	switch format {
+	case "tree":
+		links, err = fsckTree(data, repo.HashSize())
+	case "commit":
+		links, err = fsckCommit(data, hexSize)
+	case "tag":
+		links, err = fsckTag(data, hexSize)
+	}
+	return format, links, err
+}
+
+func fsckTree(data []byte, hashSize int) ([]fsckLink, error) {
+	links := []fsckLink{}
+	var prev *treeLeaf
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		null := bytes.IndexByte(data, 0)
+		if space <= 0 || null < space || null+1+hashSize > len(data) {
+			return nil, fmt.Errorf("malformed tree entry")
+		}
+		leaf := &treeLeaf{
+			Mode: string(data[:space]),
+			Path: string(data[space+1 : null]),
+			Sha:  hex.EncodeToString(data[null+1 : null+1+hashSize]),
+		}
+		data = data[null+1+hashSize:]
+
+		if len(leaf.Mode) == 5 {
+			leaf.Mode = "0" + leaf.Mode
+		} else if strings.HasPrefix(leaf.Mode, "0") {
+			return nil, fmt.Errorf("zero-padded file mode %s", leaf.Mode)
+		}
+		if !slices.Contains(validModes, leaf.Mode) {
+			return nil, fmt.Errorf("bad file mode %q for %q", leaf.Mode, leaf.Path)
+		}
+		if leaf.Path == "" || leaf.Path == "." || leaf.Path == ".." || strings.Contains(leaf.Path, "/") {
+			return nil, fmt.Errorf("bad entry name %q", leaf.Path)
+		}
+		if prev != nil {
+			if prev.Path == leaf.Path {
+				return nil, fmt.Errorf("duplicate entry %q", leaf.Path)
+			}
+			if prev.sortKey() > leaf.sortKey() {
+				return nil, fmt.Errorf("entries not sorted: %q before %q", prev.Path, leaf.Path)
+			}
+		}
+		prev = leaf
+
+		switch {
+		case leaf.Mode == "160000": // gitlink，指向子模块中的 commit，不在本仓库
+		case leaf.Mode == "040000":
+			links = append(links, fsckLink{leaf.Sha, "tree"})
+		default:
+			links = append(links, fsckLink{leaf.Sha, "blob"})
+		}
+	}
+	return links, nil
+}
+
+// 按顺序读取头部，返回 (key, value) 列表，续行会拼接到上一个值
+func fsckHeaders(data []byte) ([][2]string, error) {
+	headers := [][2]string{}
+	for {
+		nl := bytes.IndexByte(data, '\n')
+		if nl == -1 {
+			return nil, fmt.Errorf("missing blank line before message")
+		}
+		if nl == 0 {
+			return headers, nil
+		}
+		line := string(data[:nl])
+		data = data[nl+1:]
+
+		if strings.HasPrefix(line, " ") {
+			// 续行
+			if len(headers) == 0 {
+				return nil, fmt.Errorf("unexpected continuation line")
+			}
+			headers[len(headers)-1][1] += "\n" + line[1:]
+			continue
+		}
+		key, value, ok := strings.Cut(line, " ")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		headers = append(headers, [2]string{key, value})
+	}
+}
+
+func fsckCommit(data []byte, hexSize int) ([]fsckLink, error) {
+	headers, err := fsckHeaders(data)
+	if err != nil {
+		return nil, err
+	}
+
+	links := []fsckLink{}
+	i := 0
+	next := func(key string) (string, bool) {
+		if i < len(headers) && headers[i][0] == key {
+			i++
+			return headers[i-1][1], true
+		}
+		return "", false
+	}
+
+	tree, ok := next("tree")
+	if !ok {
+		return nil, fmt.Errorf("missing tree header")
+	}
+	if !isHexName(tree, hexSize) {
+		return nil, fmt.Errorf("invalid tree %q", tree)
+	}
+	links = append(links, fsckLink{tree, "tree"})
+
+	for {
+		parent, ok := next("parent")
+		if !ok {
+			break
+		}
+		if !isHexName(parent, hexSize) {
+			return nil, fmt.Errorf("invalid parent %q", parent)
+		}
+		links = append(links, fsckLink{parent, "commit"})
+	}
+
+	for _, key := range []string{"author", "committer"} {
+		ident, ok := next(key)
+		if !ok {
+			return nil, fmt.Errorf("missing %s header", key)
+		}
+		if !identRegx.MatchString(ident) {
+			return nil, fmt.Errorf("invalid %s line %q", key, ident)
+		}
+	}
+	return links, nil
+}
+
+func fsckTag(data []byte, hexSize int) ([]fsckLink, error) {
+	headers, err := fsckHeaders(data)
+	if err != nil {
+		return nil, err
+	}
+
+	expect := []string{"object", "type", "tag"}
+	if len(headers) < len(expect) {
+		return nil, fmt.Errorf("missing %s header", expect[len(headers)])
+	}
+	for i, key := range expect {
+		if headers[i][0] != key {
+			return nil, fmt.Errorf("missing %s header", key)
+		}
+	}
+
+	object, typ, name := headers[0][1], headers[1][1], headers[2][1]
+	if !isHexName(object, hexSize) {
+		return nil, fmt.Errorf("invalid object %q", object)
+	}
+	if !validFormat[typ] {
+		return nil, fmt.Errorf("invalid type %q", typ)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("empty tag name")
+	}
+	if len(headers) > 3 && headers[3][0] == "tagger" && !identRegx.MatchString(headers[3][1]) {
+		return nil, fmt.Errorf("invalid tagger line %q", headers[3][1])
+	}
+	return []fsckLink{{object, typ}}, nil
+}
@@ -0,0 +1,275 @@
+package model
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// 收集所有引用（refs/**、各个 worktree 的 HEAD）以及 index 中的 sha（包括 resolve undo）
+func RootObjects(repo *Repository) ([]string, error) {
+	roots := []string{}
+	var collect func(refs map[string]any)
+	collect = func(refs map[string]any) {
+		for _, v := range refs {
+			switch v := v.(type) {
+			case string:
+				if v != "" {
+					roots = append(roots, v)
+				}
+			case map[string]any:
+				collect(v)
+			}
+		}
+	}
+	refs, err := ListRef(repo, "")
+	if err != nil {
+		return nil, err
+	}
+	collect(refs)
+
+	head, err := GetRefSha(repo, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		roots = append(roots, head)
+	}
+
+	index, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range indexRoots(index, "") {
+		roots = append(roots, r[1])
+	}
+
+	others, err := linkedWorktreeRoots(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range others {
+		roots = append(roots, r[1])
+	}
+	return roots, nil
+}
+
+// index 引用的对象及其描述：各个条目，以及 resolve undo 记录的冲突时的各个 stage。
+// 与 git 相同，resolve undo 中的对象也不能被删除，否则之后无法恢复冲突
+func indexRoots(index *Index, prefix string) [][2]string {
+	roots := [][2]string{}
+	for _, e := range index.Entries {
+		roots = append(roots, [2]string{prefix + "index entry " + e.Name, e.Sha})
+	}
+	for _, u := range index.ResolveUndo {
+		for _, sha := range u.Shas {
+			if sha != "" {
+				roots = append(roots, [2]string{prefix + "resolve-undo " + u.Name, sha})
+			}
+		}
+	}
+	return roots
+}
+
+// 从 roots 出发遍历所有可达对象，返回 sha -> 路径提示（commit、tag 为空）
+func ReachableObjects(repo *Repository, roots []string) (map[string]string, error) {
+	seen := make(map[string]string)
+	queue := []string{}
+	for _, r := range roots {
+		if _, ok := seen[r]; !ok {
+			seen[r] = ""
+			queue = append(queue, r)
+		}
+	}
+
+	visit := func(sha, name string) {
+		if sha == "" {
+			return
+		}
+		if _, ok := seen[sha]; !ok {
+			seen[sha] = name
+			queue = append(queue, sha)
+		}
+	}
+
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+
+		// blob 不需要解析，也不必读入内存
+		format, _, r, err := OpenObjectStream(repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		r.Close()
+		if format == "blob" {
+			continue
+		}
+
+		obj, err := ReadObject(repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		switch obj := obj.(type) {
+		case *CommitObj:
+			visit(obj.Tree, "")
+			for _, p := range obj.Parents() {
+				visit(p, "")
+			}
+		case *TagObj:
+			visit(obj.Object, "")
+		case *TreeObj:
+			for _, leaf := range obj.items {
+				if leaf.Mode == "160000" { // gitlink，指向子模块中的 commit
+					continue
+				}
+				name := path.Join(seen[sha], leaf.Path)
+				if !strings.HasPrefix(leaf.Mode, "04") {
+					if _, ok := seen[leaf.Sha]; !ok {
+						seen[leaf.Sha] = name
+					}
+					continue
+				}
+				visit(leaf.Sha, name)
+			}
+		}
+	}
+	return seen, nil
+}
+
+// 列出所有的 loose object
+func LooseObjects(repo *Repository) ([]string, error) {
+	if repo.Objects(); repo.loose == nil {
+		return []string{}, nil
+	}
+	return repo.loose.list()
+}
+
+// 删除已经被打包的 loose object，返回删除的数量
+func RemovePackedLooseObjects(repo *Repository) (int, error) {
+	shas, err := LooseObjects(repo)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, sha := range shas {
+		if repo.pack.Has(sha) {
+			if err := repo.loose.remove(sha); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// 删除超过 grace 时长仍不可达的 loose object，返回删除的数量
+func PruneLooseObjects(repo *Repository, reachable map[string]string, grace time.Duration) (int, error) {
+	shas, err := LooseObjects(repo)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	deadline := time.Now().Add(-grace)
+
+	for _, sha := range shas {
+		if _, ok := reachable[sha]; ok {
+			continue
+		}
+		stat, err := os.Stat(repo.loose.path(sha))
+		if err != nil {
+			return pruned, err
+		}
+		if stat.ModTime().Before(deadline) {
+			if err := repo.loose.remove(sha); err != nil {
+				return pruned, err
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// 删除除 keep 之外的所有 packfile。
+// 不在 keep 中的对象先写成 loose object，mtime 沿用原来的 pack，
+// 之后由 PruneLooseObjects 按 grace 时长清理（同 git repack -A）
+func RemovePacks(repo *Repository, keep string) error {
+	if repo.Objects(); repo.pack == nil {
+		return nil
+	}
+	packs, err := repo.pack.list()
+	if err != nil {
+		return err
+	}
+	defer repo.pack.reload()
+
+	var kept *packIndex
+	removing := []*packFile{}
+	for _, p := range packs {
+		if strings.TrimSuffix(path.Base(p.path), ".pack") == keep {
+			kept = p.index
+		} else {
+			removing = append(removing, p)
+		}
+	}
+	// 全部写出之后再删除，REF_DELTA 的 base 可能在其他待删除的 pack 中
+	for _, p := range removing {
+		if err := loosenPackObjects(repo, p, kept); err != nil {
+			return err
+		}
+	}
+	for _, p := range removing {
+		if err := os.Remove(strings.TrimSuffix(p.path, ".pack") + ".idx"); err != nil {
+			return err
+		}
+		if err := os.Remove(p.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把 p 中不在 kept 里的对象写成 loose object
+func loosenPackObjects(repo *Repository, p *packFile, kept *packIndex) error {
+	stat, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < p.index.count(); i++ {
+		rawsha := p.index.shaAt(i)
+		if kept != nil {
+			if _, ok := kept.find(rawsha); ok {
+				continue
+			}
+		}
+		sha := hex.EncodeToString(rawsha)
+		if repo.loose.Has(sha) {
+			continue
+		}
+		if err := loosenObject(repo, sha); err != nil {
+			return err
+		}
+		if err := os.Chtimes(repo.loose.path(sha), stat.ModTime(), stat.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loosenObject(repo *Repository, sha string) error {
+	format, size, r, err := repo.pack.OpenStream(sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	written, err := repo.loose.WriteStream(format, size, r, repo.newHash())
+	if err != nil {
+		return err
+	}
+	if written != sha {
+		return corruptObjectErr(sha, nil, "hash mismatch")
+	}
+	return nil
+}
@@ -53,37 +53,57 @@ type GitIgnore struct {
 	Scoped   map[string][]*IgnoreRule // 存在于各个目录下的 .gitignore
 }
 
-func ReadGitignore(repo *Repository) *GitIgnore {
+func ReadGitignore(repo *Repository) (*GitIgnore, error) {
 	res := &GitIgnore{[]*IgnoreRule{}, map[string][]*IgnoreRule{}}
 
-	readRules := func(file string) {
-		if util.IsFileExist(file) {
-			content, err := os.ReadFile(file)
-			util.PanicErr(err)
+	readRules := func(file string) error {
+		if !util.IsFileExist(file) {
+			return nil
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
 
-			lines := []string{}
-			scanner := bufio.NewScanner(bytes.NewReader(content))
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			res.Absolute = append(res.Absolute, parseGitignoreRules(lines)...)
+		lines := []string{}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
 		}
+		res.Absolute = append(res.Absolute, parseGitignoreRules(lines)...)
+		return nil
+	}
+	repoFile := repo.repoPath("info/exclude")
+	if err := readRules(repoFile); err != nil {
+		return nil, err
 	}
-	repoFile := path.Join(repo.gitdir, "info/exlcude")
-	readRules(repoFile)
 
-	// global conf
-	confHome, ok := os.LookupEnv("XDG_CONFIG_HOME")
-	if !ok {
-		confHome = os.ExpandEnv("~/.config")
+	// core.excludesFile，默认为 $XDG_CONFIG_HOME/git/ignore
+	globalFile, ok := repo.Config().Get("core.excludesfile")
+	if ok {
+		var err error
+		if globalFile, err = expandConfigPath(globalFile, ""); err != nil {
+			return nil, err
+		}
+	} else {
+		confHome, ok := os.LookupEnv("XDG_CONFIG_HOME")
+		if !ok || confHome == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			confHome = path.Join(home, ".config")
+		}
+		globalFile = path.Join(confHome, "git/ignore")
+	}
+	if err := readRules(globalFile); err != nil {
+		return nil, err
 	}
-	globalFile := path.Join(confHome, "git/ignore")
-	readRules(globalFile)
 
-	// .gitignore files in the worktree
+	// .gitignore files in the worktree，与当前目录无关，都从 worktree 的根目录开始查找
 	ignoreFiles := []string{}
-	filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
-		if !d.IsDir() && d.Name() == ".gitignore" {
+	filepath.WalkDir(repo.Worktree(), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() == ".gitignore" {
 			ignoreFiles = append(ignoreFiles, path)
 		}
 		return nil
@@ -91,25 +111,31 @@ func ReadGitignore(repo *Repository) *GitIgnore {
 
 	for _, f := range ignoreFiles {
 		raw, err := os.ReadFile(f)
-		util.PanicErr(err)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := filepath.Rel(repo.Worktree(), filepath.Dir(f))
+		if err != nil {
+			return nil, err
+		}
 		lines := strings.Split(string(raw), "\n")
-		res.Scoped[filepath.Dir(f)] = parseGitignoreRules(lines)
+		res.Scoped[filepath.ToSlash(dir)] = parseGitignoreRules(lines)
 	}
 
-	return res
+	return res, nil
 }
 
-func CheckIgnore(p string, rules *GitIgnore) bool {
+func CheckIgnore(p string, rules *GitIgnore) (bool, error) {
 	if path.IsAbs(p) {
-		util.PanicErr(fmt.Errorf("requires path to be relative to the repository's root"))
+		return false, fmt.Errorf("requires path to be relative to the repository's root: %s", p)
 	}
 
 	res := checkIgnoreScoped(p, rules.Scoped)
 	if res != nil {
-		return *res
+		return *res, nil
 	}
 
-	return checkIgnoreAbsolute(p, rules.Absolute)
+	return checkIgnoreAbsolute(p, rules.Absolute), nil
 }
 
 // 检查在本工作树下的忽视规则
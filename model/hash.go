@@ -0,0 +1,65 @@
+package model
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// extensions.objectFormat 的取值
+const (
+	ObjectFormatSHA1   = "sha1"
+	ObjectFormatSHA256 = "sha256"
+)
+
+var hashSizes = map[string]int{
+	ObjectFormatSHA1:   sha1.Size,
+	ObjectFormatSHA256: sha256.Size,
+}
+
+func checkObjectFormat(format string) error {
+	if _, ok := hashSizes[format]; !ok {
+		return fmt.Errorf("unknown object format %q", format)
+	}
+	return nil
+}
+
+// 仓库使用的 hash 算法，repo 为 nil（例如 hash-object 不写入）时为 sha1
+func (r *Repository) ObjectFormat() string {
+	if r == nil || r.objectFormat == "" {
+		return ObjectFormatSHA1
+	}
+	return r.objectFormat
+}
+
+// 二进制 hash 的字节数
+func (r *Repository) HashSize() int {
+	return hashSizes[r.ObjectFormat()]
+}
+
+// 全 0 的 sha，表示不存在的对象，例如 post-checkout 之前的 HEAD
+func (r *Repository) NullSha() string {
+	return strings.Repeat("0", r.HashSize()*2)
+}
+
+// s 是否为完整的 sha（小写十六进制，长度与仓库的 hash 算法一致）
+func (r *Repository) IsFullSha(s string) bool {
+	return isHexName(s, r.HashSize()*2) && strings.ToLower(s) == s
+}
+
+// 空 tree 对象的 sha
+func (r *Repository) emptyTreeSha() string {
+	h := r.newHash()
+	h.Write(objectHeader("tree", 0))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *Repository) newHash() hash.Hash {
+	if r.ObjectFormat() == ObjectFormatSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
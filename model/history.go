@@ -0,0 +1,138 @@
+package model
+
+import (
+	"sort"
+)
+
+// 按提交时间从新到旧遍历 starts 的所有祖先（包括自身），每个 commit 只访问一次，fn 返回 false 时停止
+func WalkCommits(repo *Repository, starts []string, fn func(info *CommitInfo) bool) error {
+	seen := make(map[string]bool)
+	queue := []*CommitInfo{}
+	push := func(sha string) error {
+		if sha == "" || seen[sha] {
+			return nil
+		}
+		seen[sha] = true
+		info, err := GetCommitInfo(repo, sha)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(queue), func(i int) bool {
+			return queue[i].Time < info.Time
+		})
+		queue = append(queue, nil)
+		copy(queue[i+1:], queue[i:])
+		queue[i] = info
+		return nil
+	}
+
+	for _, sha := range starts {
+		if err := push(sha); err != nil {
+			return err
+		}
+	}
+	for len(queue) > 0 {
+		info := queue[0]
+		queue = queue[1:]
+		if !fn(info) {
+			return nil
+		}
+		for _, p := range info.Parents {
+			if err := push(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// a 是否为 b 的祖先（a == b 也算）。
+// 两者都在 commit-graph 中时，generation 不大于 a 的 commit 不可能到达 a，可以提前剪枝
+func IsAncestor(repo *Repository, a, b string) (bool, error) {
+	target, err := GetCommitInfo(repo, a)
+	if err != nil {
+		return false, err
+	}
+	seen := map[string]bool{b: true}
+	stack := []string{b}
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if sha == a {
+			return true, nil
+		}
+
+		info, err := GetCommitInfo(repo, sha)
+		if err != nil {
+			return false, err
+		}
+		if target.Generation != GenerationInfinity && info.Generation <= target.Generation {
+			continue
+		}
+		for _, p := range info.Parents {
+			if !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+	return false, nil
+}
+
+// a 和 b 的最佳公共祖先：公共祖先中不是其他公共祖先的祖先的那些
+func MergeBases(repo *Repository, a, b string) ([]string, error) {
+	ancestors := make(map[string]bool)
+	err := WalkCommits(repo, []string{a}, func(info *CommitInfo) bool {
+		ancestors[info.Sha] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 从 b 出发，遇到 a 的祖先就不再往下走
+	candidates := []string{}
+	seen := map[string]bool{b: true}
+	queue := []string{b}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if ancestors[sha] {
+			candidates = append(candidates, sha)
+			continue
+		}
+		info, err := GetCommitInfo(repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range info.Parents {
+			if !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	res := []string{}
+	for i, c := range candidates {
+		redundant := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			ok, err := IsAncestor(repo, c, other)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			res = append(res, c)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
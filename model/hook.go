@@ -0,0 +1,112 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+/*
+hooks：与 git 相同，在固定的时机执行仓库 hooks 目录（或 core.hooksPath）中与事件同名的可执行文件。
+hook 在 worktree 的根目录（bare 仓库为仓库目录）中执行，stdin 为空，stdout 重定向到 stderr，
+通过 MGIT_DIR、MGIT_WORK_TREE（兼容模式下还有 GIT_DIR、GIT_WORK_TREE、GIT_INDEX_FILE）找到仓库
+*/
+
+const (
+	HookPreCommit    = "pre-commit"
+	HookCommitMsg    = "commit-msg"
+	HookPostCommit   = "post-commit"
+	HookPostCheckout = "post-checkout"
+)
+
+// hook 以非 0 状态退出
+type HookError struct {
+	Name string
+	Code int
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook exited with status %d", e.Name, e.Code)
+}
+
+// core.hooksPath 的相对路径基于 hook 执行的目录
+func HooksDir(repo *Repository) (string, error) {
+	p, ok := repo.Config().Get("core.hookspath")
+	if !ok || p == "" {
+		return filepath.Abs(repo.repoPath("hooks"))
+	}
+	return expandConfigPath(p, hookWorkDir(repo))
+}
+
+func hookWorkDir(repo *Repository) string {
+	if repo.IsBare() {
+		return repo.gitdir
+	}
+	return repo.worktree
+}
+
+// hook 不存在或者不可执行时返回空字符串，后者与 git 一样给出提示
+func FindHook(repo *Repository, name string) (string, error) {
+	dir, err := HooksDir(repo)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, name)
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if stat.IsDir() {
+		return "", nil
+	}
+	if stat.Mode()&0111 == 0 {
+		fmt.Fprintf(os.Stderr, "hint: The '%s' hook was ignored because it's not set as executable.\n", name)
+		return "", nil
+	}
+	return p, nil
+}
+
+// 执行 hook，不存在时直接返回；非 0 退出时返回 *HookError
+func RunHook(repo *Repository, name string, args ...string) error {
+	p, err := FindHook(repo, name)
+	if err != nil || p == "" {
+		return err
+	}
+
+	gitdir, err := filepath.Abs(repo.gitdir)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), EnvDir+"="+gitdir)
+	worktree := ""
+	if !repo.IsBare() {
+		if worktree, err = filepath.Abs(repo.worktree); err != nil {
+			return err
+		}
+		env = append(env, EnvWorkTree+"="+worktree)
+	}
+	if repo.compat {
+		env = append(env, "GIT_DIR="+gitdir)
+		if worktree != "" {
+			env = append(env, "GIT_WORK_TREE="+worktree, "GIT_INDEX_FILE="+filepath.Join(gitdir, "index"))
+		}
+	}
+
+	cmd := exec.Command(p, args...)
+	cmd.Dir = hookWorkDir(repo)
+	cmd.Env = env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &HookError{Name: name, Code: exitErr.ExitCode()}
+	}
+	return err
+}
@@ -1,15 +1,16 @@
 package model
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
 	"os"
-	"path"
 	"slices"
 	"sort"
-	"strconv"
+	"strings"
 
 	"github.com/ignorantshr/mgit/util"
 )
@@ -32,14 +33,82 @@ type IndexEntry struct {
 	Sha            string
 	FlagAssumValid bool
 	FlagStage      int64
+	SkipWorktree   bool   // extended flag（v3 起），sparse checkout 不检出的文件
+	IntentToAdd    bool   // extended flag（v3 起），add -N 添加的、还没有内容的文件
 	Name           string // full path
 }
 
+// IndexEntry.ModeType 的取值
+const (
+	ModeTypeRegular = 0b1000
+	ModeTypeSymlink = 0b1010
+	ModeTypeGitlink = 0b1110
+)
+
+// 完整的 mode，例如 0o100755
+func (e *IndexEntry) Mode() int {
+	return e.ModeType<<12 | e.ModePerms
+}
+
+func (e *IndexEntry) SetMode(mode int) {
+	e.ModeType, e.ModePerms = mode>>12, mode&0o7777
+}
+
+// 用文件的元数据填充条目
+func (e *IndexEntry) SetStat(st *util.FileStat) {
+	e.Ctime = TimePair{st.CtimeSec, st.CtimeNsec}
+	e.Mtime = TimePair{st.MtimeSec, st.MtimeNsec}
+	e.Device, e.Inode = st.Dev, st.Ino
+	e.Uid, e.Gid = st.Uid, st.Gid
+	e.Fsize = st.Size
+}
+
+// 文件的元数据与条目中记录的不同，说明文件可能被修改过。
+// index 中只保存各个值的低 32 位，所以只比较低 32 位
+func (e *IndexEntry) StatChanged(st *util.FileStat) bool {
+	pairs := [][2]int64{
+		{e.Ctime.S, st.CtimeSec}, {e.Ctime.NS, st.CtimeNsec},
+		{e.Mtime.S, st.MtimeSec}, {e.Mtime.NS, st.MtimeNsec},
+		{e.Device, st.Dev}, {e.Inode, st.Ino},
+		{int64(e.Uid), int64(st.Uid)}, {int64(e.Gid), int64(st.Gid)},
+		{e.Fsize, st.Size},
+	}
+	for _, p := range pairs {
+		if uint32(p[0]) != uint32(p[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否需要 v3 的 extended flags
+func (e *IndexEntry) extended() bool {
+	return e.SkipWorktree || e.IntentToAdd
+}
+
 type Index struct {
-	Version int
-	Entries []*IndexEntry
+	Version     int
+	Entries     []*IndexEntry
+	Tree        *CacheTree     // TREE 扩展，没有时为 nil
+	ResolveUndo []*ResolveUndo // REUC 扩展
+
+	extensions []*indexExtension // 原样保留的其他扩展
+	lock       *LockFile         // ReadIndexLocked 持有的 index.lock
+	// cached tree 最近一次有效时各个条目中与 tree 相关的内容，用来发现没有通过 Add/Remove 的修改
+	treeState map[*IndexEntry]string
 }
 
+/*
+index 的版本：
+  - v2：条目名称以 0x00 结尾，整个条目补齐到 8 字节
+  - v3：flags 中设置了 extended 位的条目后面多 2 字节的 extended flags
+  - v4：没有补齐，名称按前缀压缩：先是要从上一个名称末尾去掉的字节数（变长编码），再是以 0x00 结尾的剩余部分
+*/
+const (
+	indexMinVersion = 2
+	indexMaxVersion = 4
+)
+
 func NewIndex(ver int, entries []*IndexEntry) *Index {
 	if ver < 2 {
 		ver = 2
@@ -53,33 +122,63 @@ func NewIndex(ver int, entries []*IndexEntry) *Index {
 	return i
 }
 
-func ReadIndex(repo *Repository) *Index {
+// index 文件不存在时返回空的 index，格式错误时返回 ErrCorruptIndex
+func ReadIndex(repo *Repository) (*Index, error) {
 	indexFile, err := repo.RepoFile(false, "index")
-	util.PanicErr(err)
+	if err != nil {
+		return nil, err
+	}
 
-	index := NewIndex(2, nil)
 	// new repository have no index
 	if !util.IsFile(indexFile) {
-		return index
+		ver, err := configIndexVersion(repo)
+		if err != nil {
+			return nil, err
+		}
+		return NewIndex(ver, nil), nil
 	}
 
 	raw, err := os.ReadFile(indexFile)
-	util.PanicErr(err)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(repo, raw)
+}
 
+// 解析 index 文件的内容，hash 的长度和算法由 repo 的对象格式决定
+func decodeIndex(repo *Repository, raw []byte) (*Index, error) {
+	hashSize := int64(repo.HashSize())
+	if int64(len(raw)) < 12+hashSize {
+		return nil, corruptIndexErr("index file is too short")
+	}
+	// 结尾是前面所有内容的 hash，全 0 表示没有计算（git 的 index.skipHash）
+	body, trailer := raw[:int64(len(raw))-hashSize], raw[int64(len(raw))-hashSize:]
+	if !bytes.Equal(trailer, make([]byte, hashSize)) {
+		h := repo.newHash()
+		h.Write(body)
+		if !bytes.Equal(h.Sum(nil), trailer) {
+			return nil, corruptIndexErr("bad index file checksum")
+		}
+	}
 	header := raw[:12]
 	signature := header[:4]
 	if string(signature) != "DIRC" {
-		util.PanicErr(fmt.Errorf("index file header error: %v", signature))
+		return nil, corruptIndexErr("bad signature %q", signature)
 	}
 	version := util.BytesToInt(header[4:8])
-	if version != 2 {
-		util.PanicErr(fmt.Errorf("index file version error: %v", version))
+	if version < indexMinVersion || version > indexMaxVersion {
+		return nil, corruptIndexErr("unsupported version %d", version)
 	}
 	count := util.BytesToInt(header[8:])
+	index := NewIndex(version, nil)
 
-	content := raw[12:]
+	content := body[12:]
 	idx := int64(0)
+	prevName := "" // v4 的名称基于上一个条目的名称
 	for i := 0; i < count; i++ {
+		if idx+42+hashSize > int64(len(content)) {
+			return nil, corruptIndexErr("entry %d is truncated", i)
+		}
 		ctime_s := util.BytesToInt64(content[idx : idx+4])
 		ctime_ns := util.BytesToInt64(content[idx+4 : idx+8])
 		mtime_s := util.BytesToInt64(content[idx+8 : idx+12])
@@ -94,28 +193,66 @@ func ReadIndex(repo *Repository) *Index {
 		uid := util.BytesToInt(content[idx+28 : idx+32])
 		gid := util.BytesToInt(content[idx+32 : idx+36])
 		fsize := util.BytesToInt64(content[idx+36 : idx+40])
-		sha := hex.EncodeToString(content[idx+40 : idx+60]) // fmt.Sprintf("%40x", new(big.Int).SetBytes(content[idx+40:idx+60])) // 将字节序列表示的整数转换为一个 40 字节长度的十六进制字符串
-		util.PanicErr(err)
-		flags := util.BytesToInt64(content[idx+60 : idx+62])
+		sha := hex.EncodeToString(content[idx+40 : idx+40+hashSize]) // sha1 为 20 字节，sha256 为 32 字节
+		flags := util.BytesToInt64(content[idx+40+hashSize : idx+42+hashSize])
 		flagAssumValid := (flags & 0b1000000000000000) != 0
-		// flagExtend := (flags & 0b0100000000000000) != 0 // assert
+		flagExtended := (flags & 0b0100000000000000) != 0
 		flagStage := flags & 0b0011000000000000
 		nameLength := flags & 0b0000111111111111 // 12bit 存储，最大 0xFFF，可能会溢出，所以继续向后寻找直到 0x00
-		idx += 62
-		var rawName []byte
-		if nameLength < 0xFFF {
-			if content[idx+nameLength] != 0x00 {
-				util.PanicErr(fmt.Errorf("name length parse fail"))
+		idx += 42 + hashSize
+
+		var skipWorktree, intentToAdd bool
+		if flagExtended {
+			if version < 3 {
+				return nil, corruptIndexErr("entry %d has extended flags in index v%d", i, version)
 			}
-			rawName = content[idx : idx+nameLength]
-			idx += nameLength + 1
+			if idx+2 > int64(len(content)) {
+				return nil, corruptIndexErr("entry %d is truncated", i)
+			}
+			extFlags := util.BytesToInt64(content[idx : idx+2])
+			skipWorktree = extFlags&0b0100000000000000 != 0
+			intentToAdd = extFlags&0b0010000000000000 != 0
+			idx += 2
+		}
+
+		var name string
+		if version == 4 {
+			r := bytes.NewReader(content[idx:])
+			strip, err := readOfsDeltaOffset(r) // 与 OFS_DELTA 的偏移是同一种变长编码
+			if err != nil || strip > uint64(len(prevName)) {
+				return nil, corruptIndexErr("bad path prefix of entry %d", i)
+			}
+			idx += int64(r.Size()) - int64(r.Len())
+			nullIdx := bytes.IndexByte(content[idx:], '\x00')
+			if nullIdx == -1 {
+				return nil, corruptIndexErr("name of entry %d is not terminated", i)
+			}
+			name = prevName[:len(prevName)-int(strip)] + string(content[idx:idx+int64(nullIdx)])
+			idx += int64(nullIdx) + 1
 		} else {
-			nullIdx := bytes.IndexByte(content[idx+0xFFF:], '\x00')
-			rawName = content[idx : idx+0xFFF+int64(nullIdx)]
-			idx = int64(nullIdx) + 1
+			var rawName []byte
+			if nameLength < 0xFFF {
+				if idx+nameLength >= int64(len(content)) || content[idx+nameLength] != 0x00 {
+					return nil, corruptIndexErr("name length parse fail")
+				}
+				rawName = content[idx : idx+nameLength]
+				idx += nameLength + 1
+			} else {
+				if idx+0xFFF > int64(len(content)) {
+					return nil, corruptIndexErr("name of entry %d is truncated", i)
+				}
+				nullIdx := bytes.IndexByte(content[idx+0xFFF:], '\x00')
+				if nullIdx == -1 {
+					return nil, corruptIndexErr("name of entry %d is not terminated", i)
+				}
+				rawName = content[idx : idx+0xFFF+int64(nullIdx)]
+				idx += 0xFFF + int64(nullIdx) + 1
+			}
+			name = string(rawName)
+			idx = 8 * int64(math.Ceil(float64(idx)/8))
 		}
-		name := string(rawName)
-		idx = 8 * int64(math.Ceil(float64(idx)/8))
+		prevName = name
+
 		index.Entries = append(index.Entries, &IndexEntry{
 			Ctime:          TimePair{int64(ctime_s), ctime_ns},
 			Mtime:          TimePair{mtime_s, mtime_ns},
@@ -129,33 +266,117 @@ func ReadIndex(repo *Repository) *Index {
 			Sha:            sha,
 			FlagAssumValid: flagAssumValid,
 			FlagStage:      flagStage,
+			SkipWorktree:   skipWorktree,
+			IntentToAdd:    intentToAdd,
 			Name:           name,
 		})
 	}
 
-	return index
+	index.snapshotTree()
+	if err := index.readExtensions(content[idx:], int(hashSize)); err != nil {
+		return nil, err
+	}
+	return index, nil
 }
 
-func WriteIndex(repo *Repository, index *Index) {
+// 先锁定 index 再读取，直到 WriteIndex 或 Unlock 之前其他进程都不能修改 index，
+// 并发的读取-修改-写入不会丢失修改。调用方需要 defer index.Unlock()
+func ReadIndexLocked(repo *Repository) (*Index, error) {
+	if err := repo.CheckWorktree(); err != nil {
+		return nil, err
+	}
 	p, err := repo.RepoFile(false, "index")
-	util.PanicErr(err)
-	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	util.PanicErr(err)
-	defer f.Close()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := AcquireLock(p, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := ReadIndex(repo)
+	if err != nil {
+		lock.Rollback()
+		return nil, err
+	}
+	index.lock = lock
+	return index, nil
+}
+
+// 放弃修改，释放 ReadIndexLocked 持有的 lock；WriteIndex 之后调用没有影响
+func (i *Index) Unlock() {
+	if i.lock != nil {
+		i.lock.Rollback()
+		i.lock = nil
+	}
+}
+
+func WriteIndex(repo *Repository, index *Index) error {
+	if err := repo.CheckWorktree(); err != nil {
+		return err
+	}
+	p, err := repo.RepoFile(false, "index")
+	if err != nil {
+		return err
+	}
+
+	// 写到 index.lock，完成后再替换 index，其他进程不会读到写了一半的 index；
+	// ReadIndexLocked 读取的 index 使用已经持有的 lock
+	f := index.lock
+	if f == nil {
+		if f, err = AcquireLock(p, 0); err != nil {
+			return err
+		}
+	}
+	index.lock = nil
+	defer f.Rollback()
+	if err := encodeIndex(repo, index, f); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// 把 index 编码后写到 out，末尾是前面所有内容的 hash
+func encodeIndex(repo *Repository, index *Index, out io.Writer) error {
+	// index.version 决定写入的版本，有 extended flags 的条目至少需要 v3
+	if ver, err := configIndexVersion(repo); err != nil {
+		return err
+	} else if ver != 0 {
+		index.Version = ver
+	}
+	if index.Version < 3 && slices.ContainsFunc(index.Entries, (*IndexEntry).extended) {
+		index.Version = 3
+	}
+	if index.Version < indexMinVersion || index.Version > indexMaxVersion {
+		return fmt.Errorf("unsupported index version %d", index.Version)
+	}
+
+	// 文件末尾是前面所有内容的 hash
+	h := repo.newHash()
+	w := bufio.NewWriter(io.MultiWriter(out, h))
+
+	// git 要求条目按路径排序，同一路径按 stage 排序
+	sort.SliceStable(index.Entries, func(i, j int) bool {
+		a, b := index.Entries[i], index.Entries[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.FlagStage < b.FlagStage
+	})
 
 	// 字节宽度，int 值
 	wrinteger := func(width, value int) {
-		f.Write(util.IntToBytes(value, width))
+		w.Write(util.IntToBytes(value, width))
 	}
 
 	// HEADER
-	f.WriteString("DIRC")
+	w.WriteString("DIRC")
 	wrinteger(4, index.Version)
 	wrinteger(4, len(index.Entries))
 
 	// ENTRIES
 
-	idx := 0
+	fixedSize := 42 + repo.HashSize() // 定长部分，sha1 时为 62 字节
+	prevName := ""
 	for _, e := range index.Entries {
 		wrinteger(4, int(e.Ctime.S))
 		wrinteger(4, int(e.Ctime.NS))
@@ -169,88 +390,155 @@ func WriteIndex(repo *Repository, index *Index) {
 		wrinteger(4, int(e.Gid))
 		wrinteger(4, int(e.Fsize))
 
-		sha, _ := hex.DecodeString(e.Sha)
-		f.Write(sha)
+		sha, err := hex.DecodeString(e.Sha)
+		if err != nil || len(sha) != repo.HashSize() {
+			return fmt.Errorf("invalid sha %q for index entry %q", e.Sha, e.Name)
+		}
+		w.Write(sha)
 
-		flagAssumValid := 0
+		flags := int(e.FlagStage)
 		if e.FlagAssumValid {
-			flagAssumValid = 0x1 << 15
+			flags |= 0x1 << 15
+		}
+		if e.extended() {
+			flags |= 0x1 << 14
 		}
 		nameLen := len(e.Name)
 		if nameLen >= 0xFFF {
 			nameLen = 0xFFF
 		}
-		wrinteger(2, flagAssumValid|int(e.FlagStage)|nameLen)
-		f.WriteString(e.Name)
+		wrinteger(2, flags|nameLen)
+		entrySize := fixedSize
+		if e.extended() {
+			extFlags := 0
+			if e.SkipWorktree {
+				extFlags |= 0x1 << 14
+			}
+			if e.IntentToAdd {
+				extFlags |= 0x1 << 13
+			}
+			wrinteger(2, extFlags)
+			entrySize += 2
+		}
+
+		if index.Version == 4 {
+			common := 0
+			for common < len(prevName) && common < len(e.Name) && prevName[common] == e.Name[common] {
+				common++
+			}
+			w.Write(encodeOfsDeltaOffset(uint64(len(prevName) - common)))
+			w.WriteString(e.Name[common:])
+			wrinteger(1, 0)
+			prevName = e.Name
+			continue
+		}
 
-		// 0x00
-		wrinteger(1, 0)
+		w.WriteString(e.Name)
+		entrySize += len(e.Name)
+		// 0x00 结尾，并补齐到 8 字节
+		w.Write(make([]byte, 8-entrySize%8))
+	}
 
-		idx += 62 + nameLen + 1
+	// EXTENSIONS
+	var ext bytes.Buffer
+	if err := index.writeExtensions(&ext, repo.HashSize()); err != nil {
+		return err
+	}
+	w.Write(ext.Bytes())
 
-		if idx%8 != 0 {
-			pad := 8 - idx%8
-			buf := make([]byte, pad)
-			f.Write(buf)
-			idx += pad
-		}
+	if err := w.Flush(); err != nil {
+		return err
 	}
+	_, err := out.Write(h.Sum(nil))
+	return err
 }
 
-func Index2Tree(repo *Repository, index *Index) string {
-	// 遍历 index 文件，根据文件路径由深到浅逐层构建 tree 结构
-	contents := make(map[string][]any)
-	sortpaths := make([]string, 0)
+// 根据 index 生成 tree 对象，并更新 index 的 cached tree；cached tree 有效的目录直接使用记录的 sha。
+// 有冲突条目时返回 ErrUnmerged
+func Index2Tree(repo *Repository, index *Index) (string, error) {
+	if conflicts := index.Unmerged(); len(conflicts) != 0 {
+		return "", unmergedErr(conflicts)
+	}
+	entries := slices.Clone(index.Entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	if index.Tree == nil {
+		index.Tree = &CacheTree{EntryCount: -1}
+	}
+	index.invalidateChanged()
+	sha, err := writeCachedTree(repo, entries, "", index.Tree)
+	if err != nil {
+		return "", err
+	}
+	index.snapshotTree()
+	return sha, nil
+}
 
-	for _, e := range index.Entries {
-		dir := path.Dir(e.Name)
-		contents[dir] = append(contents[dir], e)
-		sortpaths = append(sortpaths, dir)
-
-		key := dir
-		// 对每一级目录都建立一个列表项
-		for key != "." {
-			if _, ok := contents[key]; !ok {
-				contents[key] = []any{}
-			}
-			key = path.Dir(key)
-		}
+// entries 为目录 prefix 下按名称排序的所有条目
+func writeCachedTree(repo *Repository, entries []*IndexEntry, prefix string, ct *CacheTree) (string, error) {
+	if ct.EntryCount == len(entries) && ct.Sha != "" && repo.Objects().Has(ct.Sha) {
+		return ct.Sha, nil
 	}
 
-	// 路径长度倒序
-	sort.Slice(sortpaths, func(i, j int) bool {
-		return len(sortpaths[i]) > len(sortpaths[j])
-	})
-	// 去重
-	sortpaths = slices.Compact[[]string](sortpaths)
-
-	sha := "" // 记录 tree 根的 sha
-	for _, p := range sortpaths {
-		tree := NewTreeObj()
-
-		// 每个文件路径构建一棵树
-		for _, e := range contents[p] {
-			// An entry can be a normal GitIndexEntry read from the index,
-			// or a tree we've created.
-			var leaf *treeLeaf
-			switch v := e.(type) {
-			case *IndexEntry:
-				mode, _ := strconv.Atoi(fmt.Sprintf("%02o%04o", v.ModeType, v.ModePerms))
-				leafMode := string(util.IntToBytes(mode, 6))
-				leaf = &treeLeaf{Mode: leafMode, Path: path.Base(v.Name), Sha: v.Sha}
-			case [2]string:
-				mode, _ := strconv.Atoi(fmt.Sprintf("%02o%04o", 4, 0))
-				leafMode := string(util.IntToBytes(mode, 6))
-				leaf = &treeLeaf{Mode: leafMode, Path: path.Base(v[0]), Sha: v[1]}
+	tree := NewTreeObj()
+	subtrees := []*CacheTree{}
+	for i := 0; i < len(entries); {
+		e := entries[i]
+		rel := e.Name[len(prefix):]
+		dir, _, isDir := strings.Cut(rel, "/")
+		if !isDir {
+			i++
+			// intent-to-add 的条目还没有内容，不写入 tree
+			if e.IntentToAdd {
+				continue
 			}
-			tree.items = append(tree.items, leaf)
+			leafMode := fmt.Sprintf("%02o%04o", e.ModeType, e.ModePerms)
+			tree.items = append(tree.items, &treeLeaf{Mode: leafMode, Path: rel, Sha: e.Sha})
+			continue
+		}
+
+		// 同一个目录下的条目排序后是连续的
+		subPrefix := prefix + dir + "/"
+		j := i + 1
+		for j < len(entries) && strings.HasPrefix(entries[j].Name, subPrefix) {
+			j++
 		}
+		sub := ct.sub(dir)
+		if sub == nil {
+			sub = &CacheTree{Name: dir, EntryCount: -1}
+		}
+		sha, err := writeCachedTree(repo, entries[i:j], subPrefix, sub)
+		if err != nil {
+			return "", err
+		}
+		subtrees = append(subtrees, sub)
+		i = j
 
-		sha = WriteObject(repo, tree) // 写子树到磁盘
-		parent := path.Dir(p)
-		base := path.Base(p)
-		contents[parent] = append(contents[parent], [2]string{base, sha}) // 加到父目录项中
+		// 只有 intent-to-add 条目的目录是空的，不写入 tree
+		if sha == repo.emptyTreeSha() {
+			continue
+		}
+		leafMode := fmt.Sprintf("%02o%04o", 4, 0)
+		tree.items = append(tree.items, &treeLeaf{Mode: leafMode, Path: dir, Sha: sha})
 	}
 
-	return sha
+	sha, err := WriteObject(repo, tree) // 写子树到磁盘
+	if err != nil {
+		return "", err
+	}
+	ct.Sha, ct.EntryCount, ct.Subtrees = sha, len(entries), subtrees
+	return sha, nil
+}
+
+// index.version 配置的版本，没有配置时为 0
+func configIndexVersion(repo *Repository) (int, error) {
+	ver, err := repo.Config().GetInt("index.version", 0)
+	if err != nil {
+		return 0, err
+	}
+	if ver != 0 && (ver < indexMinVersion || ver > indexMaxVersion) {
+		return 0, fmt.Errorf("bad index.version %d, should be between %d and %d", ver, indexMinVersion, indexMaxVersion)
+	}
+	return int(ver), nil
 }
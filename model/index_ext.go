@@ -0,0 +1,337 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+index 的扩展位于条目之后、结尾的 hash 之前，每个扩展为 4 字节签名 + 4 字节长度 + 数据。
+签名首字母大写的是可选扩展，不认识时可以忽略；否则必须理解才能使用这个 index。
+  - TREE（cached tree）：记录目录对应的 tree 对象，提交时没有变化的目录不用重新生成 tree
+  - REUC（resolve undo）：解决冲突时删除的 stage 1~3 条目，用于恢复冲突
+其他可选扩展原样保留，只有会因为条目变化而失效的扩展在重写时丢弃
+*/
+
+const (
+	extCachedTree  = "TREE"
+	extResolveUndo = "REUC"
+)
+
+// 依赖条目的位置或内容，mgit 修改条目后不能保证正确，重写时丢弃（git 会重新生成）
+var staleExtensions = map[string]bool{
+	"EOIE": true, // end of index entry，记录 index 文件中的偏移
+	"IEOT": true, // index entry offset table
+	"FSMN": true, // fsmonitor 的 bitmap 按条目位置记录
+	"UNTR": true, // untracked cache，删除条目时需要使对应目录失效
+}
+
+// TREE 扩展中的一个目录
+type CacheTree struct {
+	Name       string // 目录名，根目录为空
+	EntryCount int    // 目录下（包括子目录）的 index 条目数，-1 表示已失效
+	Sha        string
+	Subtrees   []*CacheTree
+}
+
+func (t *CacheTree) sub(name string) *CacheTree {
+	for _, s := range t.Subtrees {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// REUC 扩展中的一个路径，Modes[i] 为 0 时 stage i+1 不存在
+type ResolveUndo struct {
+	Name  string
+	Modes [3]int
+	Shas  [3]string
+}
+
+// 不认识的可选扩展
+type indexExtension struct {
+	signature string
+	data      []byte
+}
+
+// 加入条目，并使所在目录的 cached tree 失效；已有的同名条目需要调用方先删除
+func (i *Index) Add(e *IndexEntry) {
+	i.Entries = append(i.Entries, e)
+	i.invalidateTree(e.Name)
+}
+
+// 删除 name 的所有条目，返回是否有条目被删除。
+// 删除的是冲突条目（stage 1~3）时记录到 resolve undo，以便之后恢复冲突
+func (i *Index) Remove(name string) bool {
+	kept := make([]*IndexEntry, 0, len(i.Entries))
+	var undo *ResolveUndo
+	for _, e := range i.Entries {
+		if e.Name != name {
+			kept = append(kept, e)
+			continue
+		}
+		if stage := e.Stage(); stage != StageMerged {
+			if undo == nil {
+				undo = &ResolveUndo{Name: name}
+			}
+			undo.Modes[stage-1] = e.Mode()
+			undo.Shas[stage-1] = e.Sha
+		}
+	}
+	if len(kept) == len(i.Entries) {
+		return false
+	}
+	i.Entries = kept
+	i.invalidateTree(name)
+
+	if undo != nil {
+		i.ResolveUndo = slices.DeleteFunc(i.ResolveUndo, func(u *ResolveUndo) bool { return u.Name == name })
+		i.ResolveUndo = append(i.ResolveUndo, undo)
+	}
+	return true
+}
+
+// name 所在的各级目录的 cached tree 失效
+func (i *Index) invalidateTree(name string) {
+	t := i.Tree
+	for t != nil {
+		t.EntryCount = -1
+		dir, rest, ok := strings.Cut(name, "/")
+		if !ok {
+			return
+		}
+		t, name = t.sub(dir), rest
+	}
+}
+
+// 条目中决定 tree 内容的部分
+func treeStateOf(e *IndexEntry) string {
+	return fmt.Sprintf("%o %s %d %t %s", e.Mode(), e.Sha, e.Stage(), e.IntentToAdd, e.Name)
+}
+
+// 记录当前各个条目的状态，此时 cached tree 与条目一致
+func (i *Index) snapshotTree() {
+	i.treeState = make(map[*IndexEntry]string, len(i.Entries))
+	for _, e := range i.Entries {
+		i.treeState[e] = treeStateOf(e)
+	}
+}
+
+// 直接修改条目或者 Entries 时不会经过 invalidateTree，生成 tree 之前找出这些条目，
+// 使所在目录的 cached tree 失效
+func (i *Index) invalidateChanged() {
+	for _, e := range i.Entries {
+		if state, ok := i.treeState[e]; !ok || state != treeStateOf(e) {
+			i.invalidateTree(e.Name)
+		}
+	}
+}
+
+func (i *Index) readExtensions(data []byte, hashSize int) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return corruptIndexErr("extension header is truncated")
+		}
+		sig := string(data[:4])
+		size := binary.BigEndian.Uint32(data[4:8])
+		if uint64(len(data)-8) < uint64(size) {
+			return corruptIndexErr("extension %s is truncated", sig)
+		}
+		body := data[8 : 8+size]
+		data = data[8+size:]
+
+		switch {
+		case sig == extCachedTree:
+			tree, rest, err := parseCacheTree(body, hashSize)
+			if err != nil {
+				return err
+			}
+			if len(rest) != 0 {
+				return corruptIndexErr("bad TREE extension")
+			}
+			i.Tree = tree
+		case sig == extResolveUndo:
+			undo, err := parseResolveUndo(body, hashSize)
+			if err != nil {
+				return err
+			}
+			i.ResolveUndo = undo
+		case sig[0] < 'A' || sig[0] > 'Z':
+			return fmt.Errorf("index uses %s extension, which mgit does not understand", sig)
+		case !staleExtensions[sig]:
+			i.extensions = append(i.extensions, &indexExtension{sig, body})
+		}
+	}
+	return nil
+}
+
+func (i *Index) writeExtensions(buf *bytes.Buffer, hashSize int) error {
+	write := func(sig string, data []byte) {
+		buf.WriteString(sig)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+		buf.Write(data)
+	}
+
+	if i.Tree != nil {
+		var data bytes.Buffer
+		if err := i.Tree.encode(&data, hashSize); err != nil {
+			return err
+		}
+		write(extCachedTree, data.Bytes())
+	}
+	if len(i.ResolveUndo) != 0 {
+		data, err := encodeResolveUndo(i.ResolveUndo, hashSize)
+		if err != nil {
+			return err
+		}
+		write(extResolveUndo, data)
+	}
+	for _, ext := range i.extensions {
+		write(ext.signature, ext.data)
+	}
+	return nil
+}
+
+// 目录名 \0 条目数 空格 子目录数 \n，条目数不为 -1 时接着是 tree 的 sha，然后依次是各个子目录
+func parseCacheTree(data []byte, hashSize int) (*CacheTree, []byte, error) {
+	bad := corruptIndexErr("bad TREE extension")
+	null := bytes.IndexByte(data, 0)
+	if null == -1 {
+		return nil, nil, bad
+	}
+	t := &CacheTree{Name: string(data[:null])}
+	data = data[null+1:]
+
+	nl := bytes.IndexByte(data, '\n')
+	if nl == -1 {
+		return nil, nil, bad
+	}
+	fields := strings.Fields(string(data[:nl]))
+	data = data[nl+1:]
+	if len(fields) != 2 {
+		return nil, nil, bad
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, nil, bad
+	}
+	subtrees, err := strconv.Atoi(fields[1])
+	if err != nil || subtrees < 0 {
+		return nil, nil, bad
+	}
+	t.EntryCount = count
+
+	if count >= 0 {
+		if len(data) < hashSize {
+			return nil, nil, bad
+		}
+		t.Sha = hex.EncodeToString(data[:hashSize])
+		data = data[hashSize:]
+	}
+	for k := 0; k < subtrees; k++ {
+		var sub *CacheTree
+		if sub, data, err = parseCacheTree(data, hashSize); err != nil {
+			return nil, nil, err
+		}
+		t.Subtrees = append(t.Subtrees, sub)
+	}
+	return t, data, nil
+}
+
+func (t *CacheTree) encode(buf *bytes.Buffer, hashSize int) error {
+	buf.WriteString(t.Name)
+	buf.WriteByte(0)
+	fmt.Fprintf(buf, "%d %d\n", t.EntryCount, len(t.Subtrees))
+	if t.EntryCount >= 0 {
+		sha, err := hex.DecodeString(t.Sha)
+		if err != nil || len(sha) != hashSize {
+			return fmt.Errorf("invalid sha %q for cached tree %q", t.Sha, t.Name)
+		}
+		buf.Write(sha)
+	}
+
+	// 与 git 相同，子目录先按名称长度、再按名称排序
+	sort.Slice(t.Subtrees, func(a, b int) bool {
+		x, y := t.Subtrees[a].Name, t.Subtrees[b].Name
+		if len(x) != len(y) {
+			return len(x) < len(y)
+		}
+		return x < y
+	})
+	for _, sub := range t.Subtrees {
+		if err := sub.encode(buf, hashSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 路径 \0，三个八进制 mode 各以 \0 结尾，然后是 mode 不为 0 的 stage 的 sha
+func parseResolveUndo(data []byte, hashSize int) ([]*ResolveUndo, error) {
+	bad := corruptIndexErr("bad REUC extension")
+	res := []*ResolveUndo{}
+	for len(data) > 0 {
+		null := bytes.IndexByte(data, 0)
+		if null == -1 {
+			return nil, bad
+		}
+		u := &ResolveUndo{Name: string(data[:null])}
+		data = data[null+1:]
+
+		for k := 0; k < 3; k++ {
+			null := bytes.IndexByte(data, 0)
+			if null == -1 {
+				return nil, bad
+			}
+			mode, err := strconv.ParseInt(string(data[:null]), 8, 32)
+			if err != nil {
+				return nil, bad
+			}
+			u.Modes[k] = int(mode)
+			data = data[null+1:]
+		}
+		for k := 0; k < 3; k++ {
+			if u.Modes[k] == 0 {
+				continue
+			}
+			if len(data) < hashSize {
+				return nil, bad
+			}
+			u.Shas[k] = hex.EncodeToString(data[:hashSize])
+			data = data[hashSize:]
+		}
+		res = append(res, u)
+	}
+	return res, nil
+}
+
+func encodeResolveUndo(undo []*ResolveUndo, hashSize int) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, u := range undo {
+		buf.WriteString(u.Name)
+		buf.WriteByte(0)
+		for _, mode := range u.Modes {
+			buf.WriteString(strconv.FormatInt(int64(mode), 8))
+			buf.WriteByte(0)
+		}
+		for k, mode := range u.Modes {
+			if mode == 0 {
+				continue
+			}
+			sha, err := hex.DecodeString(u.Shas[k])
+			if err != nil || len(sha) != hashSize {
+				return nil, fmt.Errorf("invalid sha %q for resolve undo %q", u.Shas[k], u.Name)
+			}
+			buf.Write(sha)
+		}
+	}
+	return buf.Bytes(), nil
+}
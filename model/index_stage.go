@@ -0,0 +1,116 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+没有冲突的路径在 index 中只有一个 stage 0 的条目。
+合并出现冲突时同一路径最多有三个条目：stage 1 为共同祖先（base），stage 2 为当前分支（ours），
+stage 3 为合并进来的分支（theirs），某一方不存在（例如被删除）时没有对应的条目。
+用 add / rm 解决冲突时删除所有 stage，删除的冲突条目记录到 REUC 扩展
+*/
+
+const (
+	StageMerged = 0
+	StageBase   = 1
+	StageOurs   = 2
+	StageTheirs = 3
+)
+
+func (e *IndexEntry) Stage() int {
+	return int(e.FlagStage >> 12)
+}
+
+func (e *IndexEntry) SetStage(stage int) {
+	e.FlagStage = int64(stage&0b11) << 12
+}
+
+// name 在 stage 上的条目，不存在时为 nil
+func (i *Index) Entry(name string, stage int) *IndexEntry {
+	for _, e := range i.Entries {
+		if e.Name == name && e.Stage() == stage {
+			return e
+		}
+	}
+	return nil
+}
+
+// 加入条目，替换同名同 stage 的条目。与 git 相同，加入 stage 0 的条目会删除冲突的各个 stage
+// （记录到 resolve undo），加入冲突条目则删除 stage 0 的条目
+func (i *Index) Set(e *IndexEntry) {
+	stage := e.Stage()
+	if stage == StageMerged {
+		i.Remove(e.Name)
+	} else {
+		i.Entries = slices.DeleteFunc(i.Entries, func(old *IndexEntry) bool {
+			return old.Name == e.Name && (old.Stage() == stage || old.Stage() == StageMerged)
+		})
+	}
+	i.Add(e)
+}
+
+// 一个冲突的路径，Stages[i] 为 stage i+1 的条目，不存在时为 nil
+type Conflict struct {
+	Name   string
+	Stages [3]*IndexEntry
+}
+
+func (c *Conflict) Base() *IndexEntry   { return c.Stages[StageBase-1] }
+func (c *Conflict) Ours() *IndexEntry   { return c.Stages[StageOurs-1] }
+func (c *Conflict) Theirs() *IndexEntry { return c.Stages[StageTheirs-1] }
+
+// 按名称排序的所有冲突路径
+func (i *Index) Unmerged() []*Conflict {
+	byName := map[string]*Conflict{}
+	for _, e := range i.Entries {
+		stage := e.Stage()
+		if stage == StageMerged {
+			continue
+		}
+		c := byName[e.Name]
+		if c == nil {
+			c = &Conflict{Name: e.Name}
+			byName[e.Name] = c
+		}
+		c.Stages[stage-1] = e
+	}
+
+	res := make([]*Conflict, 0, len(byName))
+	for _, c := range byName {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Name < res[b].Name })
+	return res
+}
+
+func (i *Index) HasUnmerged() bool {
+	return slices.ContainsFunc(i.Entries, func(e *IndexEntry) bool { return e.Stage() != StageMerged })
+}
+
+// 用 base、ours、theirs 替换 name 的所有条目，不存在的一方传 nil。
+// 重新产生冲突后之前的 resolve undo 记录不再有意义，一并删除
+func (i *Index) SetConflict(name string, base, ours, theirs *IndexEntry) {
+	i.Entries = slices.DeleteFunc(i.Entries, func(e *IndexEntry) bool { return e.Name == name })
+	i.ResolveUndo = slices.DeleteFunc(i.ResolveUndo, func(u *ResolveUndo) bool { return u.Name == name })
+	for k, e := range []*IndexEntry{base, ours, theirs} {
+		if e == nil {
+			continue
+		}
+		e.Name = name
+		e.SetStage(k + 1)
+		i.Entries = append(i.Entries, e)
+	}
+	i.invalidateTree(name)
+}
+
+func unmergedErr(conflicts []*Conflict) error {
+	names := make([]string, len(conflicts))
+	for k, c := range conflicts {
+		names[k] = c.Name
+	}
+	return fmt.Errorf("%w: %s", ErrUnmerged, strings.Join(names, ", "))
+}
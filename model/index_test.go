@@ -0,0 +1,337 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestRepo(t *testing.T, objectFormat string) *Repository {
+	t.Helper()
+	repo, err := NewMemoryRepository(objectFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func testSha(repo *Repository, data string) string {
+	h := repo.newHash()
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 按名称排好序的条目，sha 根据名称生成，不需要对应的对象存在
+func testIndexEntries(repo *Repository, names ...string) []*IndexEntry {
+	entries := []*IndexEntry{}
+	for i, name := range names {
+		e := &IndexEntry{
+			Ctime: TimePair{1700000000 + int64(i), 123},
+			Mtime: TimePair{1700000100 + int64(i), 456},
+			Inode: 1000 + int64(i),
+			Uid:   501, Gid: 20,
+			Fsize: int64(len(name)),
+			Sha:   testSha(repo, name),
+			Name:  name,
+		}
+		e.SetMode(0o100644)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func encodeTestIndex(t *testing.T, repo *Repository, index *Index) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeIndex(repo, index, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	names := []string{"README", "a/b/c.txt", "a/b/d.txt", "a/e.txt", "z" + strings.Repeat("x", 0x1000)}
+	tests := []struct {
+		name        string
+		format      string
+		version     int
+		modify      func(entries []*IndexEntry)
+		wantVersion int
+	}{
+		{"v2", ObjectFormatSHA1, 2, nil, 2},
+		{"v2 upgraded by extended flags", ObjectFormatSHA1, 2, func(entries []*IndexEntry) {
+			entries[1].SkipWorktree = true
+			entries[2].IntentToAdd = true
+		}, 3},
+		{"v3", ObjectFormatSHA1, 3, nil, 3},
+		{"v4", ObjectFormatSHA1, 4, func(entries []*IndexEntry) {
+			entries[3].IntentToAdd = true
+		}, 4},
+		{"v2 sha256", ObjectFormatSHA256, 2, nil, 2},
+		{"v4 sha256", ObjectFormatSHA256, 4, nil, 4},
+		{"stages", ObjectFormatSHA1, 2, func(entries []*IndexEntry) {
+			entries[1].SetStage(StageOurs)
+			entries[2].FlagAssumValid = true
+			entries[3].SetMode(0o120000)
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t, tt.format)
+			entries := testIndexEntries(repo, names...)
+			if tt.modify != nil {
+				tt.modify(entries)
+			}
+			raw := encodeTestIndex(t, repo, NewIndex(tt.version, entries))
+			if v := binary.BigEndian.Uint32(raw[4:8]); int(v) != tt.wantVersion {
+				t.Errorf("written version = %d, want %d", v, tt.wantVersion)
+			}
+
+			index, err := decodeIndex(repo, raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index.Version != tt.wantVersion {
+				t.Errorf("Version = %d, want %d", index.Version, tt.wantVersion)
+			}
+			if !reflect.DeepEqual(index.Entries, entries) {
+				for i := range entries {
+					if i < len(index.Entries) && !reflect.DeepEqual(index.Entries[i], entries[i]) {
+						t.Errorf("entry %d = %+v, want %+v", i, index.Entries[i], entries[i])
+					}
+				}
+				t.Fatalf("decoded %d entries, want %d", len(index.Entries), len(entries))
+			}
+			if again := encodeTestIndex(t, repo, index); !bytes.Equal(again, raw) {
+				t.Errorf("re-encoding the index gives different bytes")
+			}
+		})
+	}
+}
+
+func TestIndexExtensionsRoundTrip(t *testing.T) {
+	for _, format := range []string{ObjectFormatSHA1, ObjectFormatSHA256} {
+		t.Run(format, func(t *testing.T) {
+			repo := newTestRepo(t, format)
+			index := NewIndex(2, testIndexEntries(repo, "a/b.txt", "a/c/d.txt", "e.txt", "f.txt"))
+			if _, err := Index2Tree(repo, index); err != nil {
+				t.Fatal(err)
+			}
+			// f.txt 的冲突解决之后记录到 resolve undo
+			ours := testIndexEntries(repo, "f.txt")[0]
+			ours.SetStage(StageOurs)
+			theirs := testIndexEntries(repo, "f.txt")[0]
+			theirs.Sha = testSha(repo, "theirs")
+			theirs.SetStage(StageTheirs)
+			index.Remove("f.txt")
+			index.Add(ours)
+			index.Add(theirs)
+			index.Remove("f.txt")
+			index.Add(testIndexEntries(repo, "f.txt")[0])
+			index.extensions = append(index.extensions, &indexExtension{"ZZZZ", []byte("optional data")})
+
+			decoded, err := decodeIndex(repo, encodeTestIndex(t, repo, index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 修改 f.txt 使根目录失效，子目录 a 仍然有效
+			if decoded.Tree.EntryCount != -1 || len(decoded.Tree.Subtrees) != 1 {
+				t.Errorf("Tree = %+v, want an invalidated root with one subtree", decoded.Tree)
+			}
+			var got, want bytes.Buffer
+			decoded.Tree.sub("a").encode(&got, repo.HashSize())
+			index.Tree.sub("a").encode(&want, repo.HashSize())
+			if index.Tree.sub("a").EntryCount != 2 || got.String() != want.String() {
+				t.Errorf("Tree.sub(a) = %q, want %q", got.String(), want.String())
+			}
+			wantUndo := []*ResolveUndo{{
+				Name:  "f.txt",
+				Modes: [3]int{0, 0o100644, 0o100644},
+				Shas:  [3]string{"", ours.Sha, theirs.Sha},
+			}}
+			if !reflect.DeepEqual(decoded.ResolveUndo, wantUndo) {
+				t.Errorf("ResolveUndo = %+v, want %+v", decoded.ResolveUndo, wantUndo)
+			}
+			if !reflect.DeepEqual(decoded.extensions, index.extensions) {
+				t.Errorf("extensions = %+v, want %+v", decoded.extensions, index.extensions)
+			}
+		})
+	}
+}
+
+// 在 raw 的条目之后追加扩展，结尾的 hash 置为全 0（不校验）
+func appendIndexExtension(repo *Repository, raw []byte, sig string, data []byte) []byte {
+	res := append([]byte{}, raw[:len(raw)-repo.HashSize()]...)
+	res = append(res, sig...)
+	res = binary.BigEndian.AppendUint32(res, uint32(len(data)))
+	res = append(res, data...)
+	return append(res, make([]byte, repo.HashSize())...)
+}
+
+func TestIndexStaleExtensionsDropped(t *testing.T) {
+	repo := newTestRepo(t, "")
+	raw := encodeTestIndex(t, repo, NewIndex(2, testIndexEntries(repo, "a")))
+	raw = appendIndexExtension(repo, raw, "UNTR", []byte("untracked cache"))
+	raw = appendIndexExtension(repo, raw, "Xabc", []byte("kept"))
+
+	index, err := decodeIndex(repo, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*indexExtension{{"Xabc", []byte("kept")}}
+	if !reflect.DeepEqual(index.extensions, want) {
+		t.Errorf("extensions = %+v, want %+v", index.extensions, want)
+	}
+}
+
+func TestDecodeIndexMalformed(t *testing.T) {
+	repo := newTestRepo(t, "")
+	hashSize := repo.HashSize()
+	v2 := encodeTestIndex(t, repo, NewIndex(2, testIndexEntries(repo, "a.txt", "b.txt")))
+	v4 := encodeTestIndex(t, repo, NewIndex(4, testIndexEntries(repo, "a.txt", "b.txt")))
+
+	// 修改后把结尾的 hash 置为全 0，跳过校验
+	modify := func(raw []byte, fn func(b []byte)) []byte {
+		b := append([]byte{}, raw...)
+		fn(b)
+		copy(b[len(b)-hashSize:], make([]byte, hashSize))
+		return b
+	}
+	flagsPos := 12 + 40 + hashSize
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"too short", v2[:20], "index file is too short"},
+		{"bad checksum", append(append([]byte{}, v2[:len(v2)-1]...), v2[len(v2)-1]^1), "bad index file checksum"},
+		{"bad signature", modify(v2, func(b []byte) { b[0] = 'X' }), "bad signature"},
+		{"version 1", modify(v2, func(b []byte) { b[7] = 1 }), "unsupported version 1"},
+		{"version 5", modify(v2, func(b []byte) { b[7] = 5 }), "unsupported version 5"},
+		{"too many entries", modify(v2, func(b []byte) { b[11] = 3 }), "entry 2 is truncated"},
+		{"extended flag in v2", modify(v2, func(b []byte) { b[flagsPos] |= 0x40 }), "extended flags in index v2"},
+		{"bad name length", modify(v2, func(b []byte) { b[flagsPos+1] = 3 }), "name length parse fail"},
+		{"v4 bad prefix", modify(v4, func(b []byte) { b[flagsPos+2] = 5 }), "bad path prefix of entry 0"},
+		{"unknown required extension", appendIndexExtension(repo, v2, "link", nil), "does not understand"},
+		{"truncated extension header", append(append(append([]byte{}, v2[:len(v2)-hashSize]...), "ZZZZ"...), make([]byte, hashSize)...),
+			"extension header is truncated"},
+		{"truncated extension", modify(appendIndexExtension(repo, v2, "ZZZZ", []byte("data")), func(b []byte) {
+			binary.BigEndian.PutUint32(b[len(v2)-hashSize+4:], 100)
+		}), "extension ZZZZ is truncated"},
+		{"trailing TREE data", appendIndexExtension(repo, v2, "TREE", []byte("\x00-1 0\nextra")), "bad TREE extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeIndex(repo, tt.raw)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("decodeIndex() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheTree(t *testing.T) {
+	sha := bytes.Repeat([]byte{0xab}, 20)
+	good := "\x002 1\n" + string(sha) + "dir\x001 0\n" + string(sha)
+	tree, rest, err := parseCacheTree([]byte(good), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexSha := strings.Repeat("ab", 20)
+	want := &CacheTree{EntryCount: 2, Sha: hexSha, Subtrees: []*CacheTree{{Name: "dir", EntryCount: 1, Sha: hexSha}}}
+	if len(rest) != 0 || !reflect.DeepEqual(tree, want) {
+		t.Errorf("parseCacheTree() = %+v, %q, want %+v", tree, rest, want)
+	}
+	var buf bytes.Buffer
+	if err := tree.encode(&buf, 20); err != nil || buf.String() != good {
+		t.Errorf("encode() = %q, %v, want %q", buf.String(), err, good)
+	}
+
+	malformed := []string{
+		"",
+		"no null",
+		"\x002 1",                 // 没有换行
+		"\x002\n",                 // 缺少子目录数
+		"\x00x 0\n",               // 条目数不是数字
+		"\x002 -1\n",              // 负的子目录数
+		"\x002 0\n" + "short",     // sha 不完整
+		"\x00-1 2\ndir\x00-1 0\n", // 子目录不够
+	}
+	for _, data := range malformed {
+		if _, _, err := parseCacheTree([]byte(data), 20); !errors.Is(err, ErrCorruptIndex) {
+			t.Errorf("parseCacheTree(%q) error = %v, want ErrCorruptIndex", data, err)
+		}
+	}
+}
+
+func TestParseResolveUndo(t *testing.T) {
+	sha1, sha2 := bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)
+	good := "a\x000\x00100644\x00100755\x00" + string(sha1) + string(sha2) + "b\x00100644\x000\x000\x00" + string(sha1)
+	undo, err := parseResolveUndo([]byte(good), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*ResolveUndo{
+		{Name: "a", Modes: [3]int{0, 0o100644, 0o100755}, Shas: [3]string{"", strings.Repeat("01", 20), strings.Repeat("02", 20)}},
+		{Name: "b", Modes: [3]int{0o100644, 0, 0}, Shas: [3]string{strings.Repeat("01", 20), "", ""}},
+	}
+	if !reflect.DeepEqual(undo, want) {
+		t.Errorf("parseResolveUndo() = %+v, want %+v", undo, want)
+	}
+	if data, err := encodeResolveUndo(undo, 20); err != nil || string(data) != good {
+		t.Errorf("encodeResolveUndo() = %q, %v, want %q", data, err, good)
+	}
+
+	malformed := []string{
+		"a",                                 // 路径没有结尾
+		"a\x00100644\x000\x00",              // mode 不够
+		"a\x00100644\x000\x000",             // mode 没有结尾
+		"a\x00100648\x000\x000\x00",         // 不是八进制
+		"a\x00100644\x000\x000\x00" + "abc", // sha 不完整
+	}
+	for _, data := range malformed {
+		if _, err := parseResolveUndo([]byte(data), 20); !errors.Is(err, ErrCorruptIndex) {
+			t.Errorf("parseResolveUndo(%q) error = %v, want ErrCorruptIndex", data, err)
+		}
+	}
+}
+
+func TestIndex2TreeCachedTree(t *testing.T) {
+	repo := newTestRepo(t, "")
+	index := NewIndex(2, testIndexEntries(repo, "a/b/c.txt", "a/d.txt", "e.txt"))
+	first, err := Index2Tree(repo, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeIndex(repo, encodeTestIndex(t, repo, index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha, err := Index2Tree(repo, decoded); err != nil || sha != first {
+		t.Fatalf("Index2Tree() with a valid cached tree = %s, %v, want %s", sha, err, first)
+	}
+
+	// 不通过 Add/Remove 直接修改条目，cached tree 也要失效
+	decoded.Entries[0].Sha = testSha(repo, "changed")
+	got, err := Index2Tree(repo, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewIndex(2, testIndexEntries(repo, "a/b/c.txt", "a/d.txt", "e.txt"))
+	fresh.Entries[0].Sha = decoded.Entries[0].Sha
+	want, err := Index2Tree(repo, fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want || got == first {
+		t.Errorf("Index2Tree() after an in-place change = %s, want %s", got, want)
+	}
+	if !reflect.DeepEqual(decoded.Tree, fresh.Tree) {
+		t.Errorf("cached tree = %+v, want %+v", decoded.Tree, fresh.Tree)
+	}
+}
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+与 git 相同的 lock 协议：修改文件 <file> 时以 O_EXCL 创建 <file>.lock，把新内容写到 lock 文件中，
+fsync 之后 rename 到 <file>。rename 是原子的，其他进程要么读到旧内容，要么读到完整的新内容；
+lock 文件已经存在说明有其他进程正在修改，直接报错
+*/
+
+const lockSuffix = ".lock"
+
+// 超过这个时间的 lock 文件认为是进程崩溃后残留的，mgit 持有 lock 的时间都很短
+const staleLockAge = 10 * time.Minute
+
+// 获取 lock 失败
+type LockError struct {
+	Path string // lock 文件
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	if !errors.Is(e.Err, os.ErrExist) {
+		return fmt.Sprintf("unable to create '%s': %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("unable to create '%s': File exists.\n\n"+
+		"Another mgit process seems to be running in this repository.\n"+
+		"Please make sure all processes are terminated then try again.\n"+
+		"If it still fails, a mgit process may have crashed in this\n"+
+		"repository earlier: remove the file manually to continue.", e.Path)
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+type LockFile struct {
+	target string
+	f      *os.File
+	done   bool
+}
+
+// 锁定 target，lock 文件已经存在时在 timeout 内重试；超过 staleLockAge 的 lock 文件会被删除
+func AcquireLock(target string, timeout time.Duration) (*LockFile, error) {
+	p := target + lockSuffix
+	deadline := time.Now().Add(timeout)
+	for retry := time.Millisecond; ; retry *= 2 {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return &LockFile{target: target, f: f}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, &LockError{p, err}
+		}
+
+		if stat, serr := os.Stat(p); serr == nil && time.Since(stat.ModTime()) > staleLockAge {
+			fmt.Fprintf(os.Stderr, "warning: removing stale lock file '%s' (last modified %s)\n",
+				p, stat.ModTime().Format(time.RFC3339))
+			if rerr := os.Remove(p); rerr != nil && !os.IsNotExist(rerr) {
+				return nil, &LockError{p, err}
+			}
+			continue
+		}
+		if time.Now().Add(retry).After(deadline) {
+			return nil, &LockError{p, err}
+		}
+		time.Sleep(retry)
+	}
+}
+
+func (l *LockFile) Write(p []byte) (int, error) {
+	return l.f.Write(p)
+}
+
+// fsync 后替换目标文件，释放 lock
+func (l *LockFile) Commit() error {
+	if l.done {
+		return errors.New("lock on " + l.target + " is already released")
+	}
+	l.done = true
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		os.Remove(l.f.Name())
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		os.Remove(l.f.Name())
+		return err
+	}
+	if err := os.Rename(l.f.Name(), l.target); err != nil {
+		os.Remove(l.f.Name())
+		return err
+	}
+	return nil
+}
+
+// 放弃修改并释放 lock，Commit 之后调用没有影响，可以直接 defer
+func (l *LockFile) Rollback() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// 通过 lock 文件整体替换 target
+func writeFileLocked(target string, data []byte, timeout time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	l, err := AcquireLock(target, timeout)
+	if err != nil {
+		return err
+	}
+	defer l.Rollback()
+	if _, err := l.Write(data); err != nil {
+		return err
+	}
+	return l.Commit()
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLockFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // 目标文件原来的内容，为空时不存在
+		commit   bool
+		want     string // 结束后目标文件的内容，为空时不存在
+	}{
+		{"commit new file", "", true, "new"},
+		{"commit existing file", "old", true, "new"},
+		{"rollback new file", "", false, ""},
+		{"rollback existing file", "old", false, "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "file")
+			if tt.existing != "" {
+				writeTestFile(t, target, tt.existing)
+			}
+
+			l, err := AcquireLock(target, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := l.Write([]byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			// 释放之前目标文件保持不变
+			if _, err := os.Stat(target); (err == nil) != (tt.existing != "") {
+				t.Errorf("target changed before the lock is released: %v", err)
+			}
+
+			if tt.commit {
+				if err := l.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				if err := l.Commit(); err == nil {
+					t.Errorf("second Commit() succeeded")
+				}
+			}
+			l.Rollback()
+
+			if _, err := os.Stat(target + lockSuffix); !os.IsNotExist(err) {
+				t.Errorf("lock file still exists: %v", err)
+			}
+			if tt.want == "" {
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Errorf("target exists: %v", err)
+				}
+			} else if got := readTestFile(t, target); got != tt.want {
+				t.Errorf("target = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireLockConflict(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file")
+	l, err := AcquireLock(target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = AcquireLock(target, 50*time.Millisecond)
+	var lockErr *LockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, os.ErrExist) || lockErr.Path != target+lockSuffix {
+		t.Fatalf("AcquireLock() on a locked file error = %v, want LockError with os.ErrExist", err)
+	}
+	if d := time.Since(start); d < 25*time.Millisecond {
+		t.Errorf("AcquireLock() gave up after %v, want retries until the timeout", d)
+	}
+
+	// 在 timeout 内释放时重试成功
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Rollback()
+	}()
+	l2, err := AcquireLock(target, 5*time.Second)
+	if err != nil {
+		t.Fatalf("AcquireLock() after release: %v", err)
+	}
+	l2.Rollback()
+}
+
+func TestAcquireLockStale(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, target+lockSuffix, "left by a crashed process")
+
+	if _, err := AcquireLock(target, 0); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("AcquireLock() with a fresh lock file error = %v, want os.ErrExist", err)
+	}
+
+	old := time.Now().Add(-staleLockAge - time.Minute)
+	if err := os.Chtimes(target+lockSuffix, old, old); err != nil {
+		t.Fatal(err)
+	}
+	l, err := AcquireLock(target, 0)
+	if err != nil {
+		t.Fatalf("AcquireLock() with a stale lock file: %v", err)
+	}
+	l.Write([]byte("new"))
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, target); got != "new" {
+		t.Errorf("target = %q, want %q", got, "new")
+	}
+}
+
+func TestAcquireLockMissingDir(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "no", "such", "file")
+	_, err := AcquireLock(target, 0)
+	var lockErr *LockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("AcquireLock() error = %v, want LockError with os.ErrNotExist", err)
+	}
+}
+
+func TestWriteFileLocked(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "sub", "dir", "file")
+	if err := writeFileLocked(target, []byte("one"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileLocked(target, []byte("two"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, target); got != "two" {
+		t.Errorf("target = %q, want %q", got, "two")
+	}
+
+	l, err := AcquireLock(target, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Rollback()
+	if err := writeFileLocked(target, []byte("three"), 0); !errors.Is(err, os.ErrExist) {
+		t.Errorf("writeFileLocked() on a locked file error = %v, want os.ErrExist", err)
+	}
+	if got := readTestFile(t, target); got != "two" {
+		t.Errorf("target = %q, want %q", got, "two")
+	}
+}
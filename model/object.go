@@ -1,151 +1,121 @@
 package model
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
-
-	"github.com/ignorantshr/mgit/util"
 )
 
-var HashRegx = regexp.MustCompile("^[0-9A-Fa-f]{4,40}$")
+// sha1 为 40 个字符，sha256 为 64 个字符
+var HashRegx = regexp.MustCompile("^[0-9A-Fa-f]{4,64}$")
 
 type Object interface {
 	Format() string
-	Serialize(repo *Repository) []byte
-	Deserialize(data []byte)
+	Serialize(repo *Repository) ([]byte, error)
+	Deserialize(data []byte) error
 }
 
-func ReadObject(repo *Repository, sha string) Object {
-	if sha == "" {
-		return nil
-	}
-	path, err := repo.RepoFile(false, "objects", sha[:2], sha[2:])
-	if err != nil {
-		util.PanicErr(err)
-	}
-
-	if !util.IsFile(path) {
-		util.PanicErr(_readObjectErr(nil, "file is not found"))
-	}
-
-	raw, err := os.ReadFile(path)
-	if err != nil {
-		util.PanicErr(err)
-	}
-
-	// Read object type
-	i := bytes.IndexByte(raw, ' ')
-	if i == -1 {
-		util.PanicErr(err)
-	}
-	format := string(raw[:i])
-
-	raw = raw[i+1:]
-	// Read object size
-	i = bytes.IndexByte(raw, '\x00') // null byte
-	if i == -1 {
-		util.PanicErr(_readObjectErr(err, "format is not correct"))
-	}
-
-	size, err := strconv.Atoi(string(raw[:i]))
+// 对象不存在时返回 ErrObjectNotFound，无法解析时返回 ErrCorruptObject
+func ReadObject(repo *Repository, sha string) (Object, error) {
+	format, raw, err := repo.Objects().Read(sha)
 	if err != nil {
-		util.PanicErr(err)
+		return nil, err
 	}
-	if size != len(raw)-i-1 {
-		util.PanicErr(_readObjectErr(err, "size is not correct"))
-	}
-
-	raw = raw[i+1:]
 
 	var obj Object
 	switch format {
 	case "commit":
 		obj = NewCommitObj()
 	case "tree":
-		obj = NewTreeObj()
+		tree := NewTreeObj()
+		tree.hashSize = repo.HashSize()
+		obj = tree
 	case "tag":
 		obj = NewTagObj()
 	case "blob":
 		obj = NewBlobObj()
 	default:
-		util.PanicErr(_readObjectErr(nil, "unknown format "+format))
+		return nil, corruptObjectErr(sha, nil, "unknown format "+format)
 	}
 
-	obj.Deserialize(raw)
-	return obj
+	if err := obj.Deserialize(raw); err != nil {
+		return nil, corruptObjectErr(sha, err, "bad "+format)
+	}
+	return obj, nil
 }
 
-func WriteObject(repo *Repository, obj Object) string {
-	payload := obj.Serialize(repo)
+// 按照 repo 的对象格式计算 sha，不写入对象库；repo 为 nil 时使用 SHA-1
+func HashObject(repo *Repository, obj Object) (string, error) {
+	payload, err := obj.Serialize(repo)
+	if err != nil {
+		return "", err
+	}
+	return payloadSha(repo, obj.Format(), payload), nil
+}
 
-	result := append([]byte(obj.Format()), ' ')
-	result = strconv.AppendInt(result, int64(len(payload)), 10)
-	result = append(result, '\x00')
-	result = append(result, payload...)
+func payloadSha(repo *Repository, format string, payload []byte) string {
+	h := repo.newHash()
+	h.Write(objectHeader(format, len(payload)))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	rawsha := sha1.Sum(result)
-	sha := hex.EncodeToString(rawsha[:])
+func WriteObject(repo *Repository, obj Object) (string, error) {
+	payload, err := obj.Serialize(repo)
+	if err != nil {
+		return "", err
+	}
 
+	sha := payloadSha(repo, obj.Format(), payload)
 	if repo != nil {
-		p, err := repo.RepoFile(true, "objects", string(sha[:2]), string(sha[2:]))
-		if err != nil {
-			util.PanicErr(err)
-		}
-		if !util.IsFileExist(p) {
-			f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				util.PanicErr(err)
-			}
-			defer f.Close()
-
-			_, err = f.Write(result)
-			if err != nil {
-				util.PanicErr(err)
+		store := repo.Objects()
+		if !store.Has(sha) {
+			if err := store.Write(sha, obj.Format(), payload); err != nil {
+				return "", err
 			}
 		}
 	}
 
-	return sha[:]
-}
-
-func _readObjectErr(err error, reason string) error {
-	return errors.Join(err, fmt.Errorf("%s: %s", ERROR_READ_OBJECT, reason))
+	return sha, nil
 }
 
 // If name is HEAD, it will just resolve .git/HEAD;
 // If name is a full hash, this hash is returned unmodified.
 // If name looks like a short hash, it will collect objects whose full hash begin with this short hash.
 // At last, it will resolve tags and branches matching name.
-func FindObject(repo *Repository, name, format string, follow bool) string {
-	shas := resolveObject(repo, name)
+//
+// 没有匹配时返回 ErrObjectNotFound，匹配到多个时返回 *AmbiguousRefError；
+// 指定了 format 但对象（follow 时为解引用之后的对象）不是该类型时也返回 ErrObjectNotFound
+func FindObject(repo *Repository, name, format string, follow bool) (string, error) {
+	shas, err := resolveObject(repo, name)
+	if err != nil {
+		return "", err
+	}
 	if len(shas) == 0 {
-		return ""
+		return "", fmt.Errorf("%w: %s", ErrObjectNotFound, name)
 	}
 	if len(shas) > 1 {
-		util.PanicErr(fmt.Errorf("Ambiguous reference %s: Candidates are:\n - %v", name, strings.Join(shas, "\b - ")))
-		return ""
+		return "", &AmbiguousRefError{Name: name, Candidates: shas}
 	}
 
 	sha := shas[0]
 	if format == "" {
-		return sha
+		return sha, nil
 	}
 
 	for {
-		obj := ReadObject(repo, sha)
+		obj, err := ReadObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
 		if obj.Format() == format {
-			return sha
+			return sha, nil
 		}
 
+		notFound := fmt.Errorf("%w: %s is a %s, not a %s", ErrObjectNotFound, name, obj.Format(), format)
 		if !follow {
-			return ""
+			return "", notFound
 		}
 
 		if obj.Format() == "tag" {
@@ -153,7 +123,7 @@ func FindObject(repo *Repository, name, format string, follow bool) string {
 		} else if obj.Format() == "commit" && format == "tree" {
 			sha = obj.(*CommitObj).Tree
 		} else {
-			return ""
+			return "", notFound
 		}
 	}
 }
@@ -169,49 +139,42 @@ This function is aware of:
   - branches
   - remote branches
 */
-func resolveObject(repo *Repository, name string) []string {
+func resolveObject(repo *Repository, name string) ([]string, error) {
 	candidates := make([]string, 0)
 	name = strings.TrimSpace(name)
 
 	if name == "" {
-		return nil
+		return nil, nil
 	}
 
 	if name == "HEAD" {
-		sha := GetRefSha(repo, "HEAD")
+		sha, err := GetRefSha(repo, "HEAD")
+		if err != nil {
+			return nil, err
+		}
 		if sha != "" {
 			candidates = append(candidates, sha)
 		}
-		return candidates
+		return candidates, nil
 	}
 
 	if HashRegx.Match([]byte(name)) {
-		name = strings.ToLower(name)
-		prefix := name[:2]
-		p, err := repo.repoDir(false, "objects", prefix)
-		util.PanicErr(err)
-
-		if p != "" {
-			rem := name[2:]
-			entries, err := os.ReadDir(p)
-			util.PanicErr(err)
-			for _, f := range entries {
-				if strings.HasPrefix(f.Name(), rem) {
-					candidates = append(candidates, prefix+f.Name())
-				}
-			}
+		shas, err := repo.Objects().ResolvePrefix(strings.ToLower(name))
+		if err != nil {
+			return nil, err
 		}
+		candidates = append(candidates, shas...)
 	}
 
-	asTag := GetRefSha(repo, "refs/tags/"+name)
-	if asTag != "" {
-		candidates = append(candidates, asTag)
-	}
-
-	asBranch := GetRefSha(repo, "refs/heads/"+name)
-	if asBranch != "" {
-		candidates = append(candidates, asBranch)
+	for _, ref := range []string{"refs/tags/" + name, "refs/heads/" + name} {
+		sha, err := GetRefSha(repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		if sha != "" {
+			candidates = append(candidates, sha)
+		}
 	}
 
-	return candidates
+	return candidates, nil
 }
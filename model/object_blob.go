@@ -14,10 +14,11 @@ func (b *BlobObj) Format() string {
 	return b.fmt
 }
 
-func (b *BlobObj) Serialize(_ *Repository) []byte {
-	return b.data
+func (b *BlobObj) Serialize(_ *Repository) ([]byte, error) {
+	return b.data, nil
 }
 
-func (b *BlobObj) Deserialize(data []byte) {
+func (b *BlobObj) Deserialize(data []byte) error {
 	b.data = data
+	return nil
 }
@@ -25,12 +25,12 @@ func (c *CommitObj) Format() string {
 	return c.fmt
 }
 
-func (c *CommitObj) Serialize(_ *Repository) []byte {
-	return c.kvlm.serialize()
+func (c *CommitObj) Serialize(_ *Repository) ([]byte, error) {
+	return c.kvlm.serialize(), nil
 }
 
-func (c *CommitObj) Deserialize(data []byte) {
-	c.kvlm.parse(data)
+func (c *CommitObj) Deserialize(data []byte) error {
+	return c.kvlm.parse(data)
 }
 
 func CreateCommit(repo *Repository, tree, parent, author, msg string, ts time.Time) *CommitObj {
@@ -38,15 +38,7 @@ func CreateCommit(repo *Repository, tree, parent, author, msg string, ts time.Ti
 	c.Tree = tree
 	c.Parent = parent
 
-	_, offset := ts.Zone()
-	hours := offset / 3600
-	minutes := (offset % 3600) / 60
-	sign := ""
-	if offset >= 0 {
-		sign = "+"
-	}
-	tz := fmt.Sprintf("%s%02d%02d", sign, hours, minutes)
-	author += " " + strconv.FormatInt(ts.Unix(), 10) + " " + tz
+	author = Ident(author, ts)
 	c.Commiter = author
 	c.Author = author
 	c.Message = msg
@@ -54,6 +46,39 @@ func CreateCommit(repo *Repository, tree, parent, author, msg string, ts time.Ti
 	return c
 }
 
+// 在 "name <email>" 后加上时间戳和时区，作为 author、committer、tagger 的值
+func Ident(who string, ts time.Time) string {
+	_, offset := ts.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	tz := fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60)
+	return who + " " + strconv.FormatInt(ts.Unix(), 10) + " " + tz
+}
+
+// 解析 Ident 的结果，得到 "name <email>" 和带时区的时间
+func ParseIdent(ident string) (who string, ts time.Time, err error) {
+	gt := strings.LastIndexByte(ident, '>')
+	if gt == -1 {
+		return "", time.Time{}, fmt.Errorf("malformed ident %q", ident)
+	}
+	fields := strings.Fields(ident[gt+1:])
+	if len(fields) != 2 || len(fields[1]) != 5 || (fields[1][0] != '+' && fields[1][0] != '-') {
+		return "", time.Time{}, fmt.Errorf("malformed ident %q", ident)
+	}
+	sec, err1 := strconv.ParseInt(fields[0], 10, 64)
+	tz, err2 := strconv.Atoi(fields[1][1:])
+	if err1 != nil || err2 != nil {
+		return "", time.Time{}, fmt.Errorf("malformed ident %q", ident)
+	}
+	offset := tz/100*3600 + tz%100*60
+	if fields[1][0] == '-' {
+		offset = -offset
+	}
+	return ident[:gt+1], time.Unix(sec, 0).In(time.FixedZone("", offset)), nil
+}
+
 // “Key-Value List with Message” for commit and tag files
 type kvlm struct {
 	// common
@@ -71,13 +96,14 @@ type kvlm struct {
 	Type   string
 	Tag    string
 	Tagger string
-}
 
-func (k *kvlm) parse(raw []byte) {
-	if k == nil {
-		*k = kvlm{}
-	}
+	// 其他不认识的头部（例如 encoding、mergetag）
+	extra [][2]string
+	// 解析时各个头部出现的顺序，重新序列化时按原顺序输出，保证 hash 不变
+	order []string
+}
 
+func (k *kvlm) parse(raw []byte) error {
 	for {
 		spaceidx := bytes.IndexByte(raw, ' ')
 		nlidx := bytes.IndexByte(raw, '\n')
@@ -85,18 +111,27 @@ func (k *kvlm) parse(raw []byte) {
 		// A blank line means the remainder of the data is the message.
 		if nlidx == 0 {
 			k.Message = string(raw[nlidx+1:])
-			return
+			return nil
+		}
+		if nlidx == -1 || spaceidx == -1 || spaceidx > nlidx {
+			return fmt.Errorf("malformed header line")
 		}
 
 		key := string(raw[:spaceidx])
 		end := spaceidx + 1
 		for { // 值跨行时每行前面有一个空格
-			end += bytes.IndexByte(raw[end:], '\n')
-			if raw[end+1] != ' ' {
+			nl := bytes.IndexByte(raw[end:], '\n')
+			if nl == -1 {
+				return fmt.Errorf("missing blank line before message")
+			}
+			end += nl
+			if end+1 >= len(raw) || raw[end+1] != ' ' {
 				break
 			}
+			end++
 		}
 		value := strings.ReplaceAll(string(raw[spaceidx+1:end]), "\n ", "\n")
+		k.order = append(k.order, key)
 		switch key {
 		case "tree":
 			k.Tree = value
@@ -104,16 +139,29 @@ func (k *kvlm) parse(raw []byte) {
 			k.Parent += value + "\n"
 		case "author":
 			k.Author = value
-		case "commiter":
+		case "committer", "commiter": // 早期的 mgit 写的是 commiter
 			k.Commiter = value
 		case "gpgsig":
 			k.Gpgsign = value
+		case "object":
+			k.Object = value
+		case "type":
+			k.Type = value
+		case "tag":
+			k.Tag = value
+		case "tagger":
+			k.Tagger = value
+		default:
+			k.extra = append(k.extra, [2]string{key, value})
 		}
 
 		raw = raw[end+1:]
 	}
 }
 
+// 新建的对象按照 git 的顺序输出头部：
+// commit 为 tree、parent...、author、committer，tag 为 object、type、tag、tagger；
+// 解析得到的对象按原来的顺序输出
 func (k *kvlm) serialize() []byte {
 	res := bytes.Buffer{}
 
@@ -126,12 +174,62 @@ func (k *kvlm) serialize() []byte {
 		res.WriteByte('\n')
 	}
 
-	write("tree", k.Tree)
-	write("author", k.Author)
-	write("parent", k.Parent)
-	write("commiter", k.Commiter)
-	write("gpgsig", k.Gpgsign)
+	parents := k.Parents()
+	fields := map[string]*string{
+		"tree": &k.Tree, "author": &k.Author, "committer": &k.Commiter, "gpgsig": &k.Gpgsign,
+		"object": &k.Object, "type": &k.Type, "tag": &k.Tag, "tagger": &k.Tagger,
+	}
+	written := map[string]bool{}
+	nextParent, nextExtra := 0, 0
+	var writeKey func(key string)
+	writeKey = func(key string) {
+		switch {
+		case key == "parent":
+			if nextParent < len(parents) {
+				write(key, parents[nextParent])
+				nextParent++
+			}
+		case key == "commiter":
+			writeKey("committer")
+		case fields[key] != nil:
+			if !written[key] {
+				write(key, *fields[key])
+				written[key] = true
+			}
+		default:
+			if nextExtra < len(k.extra) {
+				write(k.extra[nextExtra][0], k.extra[nextExtra][1])
+				nextExtra++
+			}
+		}
+	}
+
+	for _, key := range k.order {
+		writeKey(key)
+	}
+	// 新建的对象，或者解析后新设置的头部
+	for _, key := range []string{"tree", "parent", "author", "committer", "object", "type", "tag", "tagger"} {
+		writeKey(key)
+		for key == "parent" && nextParent < len(parents) {
+			writeKey(key)
+		}
+	}
+	for nextExtra < len(k.extra) {
+		writeKey("")
+	}
+	writeKey("gpgsig")
 	res.WriteByte('\n')
 	res.WriteString(k.Message)
 	return res.Bytes()
 }
+
+// Parent 中以换行分隔的各个父提交
+func (k *kvlm) Parents() []string {
+	res := []string{}
+	for _, p := range strings.Split(k.Parent, "\n") {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
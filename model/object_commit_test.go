@@ -0,0 +1,104 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdent(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	tests := []struct {
+		offset int // 秒
+		want   string
+	}{
+		{0, "+0000"},
+		{8 * 3600, "+0800"},
+		{5*3600 + 30*60, "+0530"},
+		{-5 * 3600, "-0500"},
+		{-(3*3600 + 30*60), "-0330"},
+		{-30 * 60, "-0030"},
+	}
+	for _, tt := range tests {
+		got := Ident("A U Thor <a@example.com>", ts.In(time.FixedZone("", tt.offset)))
+		if want := "A U Thor <a@example.com> 1700000000 " + tt.want; got != want {
+			t.Errorf("Ident() with offset %d = %q, want %q", tt.offset, got, want)
+		}
+	}
+}
+
+func TestParseIdent(t *testing.T) {
+	who, ts, err := ParseIdent("A U Thor <a@example.com> 1700000000 -0330")
+	if err != nil || who != "A U Thor <a@example.com>" || ts.Unix() != 1700000000 {
+		t.Fatalf("ParseIdent() = %q, %v, %v", who, ts, err)
+	}
+	if _, offset := ts.Zone(); offset != -(3*3600 + 30*60) {
+		t.Errorf("ParseIdent() offset = %d", offset)
+	}
+	if got := Ident(who, ts); got != "A U Thor <a@example.com> 1700000000 -0330" {
+		t.Errorf("Ident(ParseIdent()) = %q", got)
+	}
+
+	for _, ident := range []string{"", "A", "A <a@example.com>", "A <a@example.com> 1700000000", "A <a@example.com> x +0000", "A <a@example.com> 1700000000 0800"} {
+		if _, _, err := ParseIdent(ident); err == nil {
+			t.Errorf("ParseIdent(%q) should fail", ident)
+		}
+	}
+}
+
+func TestKvlmRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  Object
+		raw  string
+	}{
+		{"commit", NewCommitObj(), "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+			"parent 1111111111111111111111111111111111111111\n" +
+			"author A <a@example.com> 1700000000 -0500\n" +
+			"committer C <c@example.com> 1700000001 +0530\n" +
+			"\nmessage\n"},
+		{"merge", NewCommitObj(), "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+			"parent 1111111111111111111111111111111111111111\n" +
+			"parent 2222222222222222222222222222222222222222\n" +
+			"author A <a@example.com> 1700000000 +0000\n" +
+			"committer A <a@example.com> 1700000000 +0000\n" +
+			"mergetag object 3333333333333333333333333333333333333333\n type commit\n tag v1\n\n message\n" +
+			"\nmerge\n"},
+		// encoding 在 gpgsig 之后，不能按默认顺序重排
+		{"signed", NewCommitObj(), "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+			"author A <a@example.com> 1700000000 +0000\n" +
+			"committer A <a@example.com> 1700000000 +0000\n" +
+			"gpgsig -----BEGIN PGP SIGNATURE-----\n \n abc\n -----END PGP SIGNATURE-----\n" +
+			"encoding ISO-8859-1\n" +
+			"\nsigned\n"},
+		{"tag", NewTagObj(), "object 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+			"type tree\n" +
+			"tag v1\n" +
+			"tagger T <t@example.com> 1700000000 -0800\n" +
+			"\nmessage\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.obj.Deserialize([]byte(tt.raw)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.obj.Serialize(nil)
+			if err != nil || string(got) != tt.raw {
+				t.Errorf("Serialize() = %q, %v, want %q", got, err, tt.raw)
+			}
+		})
+	}
+}
+
+func TestCreateCommit(t *testing.T) {
+	ts := time.Unix(1700000000, 0).In(time.FixedZone("", -(3*3600 + 30*60)))
+	c := CreateCommit(nil, "4b825dc642cb6eb9a060e54bf8d69288fbee4904", "1111111111111111111111111111111111111111",
+		"A <a@example.com>", "msg\n", ts)
+	want := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"parent 1111111111111111111111111111111111111111\n" +
+		"author A <a@example.com> 1700000000 -0330\n" +
+		"committer A <a@example.com> 1700000000 -0330\n" +
+		"\nmsg\n"
+	if got, err := c.Serialize(nil); err != nil || string(got) != want {
+		t.Errorf("Serialize() = %q, %v, want %q", got, err, want)
+	}
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ignorantshr/mgit/util"
+)
+
+// objects/xx/yyyy 形式存放的对象，每个文件都经过 zlib 压缩
+type LooseStore struct {
+	dir string
+}
+
+func NewLooseStore(dir string) *LooseStore {
+	return &LooseStore{dir}
+}
+
+func (l *LooseStore) path(sha string) string {
+	return path.Join(l.dir, sha[:2], sha[2:])
+}
+
+func (l *LooseStore) Has(sha string) bool {
+	return len(sha) > 2 && util.IsFile(l.path(sha))
+}
+
+func (l *LooseStore) Read(sha string) (string, []byte, error) {
+	if !l.Has(sha) {
+		return "", nil, objectNotFoundErr(sha)
+	}
+	format, data, err := readLooseObject(l.path(sha))
+	if err != nil {
+		return "", nil, corruptObjectErr(sha, err, "bad loose object")
+	}
+	return format, data, nil
+}
+
+func (l *LooseStore) Write(sha, format string, data []byte) error {
+	p := l.path(sha)
+	if util.IsFileExist(p) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// 先写到临时文件再重命名，崩溃时不会留下不完整的对象
+	f, err := os.CreateTemp(path.Dir(p), "tmp_obj_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// loose objects are deflated just like git does
+	zw := zlib.NewWriter(f)
+	if _, err := zw.Write(objectHeader(format, len(data))); err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0444); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (l *LooseStore) Iterate(fn func(sha string)) error {
+	shas, err := l.list()
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		fn(sha)
+	}
+	return nil
+}
+
+func (l *LooseStore) ResolvePrefix(prefix string) ([]string, error) {
+	res := []string{}
+	if len(prefix) < 2 {
+		return res, nil
+	}
+	entries, err := os.ReadDir(path.Join(l.dir, prefix[:2]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, f := range entries {
+		if strings.HasPrefix(f.Name(), prefix[2:]) {
+			res = append(res, prefix[:2]+f.Name())
+		}
+	}
+	return res, nil
+}
+
+// 列出所有的 loose object
+func (l *LooseStore) list() ([]string, error) {
+	res := []string{}
+	dirs, err := os.ReadDir(l.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() || !isHexName(d.Name(), 2) {
+			continue
+		}
+		files, err := os.ReadDir(path.Join(l.dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if isHexName(f.Name(), 0) {
+				res = append(res, d.Name()+f.Name())
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (l *LooseStore) remove(sha string) error {
+	p := l.path(sha)
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	// 目录为空时一并删除
+	if dir := path.Dir(p); util.IsDirEmpty(dir) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// "<format> <size>\x00"
+func objectHeader(format string, size int) []byte {
+	res := append([]byte(format), ' ')
+	res = strconv.AppendInt(res, int64(size), 10)
+	return append(res, '\x00')
+}
+
+func readLooseObject(path string) (string, []byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	raw, err = inflateLoose(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("decompress failed: %w", err)
+	}
+
+	// Read object type
+	i := bytes.IndexByte(raw, ' ')
+	if i == -1 {
+		return "", nil, fmt.Errorf("format is not correct")
+	}
+	format := string(raw[:i])
+
+	raw = raw[i+1:]
+	// Read object size
+	i = bytes.IndexByte(raw, '\x00') // null byte
+	if i == -1 {
+		return "", nil, fmt.Errorf("format is not correct")
+	}
+
+	size, err := strconv.Atoi(string(raw[:i]))
+	if err != nil {
+		return "", nil, fmt.Errorf("bad object size: %w", err)
+	}
+	if size != len(raw)-i-1 {
+		return "", nil, fmt.Errorf("size is not correct")
+	}
+
+	return format, raw[i+1:], nil
+}
+
+// 解压 loose object。
+// 早期的 mgit 直接存储未压缩的内容（以 "blob " 之类的类型名开头），
+// 这种情况下原样返回，因此旧仓库仍然可以读取。
+func inflateLoose(raw []byte) ([]byte, error) {
+	if !isZlibHeader(raw) {
+		return raw, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// zlib header: CM(low 4 bits of CMF) must be 8 (deflate) and CMF*256+FLG must be a multiple of 31.
+// None of the object type names ("blob", "tree", "commit", "tag") can satisfy this.
+func isZlibHeader(raw []byte) bool {
+	if len(raw) < 2 {
+		return false
+	}
+	return raw[0]&0x0f == 8 && (uint16(raw[0])<<8|uint16(raw[1]))%31 == 0
+}
+
+// size 为 0 时不限制长度
+func isHexName(name string, size int) bool {
+	if size != 0 && len(name) != size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && name != ""
+}
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// 对象数据库的抽象。sha 均为小写十六进制字符串，format 为 blob、tree、commit 或 tag，
+// data 是不带 "<format> <size>\x00" 头部的对象内容。
+// 计算 sha 是调用方（WriteObject）的责任，store 只负责存取。
+type ObjectStore interface {
+	Has(sha string) bool
+	// 对象不存在时返回 ErrObjectNotFound
+	Read(sha string) (format string, data []byte, err error)
+	Write(sha, format string, data []byte) error
+	// 遍历所有对象，顺序不确定
+	Iterate(fn func(sha string)) error
+	// 返回所有以 prefix 开头的 sha
+	ResolvePrefix(prefix string) ([]string, error)
+}
+
+// 按顺序组合多个 store：读取时依次查找，写入时写到第一个 store
+type MultiStore struct {
+	stores []ObjectStore
+}
+
+func NewMultiStore(stores ...ObjectStore) *MultiStore {
+	return &MultiStore{stores}
+}
+
+func (m *MultiStore) Has(sha string) bool {
+	for _, s := range m.stores {
+		if s.Has(sha) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MultiStore) Read(sha string) (string, []byte, error) {
+	for _, s := range m.stores {
+		format, data, err := s.Read(sha)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		return format, data, err
+	}
+	return "", nil, objectNotFoundErr(sha)
+}
+
+func (m *MultiStore) readDeltaBase(sha string, depth int) (string, []byte, error) {
+	for _, s := range m.stores {
+		format, data, err := readDeltaBase(s, sha, depth)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		return format, data, err
+	}
+	return "", nil, objectNotFoundErr(sha)
+}
+
+func (m *MultiStore) Write(sha, format string, data []byte) error {
+	return m.stores[0].Write(sha, format, data)
+}
+
+// 同一个对象可能同时存在于多个 store 中，只回调一次
+func (m *MultiStore) Iterate(fn func(sha string)) error {
+	seen := make(map[string]struct{})
+	for _, s := range m.stores {
+		err := s.Iterate(func(sha string) {
+			if _, ok := seen[sha]; !ok {
+				seen[sha] = struct{}{}
+				fn(sha)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiStore) ResolvePrefix(prefix string) ([]string, error) {
+	seen := make(map[string]struct{})
+	res := []string{}
+	for _, s := range m.stores {
+		shas, err := s.ResolvePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, sha := range shas {
+			if _, ok := seen[sha]; !ok {
+				seen[sha] = struct{}{}
+				res = append(res, sha)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 纯内存的对象数据库，便于嵌入到服务中或者在测试中使用
+type MemoryStore struct {
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	format string
+	data   []byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{make(map[string]memoryObject)}
+}
+
+func (m *MemoryStore) Has(sha string) bool {
+	_, ok := m.objects[sha]
+	return ok
+}
+
+func (m *MemoryStore) Read(sha string) (string, []byte, error) {
+	obj, ok := m.objects[sha]
+	if !ok {
+		return "", nil, objectNotFoundErr(sha)
+	}
+	return obj.format, obj.data, nil
+}
+
+func (m *MemoryStore) Write(sha, format string, data []byte) error {
+	m.objects[sha] = memoryObject{format, append([]byte{}, data...)}
+	return nil
+}
+
+func (m *MemoryStore) Iterate(fn func(sha string)) error {
+	for sha := range m.objects {
+		fn(sha)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ResolvePrefix(prefix string) ([]string, error) {
+	res := []string{}
+	for sha := range m.objects {
+		if strings.HasPrefix(sha, prefix) {
+			res = append(res, sha)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 仓库的对象数据库，默认为 objects/ 目录下的 loose object 和 packfile，
+// 之后是 objects/info/alternates 中各个目录的 loose object 和 packfile。
+// 新对象总是写入本仓库的 loose object。
+// alternates 无法读取时，只使用本仓库的对象，错误可以通过 Alternates 获取
+func (r *Repository) Objects() ObjectStore {
+	if r.objects == nil {
+		dir := r.repoPath("objects")
+		r.loose = NewLooseStore(dir)
+		r.pack = NewPackStore(dir, r.HashSize())
+		stores := []ObjectStore{r.loose, r.pack}
+		packs := []*PackStore{r.pack}
+		alternates, _ := readAlternates(dir)
+		for _, alt := range alternates {
+			p := NewPackStore(alt, r.HashSize())
+			stores = append(stores, NewLooseStore(alt), p)
+			packs = append(packs, p)
+		}
+		r.objects = NewMultiStore(stores...)
+		// REF_DELTA 的 base 可能在其他 pack 或者是 loose object
+		for _, p := range packs {
+			p.external = r.objects
+		}
+	}
+	return r.objects
+}
+
+// 替换仓库的对象数据库，例如使用 MemoryStore
+func (r *Repository) SetObjectStore(store ObjectStore) {
+	r.objects = store
+	r.loose = nil
+	r.pack = nil
+}
+
+// 只有对象数据库、不落盘的仓库，没有 worktree、refs 和 index
+func NewMemoryRepository(objectFormat string) (*Repository, error) {
+	if objectFormat == "" {
+		objectFormat = ObjectFormatSHA1
+	}
+	if err := checkObjectFormat(objectFormat); err != nil {
+		return nil, err
+	}
+	r := &Repository{objectFormat: objectFormat}
+	r.SetObjectStore(NewMemoryStore())
+	return r, nil
+}
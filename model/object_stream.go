@@ -0,0 +1,273 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ignorantshr/mgit/util"
+)
+
+/*
+大文件的流式读写。
+
+超过 core.bigFileThreshold 的对象不会被完整地读入内存：
+写入时一边计算 hash 一边压缩到临时文件，最后再重命名为 objects/xx/yyyy；
+读取时返回一个 io.ReadCloser，边解压边读。
+*/
+
+const defaultBigFileThreshold = 512 << 20 // 与 git 的默认值相同
+
+// 支持流式读取的 store
+type StreamReader interface {
+	// 对象不存在时返回 ErrObjectNotFound；调用方负责关闭返回的 reader
+	OpenStream(sha string) (format string, size int64, r io.ReadCloser, err error)
+}
+
+// 支持流式写入的 store，sha 在写入的同时计算
+type StreamWriter interface {
+	WriteStream(format string, size int64, r io.Reader, h hash.Hash) (string, error)
+}
+
+// 以流的方式打开对象
+func OpenObjectStream(repo *Repository, sha string) (string, int64, io.ReadCloser, error) {
+	return openStream(repo.Objects(), sha)
+}
+
+func openStream(store ObjectStore, sha string) (string, int64, io.ReadCloser, error) {
+	if s, ok := store.(StreamReader); ok {
+		return s.OpenStream(sha)
+	}
+	format, data, err := store.Read(sha)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return format, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// 从 r 中读取 size 字节作为对象内容，按照 repo 的对象格式计算 sha，不写入对象库
+func HashObjectStream(repo *Repository, format string, size int64, r io.Reader) (string, error) {
+	h := repo.newHash()
+	h.Write(objectHeader(format, int(size)))
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("object size mismatch: expected %d, read %d", size, n)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 从 r 中读取 size 字节作为对象内容，计算 sha 并写入 repo（repo 为 nil 时只计算 sha）
+func WriteObjectStream(repo *Repository, format string, size int64, r io.Reader) (string, error) {
+	if repo == nil {
+		return HashObjectStream(repo, format, size, r)
+	}
+
+	store := repo.Objects()
+	if s, ok := store.(StreamWriter); ok {
+		return s.WriteStream(format, size, r, repo.newHash())
+	}
+
+	// store 不支持流式写入，只能读入内存
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) != size {
+		return "", fmt.Errorf("object size mismatch: expected %d, read %d", size, len(data))
+	}
+	h := repo.newHash()
+	h.Write(objectHeader(format, len(data)))
+	h.Write(data)
+	sha := hex.EncodeToString(h.Sum(nil))
+	if !store.Has(sha) {
+		if err := store.Write(sha, format, data); err != nil {
+			return "", err
+		}
+	}
+	return sha, nil
+}
+
+// 超过该大小的对象使用流式读写，可通过 core.bigFileThreshold 配置，支持 k/m/g 后缀
+func (r *Repository) BigFileThreshold() (int64, error) {
+	return r.Config().GetInt("core.bigfilethreshold", defaultBigFileThreshold)
+}
+
+func (m *MultiStore) OpenStream(sha string) (string, int64, io.ReadCloser, error) {
+	for _, s := range m.stores {
+		format, size, r, err := openStream(s, sha)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		return format, size, r, err
+	}
+	return "", 0, nil, objectNotFoundErr(sha)
+}
+
+func (m *MultiStore) WriteStream(format string, size int64, r io.Reader, h hash.Hash) (string, error) {
+	s, ok := m.stores[0].(StreamWriter)
+	if !ok {
+		return "", fmt.Errorf("object store does not support streaming writes")
+	}
+	return s.WriteStream(format, size, r, h)
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (l *LooseStore) OpenStream(sha string) (string, int64, io.ReadCloser, error) {
+	if !l.Has(sha) {
+		return "", 0, nil, objectNotFoundErr(sha)
+	}
+	f, err := os.Open(l.path(sha))
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	var zr *bufio.Reader
+	closers := []io.Closer{f}
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(2)
+	if isZlibHeader(head) {
+		z, err := zlib.NewReader(br)
+		if err != nil {
+			f.Close()
+			return "", 0, nil, corruptObjectErr(sha, err, "decompress failed")
+		}
+		zr = bufio.NewReader(z)
+		closers = append([]io.Closer{z}, closers...)
+	} else {
+		zr = br // 未压缩的旧格式
+	}
+
+	header, err := zr.ReadString('\x00')
+	if err != nil {
+		f.Close()
+		return "", 0, nil, corruptObjectErr(sha, err, "format is not correct")
+	}
+	format, sizeStr, ok := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if !ok || err != nil {
+		f.Close()
+		return "", 0, nil, corruptObjectErr(sha, err, "format is not correct")
+	}
+
+	return format, size, &readCloser{io.LimitReader(zr, size), closers}, nil
+}
+
+// 先写到临时文件，算出 sha 之后再重命名
+func (l *LooseStore) WriteStream(format string, size int64, r io.Reader, h hash.Hash) (string, error) {
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(l.dir, "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zlib.NewWriter(tmp)
+	w := io.MultiWriter(zw, h)
+	w.Write(objectHeader(format, int(size)))
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("object size mismatch: expected %d, read %d", size, n)
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := tmp.Chmod(0444); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	sha := hex.EncodeToString(h.Sum(nil))
+	p := l.path(sha)
+	if util.IsFileExist(p) {
+		return sha, nil
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	return sha, os.Rename(tmp.Name(), p)
+}
+
+// 非 delta 对象可以直接边解压边读，delta 对象需要先还原（通常只有小对象才会被 delta）
+func (s *PackStore) OpenStream(sha string) (string, int64, io.ReadCloser, error) {
+	rawsha, err := hex.DecodeString(sha)
+	if err != nil || len(rawsha) != s.hashSize {
+		return "", 0, nil, objectNotFoundErr(sha)
+	}
+
+	packs, err := s.list()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	for _, p := range packs {
+		offset, ok := p.index.find(rawsha)
+		if !ok {
+			continue
+		}
+
+		f, err := os.Open(p.path)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		r := io.NewSectionReader(f, int64(offset), 1<<62)
+		br := &byteCounter{r: r}
+		typ, size, err := readPackObjectHeader(br)
+		if err != nil {
+			f.Close()
+			return "", 0, nil, corruptObjectErr(sha, err, p.path)
+		}
+
+		if _, ok := packTypeNames[typ]; ok {
+			zr, err := zlib.NewReader(io.NewSectionReader(r, int64(br.n), 1<<62))
+			if err != nil {
+				f.Close()
+				return "", 0, nil, corruptObjectErr(sha, err, p.path)
+			}
+			return packTypeNames[typ], size, &readCloser{io.LimitReader(zr, size), []io.Closer{zr, f}}, nil
+		}
+		f.Close()
+
+		format, data, err := s.Read(sha)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return format, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return "", 0, nil, objectNotFoundErr(sha)
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"path"
@@ -13,12 +14,13 @@ import (
 )
 
 type TreeObj struct {
-	fmt   string
-	items []*treeLeaf
+	fmt      string
+	items    []*treeLeaf
+	hashSize int // 二进制 sha 的长度，取决于仓库的 object format
 }
 
 func NewTreeObj() *TreeObj {
-	return &TreeObj{fmt: "tree"}
+	return &TreeObj{fmt: "tree", hashSize: sha1.Size}
 }
 
 func (t *TreeObj) Items() []*treeLeaf {
@@ -29,12 +31,17 @@ func (t *TreeObj) Format() string {
 	return t.fmt
 }
 
-func (t *TreeObj) Serialize(repo *Repository) []byte {
+func (t *TreeObj) Serialize(repo *Repository) ([]byte, error) {
 	return serializeTree(t.items)
 }
 
-func (t *TreeObj) Deserialize(data []byte) {
-	t.items = parseTree(data)
+func (t *TreeObj) Deserialize(data []byte) error {
+	items, err := parseTree(data, t.hashSize)
+	if err != nil {
+		return err
+	}
+	t.items = items
+	return nil
 }
 
 // [mode] space [path] 0x00 [sha-1]
@@ -44,83 +51,117 @@ type treeLeaf struct {
 	Sha  string
 }
 
-func parseTree(raw []byte) []*treeLeaf {
+func parseTree(raw []byte, hashSize int) ([]*treeLeaf, error) {
 	res := make([]*treeLeaf, 0)
 	for len(raw) > 0 {
-		pos, lf := parseTreeLeaf(raw)
+		pos, lf, err := parseTreeLeaf(raw, hashSize)
+		if err != nil {
+			return nil, err
+		}
 		res = append(res, lf)
 		raw = raw[pos:]
 	}
-	return res
+	return res, nil
 }
 
-func serializeTree(items []*treeLeaf) []byte {
+func serializeTree(items []*treeLeaf) ([]byte, error) {
+	// git 按名称排序，目录名视为带有结尾的 "/"
 	sort.Slice(items, func(i, j int) bool {
-		// keep dir sort after file
-		ifile := strings.HasPrefix(items[i].Path, "10")
-		jfile := strings.HasPrefix(items[j].Path, "10")
-
-		if ifile && jfile || !ifile && !jfile {
-			return items[i].Path < items[j].Path
-		}
-
-		return ifile
+		return items[i].sortKey() < items[j].sortKey()
 	})
 
 	res := bytes.Buffer{}
 	for _, item := range items {
-		res.WriteString(item.Mode)
+		// 目录的 mode 在 tree 中写作 40000，不带前导 0
+		res.WriteString(strings.TrimPrefix(item.Mode, "0"))
 		res.WriteByte(' ')
 		res.WriteString(item.Path)
 		res.WriteByte('\x00')
 		sha, err := hex.DecodeString(item.Sha)
-		util.PanicErr(err)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sha %q for tree entry %q", item.Sha, item.Path)
+		}
 		res.Write(sha)
 	}
 
-	return res.Bytes()
-	// return res
+	return res.Bytes(), nil
 }
 
-func parseTreeLeaf(raw []byte) (int, *treeLeaf) {
+func parseTreeLeaf(raw []byte, hashSize int) (int, *treeLeaf, error) {
 	leaf := &treeLeaf{}
 	space := bytes.IndexByte(raw, ' ')
-	if space != 6 {
-		util.PanicErr(fmt.Errorf("invalid tree file"))
+	if space != 5 && space != 6 {
+		return 0, nil, fmt.Errorf("invalid tree file")
 	}
 
-	leaf.Mode = strconv.Itoa(util.BytesToInt(raw[:space]))
+	if raw[0] == 0 {
+		// 早期的 mgit 把 mode 当作 6 字节的大端整数存储
+		leaf.Mode = strconv.Itoa(util.BytesToInt(raw[:space]))
+	} else {
+		leaf.Mode = string(raw[:space])
+	}
 	if len(leaf.Mode) == 5 {
 		leaf.Mode = "0" + leaf.Mode
 	}
 
-	null := space + 1 + bytes.IndexByte(raw[space+1:], '\x00')
+	null := bytes.IndexByte(raw[space+1:], '\x00')
+	if null == -1 {
+		return 0, nil, fmt.Errorf("invalid tree file")
+	}
+	null += space + 1
 	leaf.Path = string(raw[space+1 : null])
 
-	leaf.Sha = hex.EncodeToString(raw[null+1 : null+21])
-	return null + 21, leaf
+	end := null + 1 + hashSize
+	if end > len(raw) {
+		return 0, nil, fmt.Errorf("invalid tree file")
+	}
+	leaf.Sha = hex.EncodeToString(raw[null+1 : end])
+	return end, leaf, nil
+}
+
+func (l *treeLeaf) sortKey() string {
+	if strings.HasPrefix(l.Mode, "04") {
+		return l.Path + "/"
+	}
+	return l.Path
+}
+
+// 树扁平化，值为文件的 sha
+func Tree2Map(repo *Repository, ref string, prefix string) (map[string]string, error) {
+	return flattenTree(repo, ref, prefix, func(l *treeLeaf) string { return l.Sha })
 }
 
-// 树扁平化
-func Tree2Map(repo *Repository, ref string, prefix string) map[string]string {
+// 树扁平化，值为文件的 mode，例如 "100755"
+func Tree2ModeMap(repo *Repository, ref string, prefix string) (map[string]string, error) {
+	return flattenTree(repo, ref, prefix, func(l *treeLeaf) string { return l.Mode })
+}
+
+func flattenTree(repo *Repository, ref string, prefix string, value func(*treeLeaf) string) (map[string]string, error) {
 	res := make(map[string]string)
-	sha := FindObject(repo, ref, "tree", true)
-	if sha == "" {
-		return res
+	sha, err := FindObject(repo, ref, "tree", true)
+	if err != nil {
+		return nil, err
 	}
-	tree := ReadObject(repo, sha).(*TreeObj)
+	obj, err := ReadObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	tree := obj.(*TreeObj)
 
 	for _, leaf := range tree.items {
 		fullPath := path.Join(prefix, leaf.Path)
 		if strings.HasPrefix(leaf.Mode, "04") {
-			subTree := Tree2Map(repo, leaf.Sha, fullPath)
+			subTree, err := flattenTree(repo, leaf.Sha, fullPath, value)
+			if err != nil {
+				return nil, err
+			}
 			for k, v := range subTree {
 				res[k] = v
 			}
 		} else {
-			res[fullPath] = leaf.Sha
+			res[fullPath] = value(leaf)
 		}
 	}
 
-	return res
+	return res, nil
 }
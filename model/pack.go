@@ -0,0 +1,554 @@
+package model
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ignorantshr/mgit/util"
+)
+
+/*
+packfile 由两个文件组成：
+
+  - objects/pack/pack-<sha>.pack 存放对象数据，每个对象可以是完整的或者是相对于另一个对象的 delta
+  - objects/pack/pack-<sha>.idx  version 2 索引，用于通过 sha 定位对象在 pack 中的偏移
+
+参考 https://git-scm.com/docs/gitformat-pack
+*/
+
+const (
+	packObjCommit   = 1
+	packObjTree     = 2
+	packObjBlob     = 3
+	packObjTag      = 4
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+var packIdxMagic = []byte{0xff, 't', 'O', 'c'}
+
+var packTypeNames = map[int]string{
+	packObjCommit: "commit",
+	packObjTree:   "tree",
+	packObjBlob:   "blob",
+	packObjTag:    "tag",
+}
+
+var packTypeNums = map[string]int{
+	"commit": packObjCommit,
+	"tree":   packObjTree,
+	"blob":   packObjBlob,
+	"tag":    packObjTag,
+}
+
+type packIndex struct {
+	hashSize int
+	fanout   [256]uint32
+	shas     []byte // count * hashSize, sorted
+	offsets  []uint64
+}
+
+func (idx *packIndex) count() int {
+	return int(idx.fanout[255])
+}
+
+func (idx *packIndex) shaAt(i int) []byte {
+	return idx.shas[i*idx.hashSize : (i+1)*idx.hashSize]
+}
+
+// 通过 fan-out 表缩小范围后二分查找
+func (idx *packIndex) find(sha []byte) (uint64, bool) {
+	lo, hi := idx.bucket(sha[0])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.shaAt(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(idx.shaAt(i), sha) {
+		return idx.offsets[i], true
+	}
+	return 0, false
+}
+
+func (idx *packIndex) bucket(first byte) (int, int) {
+	lo := 0
+	if first > 0 {
+		lo = int(idx.fanout[first-1])
+	}
+	return lo, int(idx.fanout[first])
+}
+
+// 收集以 prefix（十六进制，长度至少为 2）开头的所有 sha
+func (idx *packIndex) findPrefix(prefix string) []string {
+	first, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+	res := []string{}
+	lo, hi := idx.bucket(first[0])
+	for i := lo; i < hi; i++ {
+		sha := hex.EncodeToString(idx.shaAt(i))
+		if strings.HasPrefix(sha, prefix) {
+			res = append(res, sha)
+		}
+	}
+	return res
+}
+
+func parsePackIndex(raw []byte, hashSize int) (*packIndex, error) {
+	if len(raw) < 8+256*4 || !bytes.Equal(raw[:4], packIdxMagic) {
+		return nil, fmt.Errorf("unsupported pack index format")
+	}
+	if ver := binary.BigEndian.Uint32(raw[4:8]); ver != 2 {
+		return nil, fmt.Errorf("unsupported pack index version %d", ver)
+	}
+
+	idx := &packIndex{hashSize: hashSize}
+	pos := 8
+	for i := 0; i < 256; i++ {
+		idx.fanout[i] = binary.BigEndian.Uint32(raw[pos:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, fmt.Errorf("pack index fanout table is not sorted")
+		}
+		pos += 4
+	}
+	n := idx.count()
+
+	// sha 表 + crc32 表 + 4 字节偏移表 + 两个校验和
+	if len(raw) < pos+n*(hashSize+4+4)+2*hashSize {
+		return nil, fmt.Errorf("pack index is truncated")
+	}
+	idx.shas = raw[pos : pos+n*hashSize]
+	pos += n * hashSize
+	pos += n * 4 // crc32, not used while reading
+
+	largePos := pos + n*4
+	idx.offsets = make([]uint64, n)
+	for i := 0; i < n; i++ {
+		off := binary.BigEndian.Uint32(raw[pos+i*4:])
+		if off&0x80000000 == 0 {
+			idx.offsets[i] = uint64(off)
+			continue
+		}
+		// 最高位为 1 时表示 8 字节偏移表中的下标
+		p := largePos + int(off&0x7fffffff)*8
+		if p+8 > len(raw) {
+			return nil, fmt.Errorf("pack index large offset out of range")
+		}
+		idx.offsets[i] = binary.BigEndian.Uint64(raw[p:])
+	}
+	return idx, nil
+}
+
+type packFile struct {
+	path  string // path of the .pack file
+	index *packIndex
+}
+
+type packEntry struct {
+	typ  int
+	data []byte
+}
+
+// objects/pack 目录下的 packfile 组成的只读对象数据库
+type PackStore struct {
+	dir      string // objects directory
+	hashSize int
+	packs    []*packFile // loaded lazily, see list
+
+	// 用于查找 REF_DELTA 的 base，其可能在其他 pack 或者是 loose object
+	external ObjectStore
+}
+
+func NewPackStore(dir string, hashSize int) *PackStore {
+	return &PackStore{dir: dir, hashSize: hashSize}
+}
+
+// 列出所有的 packfile，结果会被缓存
+func (s *PackStore) list() ([]*packFile, error) {
+	if s.packs != nil {
+		return s.packs, nil
+	}
+
+	packs := []*packFile{}
+	idxFiles, err := filepath.Glob(path.Join(s.dir, "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(idxFiles)
+
+	for _, f := range idxFiles {
+		packPath := strings.TrimSuffix(f, ".idx") + ".pack"
+		if !util.IsFile(packPath) {
+			continue
+		}
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		index, err := parsePackIndex(raw, s.hashSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrCorruptObject, f, err)
+		}
+		packs = append(packs, &packFile{path: packPath, index: index})
+	}
+	s.packs = packs
+	return s.packs, nil
+}
+
+// 新增或删除 packfile 之后需要重新加载
+func (s *PackStore) reload() {
+	s.packs = nil
+}
+
+// pack 无法读取时返回 false，错误由 Read 报告
+func (s *PackStore) Has(sha string) bool {
+	rawsha, err := hex.DecodeString(sha)
+	if err != nil || len(rawsha) != s.hashSize {
+		return false
+	}
+	packs, _ := s.list()
+	for _, p := range packs {
+		if _, ok := p.index.find(rawsha); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 从 packfile 中读取对象，返回对象类型和内容
+func (s *PackStore) Read(sha string) (string, []byte, error) {
+	return s.read(sha, 0)
+}
+
+// 作为其他 pack 中 REF_DELTA 的 base 读取，depth 为已经经过的 delta 层数
+func (s *PackStore) readDeltaBase(sha string, depth int) (string, []byte, error) {
+	return s.read(sha, depth)
+}
+
+func (s *PackStore) read(sha string, depth int) (string, []byte, error) {
+	rawsha, err := hex.DecodeString(sha)
+	if err != nil || len(rawsha) != s.hashSize {
+		return "", nil, objectNotFoundErr(sha)
+	}
+
+	packs, err := s.list()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, p := range packs {
+		offset, ok := p.index.find(rawsha)
+		if !ok {
+			continue
+		}
+
+		f, err := os.Open(p.path)
+		if err != nil {
+			return "", nil, err
+		}
+		defer f.Close()
+
+		e, err := p.readAt(s, f, offset, depth)
+		if err != nil && depth > 0 {
+			// 作为 delta base 读取时由最外层的 Read 报告，逐层包装会让错误信息随 delta 链变长
+			return "", nil, err
+		}
+		if err != nil {
+			return "", nil, corruptObjectErr(sha, err, p.path)
+		}
+		return packTypeNames[e.typ], e.data, nil
+	}
+	return "", nil, objectNotFoundErr(sha)
+}
+
+func (s *PackStore) Write(sha, format string, data []byte) error {
+	return fmt.Errorf("pack store is read-only, use WritePack to create packs")
+}
+
+func (s *PackStore) Iterate(fn func(sha string)) error {
+	packs, err := s.list()
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		for i := 0; i < p.index.count(); i++ {
+			fn(hex.EncodeToString(p.index.shaAt(i)))
+		}
+	}
+	return nil
+}
+
+func (s *PackStore) ResolvePrefix(prefix string) ([]string, error) {
+	packs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, p := range packs {
+		res = append(res, p.index.findPrefix(prefix)...)
+	}
+	return res, nil
+}
+
+// delta 链的最大长度，与 git 的 pack.depth 上限相同，避免损坏的 pack 导致无限递归
+const maxDeltaDepth = 4095
+
+// 可以接着已有的 delta 层数读取 REF_DELTA 的 base 的 store，
+// 跨 pack 的 delta 链同样受 maxDeltaDepth 的限制
+type deltaBaseReader interface {
+	readDeltaBase(sha string, depth int) (format string, data []byte, err error)
+}
+
+func readDeltaBase(store ObjectStore, sha string, depth int) (string, []byte, error) {
+	if s, ok := store.(deltaBaseReader); ok {
+		return s.readDeltaBase(sha, depth)
+	}
+	return store.Read(sha)
+}
+
+// 读取 offset 处的对象，并递归地解析 delta，depth 为已经经过的 delta 层数
+func (p *packFile) readAt(store *PackStore, f io.ReaderAt, offset uint64, depth int) (*packEntry, error) {
+	if depth > maxDeltaDepth {
+		return nil, fmt.Errorf("delta chain is too long at %d", offset)
+	}
+	r := io.NewSectionReader(f, int64(offset), 1<<62)
+	br := &byteCounter{r: r}
+
+	typ, size, err := readPackObjectHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		data, err := inflatePacked(r, int64(br.n), size)
+		if err != nil {
+			return nil, err
+		}
+		return &packEntry{typ, data}, nil
+
+	case packObjOfsDelta:
+		rel, err := readOfsDeltaOffset(br)
+		if err != nil {
+			return nil, err
+		}
+		if rel == 0 || rel > offset {
+			return nil, fmt.Errorf("invalid delta base offset at %d", offset)
+		}
+		delta, err := inflatePacked(r, int64(br.n), size)
+		if err != nil {
+			return nil, err
+		}
+		base, err := p.readAt(store, f, offset-rel, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		data, err := applyDelta(base.data, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &packEntry{base.typ, data}, nil
+
+	case packObjRefDelta:
+		baseSha := make([]byte, p.index.hashSize)
+		if _, err := io.ReadFull(br, baseSha); err != nil {
+			return nil, err
+		}
+		delta, err := inflatePacked(r, int64(br.n), size)
+		if err != nil {
+			return nil, err
+		}
+
+		var base *packEntry
+		if off, ok := p.index.find(baseSha); ok {
+			base, err = p.readAt(store, f, off, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// base 可能在别的 pack 或者是 loose object
+			if store.external == nil {
+				return nil, fmt.Errorf("delta base %x is not found", baseSha)
+			}
+			format, data, err := readDeltaBase(store.external, hex.EncodeToString(baseSha), depth+1)
+			if errors.Is(err, ErrObjectNotFound) {
+				return nil, fmt.Errorf("delta base %x is not found", baseSha)
+			}
+			if err != nil {
+				return nil, err
+			}
+			base = &packEntry{packTypeNums[format], data}
+		}
+		data, err := applyDelta(base.data, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &packEntry{base.typ, data}, nil
+	}
+
+	return nil, fmt.Errorf("unknown pack object type %d at %d", typ, offset)
+}
+
+type byteCounter struct {
+	r io.Reader
+	n int
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *byteCounter) ReadByte() (byte, error) {
+	buf := [1]byte{}
+	if _, err := io.ReadFull(b, buf[:]); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// 第一个字节：MSB 为继续标志，接下来 3 bit 为类型，低 4 bit 为大小；
+// 之后每个字节的低 7 bit 依次作为大小的更高位
+func readPackObjectHeader(r io.ByteReader) (int, int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ := int(c>>4) & 0x7
+	size := int64(c & 0x0f)
+	shift := 4
+	for c&0x80 != 0 {
+		c, err = r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		if shift > 56 {
+			return 0, 0, errors.New("object size is too large")
+		}
+		size |= int64(c&0x7f) << shift
+		shift += 7
+	}
+	return typ, size, nil
+}
+
+// OFS_DELTA 的 base 偏移使用另一种变长编码，每多一个字节都要先加 1
+func readOfsDeltaOffset(r io.ByteReader) (uint64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	off := uint64(c & 0x7f)
+	for c&0x80 != 0 {
+		c, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		off = ((off + 1) << 7) | uint64(c&0x7f)
+	}
+	return off, nil
+}
+
+func inflatePacked(r io.ReaderAt, pos, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(io.NewSectionReader(r, pos, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// size 来自 pack 中的数据，不能直接用来分配内存，边解压边扩大缓冲区
+	data, err := io.ReadAll(io.LimitReader(zr, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("inflated size %d does not match object size %d", len(data), size)
+	}
+	return data, nil
+}
+
+func readDeltaSize(delta []byte) (int, []byte) {
+	size, shift := 0, 0
+	for len(delta) > 0 && shift < 63 {
+		c := delta[0]
+		delta = delta[1:]
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return size, delta
+}
+
+// delta 数据：base 大小、结果大小，然后是一系列 copy/insert 指令
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta := readDeltaSize(delta)
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("delta base size mismatch: %d != %d", baseSize, len(base))
+	}
+	resultSize, delta := readDeltaSize(delta)
+	if resultSize < 0 {
+		return nil, fmt.Errorf("invalid delta result size")
+	}
+
+	// resultSize 来自 delta 中的数据，不能直接用来分配内存
+	res := make([]byte, 0, min(resultSize, len(base)+len(delta)))
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 != 0 {
+			// copy: 低 4 bit 表示 offset 的哪些字节存在，接下来 3 bit 表示 size 的哪些字节存在
+			var off, size int
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("delta is truncated")
+					}
+					off |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(1<<(4+i)) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("delta is truncated")
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > len(base) {
+				return nil, fmt.Errorf("delta copy out of range")
+			}
+			res = append(res, base[off:off+size]...)
+		} else if op != 0 {
+			// insert: op 本身就是要插入的字节数
+			n := int(op)
+			if n > len(delta) {
+				return nil, fmt.Errorf("delta is truncated")
+			}
+			res = append(res, delta[:n]...)
+			delta = delta[n:]
+		} else {
+			return nil, fmt.Errorf("invalid delta opcode 0")
+		}
+	}
+
+	if len(res) != resultSize {
+		return nil, fmt.Errorf("delta result size mismatch: %d != %d", len(res), resultSize)
+	}
+	return res, nil
+}
@@ -0,0 +1,398 @@
+package model
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func zlibData(b []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// 根据 sha（十六进制）和偏移生成 v2 的 .idx，crc32 和校验和都为 0
+func buildPackIndex(offsets map[string]uint64, hashSize int) []byte {
+	shas := []string{}
+	for sha := range offsets {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	res := append([]byte{}, packIdxMagic...)
+	res = binary.BigEndian.AppendUint32(res, 2)
+	var fanout [256]uint32
+	for _, sha := range shas {
+		first, _ := hex.DecodeString(sha[:2])
+		fanout[first[0]]++
+	}
+	total := uint32(0)
+	for i := range fanout {
+		total += fanout[i]
+		res = binary.BigEndian.AppendUint32(res, total)
+	}
+	for _, sha := range shas {
+		raw, _ := hex.DecodeString(sha)
+		res = append(res, raw...)
+	}
+	res = append(res, make([]byte, 4*len(shas))...)
+	large := []uint64{}
+	for _, sha := range shas {
+		if off := offsets[sha]; off < 0x80000000 {
+			res = binary.BigEndian.AppendUint32(res, uint32(off))
+		} else {
+			res = binary.BigEndian.AppendUint32(res, 0x80000000|uint32(len(large)))
+			large = append(large, off)
+		}
+	}
+	for _, off := range large {
+		res = binary.BigEndian.AppendUint64(res, off)
+	}
+	return append(res, make([]byte, 2*hashSize)...)
+}
+
+// 依次写入各个对象（对象头 + extra + zlib 压缩的数据），返回 pack 和各个对象的偏移
+func buildPack(entries ...[]byte) ([]byte, []uint64) {
+	pack := []byte("PACK")
+	pack = binary.BigEndian.AppendUint32(pack, 2)
+	pack = binary.BigEndian.AppendUint32(pack, uint32(len(entries)))
+	offsets := []uint64{}
+	for _, e := range entries {
+		offsets = append(offsets, uint64(len(pack)))
+		pack = append(pack, e...)
+	}
+	return pack, offsets
+}
+
+func packEntryBytes(typ int, extra, data []byte) []byte {
+	res := append(encodePackObjectHeader(typ, len(data)), extra...)
+	return append(res, zlibData(data)...)
+}
+
+func TestReadPackObject(t *testing.T) {
+	base := []byte(strings.Repeat("hello packfile\n", 20))
+	target := append(append([]byte{}, base[:100]...), "changed\n"...)
+	delta := bytes.Join([][]byte{
+		encodeDeltaSize(len(base)), encodeDeltaSize(len(target)),
+		encodeDeltaCopy(0, 100), {8}, []byte("changed\n"),
+	}, nil)
+	baseSha := strings.Repeat("11", sha1.Size)
+	rawBaseSha, _ := hex.DecodeString(baseSha)
+
+	// base、相对于 base 的 OFS_DELTA、相对于 OFS_DELTA 结果的 REF_DELTA（delta 链）
+	first := packEntryBytes(packObjBlob, nil, base)
+	pack, offsets := buildPack(first,
+		packEntryBytes(packObjOfsDelta, encodeOfsDeltaOffset(uint64(len(first))), delta),
+		packEntryBytes(packObjRefDelta, rawBaseSha, delta))
+	shas := map[string]uint64{baseSha: offsets[0], strings.Repeat("22", sha1.Size): offsets[1], strings.Repeat("ee", sha1.Size): offsets[2]}
+	idx, err := parsePackIndex(buildPackIndex(shas, sha1.Size), sha1.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &packFile{index: idx}
+	for i, want := range [][]byte{base, target, target} {
+		e, err := p.readAt(&PackStore{hashSize: sha1.Size}, bytes.NewReader(pack), offsets[i], 0)
+		if err != nil {
+			t.Fatalf("readAt(%d): %v", offsets[i], err)
+		}
+		if e.typ != packObjBlob || !bytes.Equal(e.data, want) {
+			t.Errorf("readAt(%d) = %d %q, want blob %q", offsets[i], e.typ, e.data, want)
+		}
+	}
+
+	for sha, off := range shas {
+		raw, _ := hex.DecodeString(sha)
+		if got, ok := idx.find(raw); !ok || got != off {
+			t.Errorf("find(%s) = %d, %t, want %d", sha, got, ok, off)
+		}
+	}
+	if got := idx.findPrefix("2222"); len(got) != 1 || got[0] != strings.Repeat("22", sha1.Size) {
+		t.Errorf("findPrefix(2222) = %v", got)
+	}
+	if _, ok := idx.find(bytes.Repeat([]byte{0x33}, sha1.Size)); ok {
+		t.Errorf("find(33...) succeeded")
+	}
+}
+
+func TestParsePackIndexMalformed(t *testing.T) {
+	hashSize := sha1.Size
+	rawIdx := buildPackIndex(map[string]uint64{
+		strings.Repeat("01", hashSize): 12,
+		strings.Repeat("80", hashSize): 1 << 32,
+		strings.Repeat("ff", hashSize): 100,
+	}, hashSize)
+	if _, err := parsePackIndex(rawIdx, hashSize); err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte{}, rawIdx...))
+	}
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"empty", nil, "unsupported pack index format"},
+		{"bad magic", modify(func(b []byte) []byte { b[0] = 0; return b }), "unsupported pack index format"},
+		{"short header", rawIdx[:100], "unsupported pack index format"},
+		{"version 3", modify(func(b []byte) []byte { b[7] = 3; return b }), "unsupported pack index version 3"},
+		{"truncated tables", rawIdx[:len(rawIdx)-2*hashSize-9], "pack index is truncated"},
+		{"decreasing fanout", modify(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[8+4*10:], 1000)
+			return b
+		}), "fanout table is not sorted"},
+		{"count too large", modify(func(b []byte) []byte {
+			for i := 0; i < 256; i++ {
+				binary.BigEndian.PutUint32(b[8+4*i:], 1<<20)
+			}
+			return b
+		}), "pack index is truncated"},
+		{"large offset out of range", modify(func(b []byte) []byte {
+			n := 8 + 1024 + 3*hashSize + 3*4 + 4
+			binary.BigEndian.PutUint32(b[n:], 0x80000010)
+			return b
+		}), "large offset out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePackIndex(tt.raw, hashSize)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parsePackIndex() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPackObjectMalformed(t *testing.T) {
+	blobSha := strings.Repeat("ab", sha1.Size)
+	selfIdx := buildPackIndex(map[string]uint64{blobSha: 12}, sha1.Size)
+	rawSha, _ := hex.DecodeString(blobSha)
+
+	onlyEntry := func(entry []byte) []byte {
+		pack, _ := buildPack(entry)
+		return pack
+	}
+	tests := []struct {
+		name string
+		pack []byte
+		want string
+	}{
+		{"ofs delta to itself", onlyEntry(packEntryBytes(packObjOfsDelta, encodeOfsDeltaOffset(0), []byte("abc"))),
+			"invalid delta base offset"},
+		{"ofs delta before the pack", onlyEntry(packEntryBytes(packObjOfsDelta, encodeOfsDeltaOffset(100), []byte("abc"))),
+			"invalid delta base offset"},
+		{"ref delta to itself", onlyEntry(packEntryBytes(packObjRefDelta, rawSha, []byte("abc"))),
+			"delta chain is too long"},
+		{"size mismatch", onlyEntry(append(encodePackObjectHeader(packObjBlob, 10), zlibData([]byte("abc"))...)),
+			"does not match object size"},
+		{"huge declared size", onlyEntry(append(encodePackObjectHeader(packObjBlob, 1<<40), zlibData([]byte("abc"))...)),
+			"does not match object size"},
+		{"truncated zlib", onlyEntry(append(encodePackObjectHeader(packObjBlob, 3), zlibData([]byte("abc"))[:4]...)),
+			"unexpected EOF"},
+		{"unknown type", onlyEntry(packEntryBytes(5, nil, []byte("abc"))),
+			"unknown pack object type 5"},
+		{"overlong size", onlyEntry(bytes.Repeat([]byte{0xff}, 12)),
+			"object size is too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, err := parsePackIndex(selfIdx, sha1.Size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &packFile{index: idx}
+			_, err = p.readAt(&PackStore{hashSize: sha1.Size}, bytes.NewReader(tt.pack), 12, 0)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readAt() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// 两个 pack 中的 REF_DELTA 互相以对方为 base，跨 pack 的 delta 链也要受 maxDeltaDepth 限制
+func TestReadPackObjectCrossPackCycle(t *testing.T) {
+	dir := t.TempDir()
+	packDir := filepath.Join(dir, "pack")
+	if err := os.Mkdir(packDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	shaA, shaB := strings.Repeat("aa", sha1.Size), strings.Repeat("bb", sha1.Size)
+	for _, p := range [][2]string{{shaA, shaB}, {shaB, shaA}} {
+		rawBase, _ := hex.DecodeString(p[1])
+		pack, offsets := buildPack(packEntryBytes(packObjRefDelta, rawBase, []byte("abc")))
+		name := filepath.Join(packDir, "pack-"+p[0])
+		if err := os.WriteFile(name+".pack", pack, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name+".idx", buildPackIndex(map[string]uint64{p[0]: offsets[0]}, sha1.Size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewPackStore(dir, sha1.Size)
+	store.external = NewMultiStore(NewLooseStore(dir), store)
+	_, _, err := store.Read(shaA)
+	if !errors.Is(err, ErrCorruptObject) || !strings.Contains(err.Error(), "delta chain is too long") {
+		t.Errorf("Read() error = %v, want a too long delta chain", err)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	delta := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name  string
+		delta []byte
+		want  string
+	}{
+		{"empty result", delta(encodeDeltaSize(11), encodeDeltaSize(0)), ""},
+		{"copy all", delta(encodeDeltaSize(11), encodeDeltaSize(11), encodeDeltaCopy(0, 11)), "hello world"},
+		{"copy and insert", delta(encodeDeltaSize(11), encodeDeltaSize(11), encodeDeltaCopy(6, 5), []byte{6, ' ', 'h', 'e', 'l', 'l', 'o'}),
+			"world hello"},
+		{"copy twice", delta(encodeDeltaSize(11), encodeDeltaSize(10), encodeDeltaCopy(0, 5), encodeDeltaCopy(0, 5)), "hellohello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyDelta(base, tt.delta)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("applyDelta() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaMalformed(t *testing.T) {
+	base := []byte("hello world")
+	delta := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name  string
+		delta []byte
+		want  string
+	}{
+		{"base size mismatch", delta(encodeDeltaSize(5), encodeDeltaSize(5), encodeDeltaCopy(0, 5)),
+			"delta base size mismatch"},
+		{"copy out of range", delta(encodeDeltaSize(11), encodeDeltaSize(5), encodeDeltaCopy(8, 5)),
+			"delta copy out of range"},
+		{"truncated copy", delta(encodeDeltaSize(11), encodeDeltaSize(5), []byte{0x91}),
+			"delta is truncated"},
+		{"truncated insert", delta(encodeDeltaSize(11), encodeDeltaSize(5), []byte{5, 'a', 'b'}),
+			"delta is truncated"},
+		{"opcode 0", delta(encodeDeltaSize(11), encodeDeltaSize(5), []byte{0}),
+			"invalid delta opcode 0"},
+		{"result size mismatch", delta(encodeDeltaSize(11), encodeDeltaSize(6), encodeDeltaCopy(0, 5)),
+			"size mismatch"},
+		{"huge result size", delta(encodeDeltaSize(11), encodeDeltaSize(1<<40), encodeDeltaCopy(0, 5)),
+			"size mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := applyDelta(base, tt.delta)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("applyDelta() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateDelta(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 8))
+	targets := [][]byte{
+		nil,
+		[]byte("completely different"),
+		base,
+		append(append([]byte{}, base[:40]...), "inserted"+string(base[40:])...),
+		append(append([]byte{}, base[64:]...), base[:64]...),
+		bytes.Repeat(base, 1000), // 超过单个 copy 指令的 0x10000 上限
+	}
+	for i, target := range targets {
+		got, err := applyDelta(base, createDelta(base, target))
+		if err != nil {
+			t.Errorf("#%d: applyDelta: %v", i, err)
+		} else if !bytes.Equal(got, target) {
+			t.Errorf("#%d: applyDelta(createDelta()) does not reproduce the target", i)
+		}
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	for _, format := range []string{ObjectFormatSHA1, ObjectFormatSHA256} {
+		t.Run(format, func(t *testing.T) {
+			repo, err := NewMemoryRepository(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 一组相似的 blob，会产生 delta
+			contents := map[string][]byte{}
+			names := map[string]string{}
+			shas := []string{}
+			base := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 50)
+			for i := 0; i < 8; i++ {
+				blob := &BlobObj{fmt: "blob", data: []byte(base + strings.Repeat(fmt.Sprintf("line %d\n", i), i+1))}
+				sha, err := WriteObject(repo, blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents[sha] = blob.data
+				names[sha] = "file.txt"
+				shas = append(shas, sha)
+			}
+
+			out := &bytes.Buffer{}
+			_, rawIdx, err := encodePack(repo, shas, names, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pack := out.Bytes()
+			idx, err := parsePackIndex(rawIdx, repo.HashSize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idx.count() != len(contents) {
+				t.Fatalf("count() = %d, want %d", idx.count(), len(contents))
+			}
+
+			p := &packFile{index: idx}
+			store := &PackStore{hashSize: repo.HashSize()}
+			deltas := 0
+			for sha, want := range contents {
+				raw, _ := hex.DecodeString(sha)
+				off, ok := idx.find(raw)
+				if !ok {
+					t.Fatalf("find(%s) failed", sha)
+				}
+				if typ, _, _ := readPackObjectHeader(bytes.NewReader(pack[off:])); typ == packObjOfsDelta {
+					deltas++
+				}
+				entry, err := p.readAt(store, bytes.NewReader(pack), off, 0)
+				if err != nil {
+					t.Fatalf("readAt(%s): %v", sha, err)
+				}
+				if entry.typ != packObjBlob || !bytes.Equal(entry.data, want) {
+					t.Errorf("readAt(%s) returned different content", sha)
+				}
+			}
+			if deltas == 0 {
+				t.Errorf("no object is stored as a delta")
+			}
+		})
+	}
+}
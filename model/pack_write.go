@@ -0,0 +1,367 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	packWindow     = 10 // 每个对象最多与前面多少个同类型对象尝试 delta
+	packDepth      = 50 // delta 链的最大长度
+	deltaBlockSize = 16
+)
+
+type packObject struct {
+	sha   string
+	typ   int
+	name  string // path hint, objects with the same name usually delta well
+	data  []byte
+	size  int64
+	big   bool // 超过 core.bigFileThreshold，写入时直接从 store 流式拷贝，不做 delta
+	depth int
+	base  *packObject
+	delta []byte
+
+	offset uint64
+	crc    uint32
+}
+
+// 将给定的对象写入一个新的 packfile 及其 .idx，返回 pack 的名称（pack-<sha>）。
+// names 是对象对应的路径提示，可以为空。
+func WritePack(repo *Repository, shas []string, names map[string]string) (string, error) {
+	packDir, err := repo.repoDir(true, "objects", "pack")
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(packDir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	bw := bufio.NewWriter(tmp)
+	checksum, idx, err := encodePack(repo, shas, names, bw)
+	if err != nil {
+		return "", err
+	}
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+	if err := tmp.Chmod(0444); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := "pack-" + hex.EncodeToString(checksum)
+	idxTmp := tmp.Name() + ".idx"
+	defer os.Remove(idxTmp)
+	if err := os.WriteFile(idxTmp, idx, 0444); err != nil {
+		return "", err
+	}
+
+	// 先放 .pack 再放 .idx，读取方以 .idx 为准，不会看到不完整的 pack
+	if err := os.Rename(tmp.Name(), path.Join(packDir, name+".pack")); err != nil {
+		return "", err
+	}
+	if err := os.Rename(idxTmp, path.Join(packDir, name+".idx")); err != nil {
+		return "", err
+	}
+
+	if repo.pack != nil {
+		repo.pack.reload()
+	}
+	return name, nil
+}
+
+// 把对象编码为 pack 写到 out，返回 pack 的 checksum 和对应的 .idx 内容
+func encodePack(repo *Repository, shas []string, names map[string]string, out io.Writer) ([]byte, []byte, error) {
+	threshold, err := repo.BigFileThreshold()
+	if err != nil {
+		return nil, nil, err
+	}
+	objs := make([]*packObject, 0, len(shas))
+	for _, sha := range shas {
+		format, size, r, err := OpenObjectStream(repo, sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		o := &packObject{sha: sha, typ: packTypeNums[format], name: path.Base(names[sha]), size: size}
+		if size > threshold {
+			o.big = true
+		} else {
+			o.data, err = io.ReadAll(r)
+		}
+		r.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		objs = append(objs, o)
+	}
+
+	// 类型、名称相同的对象放在一起，大的在前，这样小对象可以作为大对象的 delta
+	sort.SliceStable(objs, func(i, j int) bool {
+		a, b := objs[i], objs[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.size > b.size
+	})
+	findDeltas(objs)
+
+	sum := repo.newHash()
+	w := &countingWriter{w: out}
+	packOut := io.MultiWriter(w, sum)
+
+	header := []byte("PACK")
+	header = binary.BigEndian.AppendUint32(header, 2)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(objs)))
+	packOut.Write(header)
+
+	for _, o := range objs {
+		o.offset = uint64(w.n)
+		crc := crc32.NewIEEE()
+		entry := io.MultiWriter(packOut, crc)
+
+		if o.base != nil {
+			entry.Write(encodePackObjectHeader(packObjOfsDelta, len(o.delta)))
+			entry.Write(encodeOfsDeltaOffset(o.offset - o.base.offset))
+			err = deflateTo(entry, o.delta)
+		} else if o.big {
+			err = copyBigObject(repo, entry, o)
+		} else {
+			entry.Write(encodePackObjectHeader(o.typ, len(o.data)))
+			err = deflateTo(entry, o.data)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		o.crc = crc.Sum32()
+	}
+
+	checksum := sum.Sum(nil)
+	if _, err := w.Write(checksum); err != nil {
+		return nil, nil, err
+	}
+	return checksum, encodePackIndex(objs, checksum, repo.newHash()), nil
+}
+
+// 大对象直接从 store 流式压缩到 pack 中
+func copyBigObject(repo *Repository, w io.Writer, o *packObject) error {
+	_, _, r, err := OpenObjectStream(repo, o.sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w.Write(encodePackObjectHeader(o.typ, int(o.size)))
+	zw := zlib.NewWriter(w)
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// 在窗口内为每个对象寻找最小的 delta
+func findDeltas(objs []*packObject) {
+	for i, o := range objs {
+		if o.big || len(o.data) < deltaBlockSize {
+			continue
+		}
+		for j := i - 1; j >= 0 && j >= i-packWindow; j-- {
+			base := objs[j]
+			if base.big || base.typ != o.typ || base.depth >= packDepth {
+				continue
+			}
+			delta := createDelta(base.data, o.data)
+			limit := len(o.data) / 2
+			if o.delta != nil {
+				limit = len(o.delta)
+			}
+			if len(delta) < limit {
+				o.base, o.delta, o.depth = base, delta, base.depth+1
+			}
+		}
+	}
+}
+
+func encodePackIndex(objs []*packObject, packChecksum []byte, sum hash.Hash) []byte {
+	sorted := append([]*packObject{}, objs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].sha < sorted[j].sha
+	})
+
+	res := bytes.Buffer{}
+	res.Write(packIdxMagic)
+	res.Write(binary.BigEndian.AppendUint32(nil, 2))
+
+	var fanout [256]uint32
+	for _, o := range sorted {
+		first, _ := hex.DecodeString(o.sha[:2])
+		fanout[first[0]]++
+	}
+	total := uint32(0)
+	for i := range fanout {
+		total += fanout[i]
+		res.Write(binary.BigEndian.AppendUint32(nil, total))
+	}
+
+	for _, o := range sorted {
+		sha, _ := hex.DecodeString(o.sha)
+		res.Write(sha)
+	}
+	for _, o := range sorted {
+		res.Write(binary.BigEndian.AppendUint32(nil, o.crc))
+	}
+
+	large := []uint64{}
+	for _, o := range sorted {
+		if o.offset < 0x80000000 {
+			res.Write(binary.BigEndian.AppendUint32(nil, uint32(o.offset)))
+		} else {
+			res.Write(binary.BigEndian.AppendUint32(nil, 0x80000000|uint32(len(large))))
+			large = append(large, o.offset)
+		}
+	}
+	for _, off := range large {
+		res.Write(binary.BigEndian.AppendUint64(nil, off))
+	}
+
+	res.Write(packChecksum)
+	sum.Write(res.Bytes())
+	res.Write(sum.Sum(nil))
+	return res.Bytes()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func deflateTo(w io.Writer, data []byte) error {
+	zw := zlib.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func encodePackObjectHeader(typ, size int) []byte {
+	c := byte(typ<<4) | byte(size&0x0f)
+	size >>= 4
+	res := []byte{}
+	for size > 0 {
+		res = append(res, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(res, c)
+}
+
+func encodeOfsDeltaOffset(off uint64) []byte {
+	res := []byte{byte(off & 0x7f)}
+	off >>= 7
+	for off > 0 {
+		off--
+		res = append([]byte{0x80 | byte(off&0x7f)}, res...)
+		off >>= 7
+	}
+	return res
+}
+
+func encodeDeltaSize(size int) []byte {
+	res := []byte{}
+	for size >= 0x80 {
+		res = append(res, byte(size&0x7f)|0x80)
+		size >>= 7
+	}
+	return append(res, byte(size))
+}
+
+// 生成把 base 变成 target 的 delta：
+// 对 base 按 16 字节分块建立索引，在 target 中查找匹配的块并尽量向后扩展，匹配不上的部分作为 insert
+func createDelta(base, target []byte) []byte {
+	index := make(map[string]int)
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		key := string(base[i : i+deltaBlockSize])
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+
+	res := encodeDeltaSize(len(base))
+	res = append(res, encodeDeltaSize(len(target))...)
+
+	insert := []byte{}
+	flush := func() {
+		for len(insert) > 0 {
+			n := min(len(insert), 0x7f)
+			res = append(res, byte(n))
+			res = append(res, insert[:n]...)
+			insert = insert[n:]
+		}
+	}
+
+	for i := 0; i < len(target); {
+		off, ok := -1, false
+		if i+deltaBlockSize <= len(target) {
+			off, ok = index[string(target[i:i+deltaBlockSize])]
+		}
+		if !ok {
+			insert = append(insert, target[i])
+			i++
+			continue
+		}
+
+		size := deltaBlockSize
+		for off+size < len(base) && i+size < len(target) && base[off+size] == target[i+size] && size < 0xffffff {
+			size++
+		}
+		flush()
+		res = append(res, encodeDeltaCopy(off, size)...)
+		i += size
+	}
+	flush()
+	return res
+}
+
+func encodeDeltaCopy(off, size int) []byte {
+	op := byte(0x80)
+	args := []byte{}
+	for i := 0; i < 4; i++ {
+		if b := byte(off >> (8 * i)); b != 0 {
+			op |= 1 << i
+			args = append(args, b)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if b := byte(size >> (8 * i)); b != 0 {
+			op |= 1 << (4 + i)
+			args = append(args, b)
+		}
+	}
+	return append([]byte{op}, args...)
+}
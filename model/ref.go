@@ -1,67 +1,243 @@
 package model
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/ignorantshr/mgit/util"
 )
 
-func GetRefSha(repo *Repository, ref string) string {
-	p, err := repo.RepoFile(false, ref)
-	if err != nil {
-		util.PanicErr(err)
+// git gc/clone 会把引用打包到 packed-refs 中，loose ref 优先
+const packedRefsFile = "packed-refs"
+
+// 与 git 的 core.filesRefLockTimeout 默认值相同，ref 被锁定时短暂重试
+const refLockTimeout = 100 * time.Millisecond
+
+// 解析 ref（跟随 "ref: " 符号引用），ref 不存在时返回空字符串
+func GetRefSha(repo *Repository, ref string) (string, error) {
+	// 内存仓库没有 refs
+	if repo.gitdir == "" {
+		return "", nil
 	}
 
+	ref = strings.TrimPrefix(path.Clean(ref), "/")
+	p := repo.repoPath(ref)
 	if !util.IsFile(p) {
-		return ""
+		if !strings.HasPrefix(ref, "refs/") {
+			return "", nil
+		}
+		packed, err := readPackedRefs(repo)
+		if err != nil {
+			return "", err
+		}
+		return packed[ref], nil
 	}
 
 	raw, err := os.ReadFile(p)
 	if err != nil {
-		util.PanicErr(err)
+		return "", err
 	}
 	data := strings.TrimSpace(string(raw))
 	if strings.HasPrefix(data, "ref: ") {
 		return GetRefSha(repo, data[5:])
 	}
-	return data
+	return data, nil
+}
+
+// 读取 packed-refs，返回 ref 全名 -> sha，忽略注释和 peeled 行（^ 开头）
+func readPackedRefs(repo *Repository) (map[string]string, error) {
+	res := make(map[string]string)
+	raw, err := os.ReadFile(repo.repoPath(packedRefsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if ok {
+			res[name] = sha
+		}
+	}
+	return res, scanner.Err()
 }
 
-func ListRef(repo *Repository, p string) map[string]any {
-	if p == "" {
-		var err error
-		p, err = repo.repoDir(false, "refs")
-		util.PanicErr(err)
+// p 为空时列出 refs 下的所有引用（包括 packed-refs 中的），否则只列出目录 p 下的 loose ref
+func ListRef(repo *Repository, p string) (map[string]any, error) {
+	if p != "" {
+		return listRefDir(repo, p)
+	}
+
+	dir, err := repo.repoDir(false, "refs")
+	if err != nil {
+		return nil, err
+	}
+	res, err := listRefDir(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := readPackedRefs(repo)
+	if err != nil {
+		return nil, err
+	}
+	for name, sha := range packed {
+		parts := strings.Split(strings.TrimPrefix(name, "refs/"), "/")
+		m := res
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := m[part].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				m[part] = sub
+			}
+			m = sub
+		}
+		if _, ok := m[parts[len(parts)-1]]; !ok {
+			m[parts[len(parts)-1]] = sha
+		}
 	}
+	return res, nil
+}
 
+func listRefDir(repo *Repository, p string) (map[string]any, error) {
 	entries, err := os.ReadDir(p)
 	if err != nil {
-		util.PanicErr(err)
+		return nil, err
 	}
 
 	res := make(map[string]any)
 	for _, v := range entries {
+		// 其他进程正在更新的 ref 留下的 lock 文件，不是 ref
+		if strings.HasSuffix(v.Name(), lockSuffix) {
+			continue
+		}
 		can := path.Join(p, v.Name())
 		if util.IsDir(can) {
-			res[v.Name()] = ListRef(repo, can)
+			res[v.Name()], err = listRefDir(repo, can)
 		} else {
-			can, _ = strings.CutPrefix(can, repo.gitdir)
-			res[v.Name()] = GetRefSha(repo, can)
+			can, _ = strings.CutPrefix(can, repo.commondir)
+			res[v.Name()], err = GetRefSha(repo, can)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
-	return res
+	return res, nil
 }
 
-func CreateRef(repo *Repository, name, sha string) {
+// name 为 refs/ 下的相对路径，例如 heads/master
+func CreateRef(repo *Repository, name, sha string) error {
 	fnm, err := repo.RepoFile(false, "refs/"+name)
 	if err != nil {
-		util.PanicErr(err)
+		return err
 	}
+	return writeFileLocked(fnm, []byte(sha+"\n"), refLockTimeout)
+}
 
-	err = os.WriteFile(fnm, []byte(sha), 0644)
+// 把 ref（全名，例如 refs/heads/master，或者 detached 的 HEAD）更新为 sha，
+// 持有 lock 时检查 ref 当前的值是否为 old（为空表示 ref 不存在），避免覆盖其他进程的更新
+func UpdateRef(repo *Repository, ref, sha, old string) error {
+	fnm, err := repo.RepoFile(false, ref)
+	if err != nil {
+		return err
+	}
+	l, err := AcquireLock(fnm, refLockTimeout)
 	if err != nil {
-		util.PanicErr(err)
+		return fmt.Errorf("cannot lock ref '%s': %w", ref, err)
+	}
+	defer l.Rollback()
+
+	cur, err := GetRefSha(repo, ref)
+	if err != nil {
+		return err
+	}
+	if cur != old {
+		if old == "" {
+			return fmt.Errorf("cannot lock ref '%s': reference already exists", ref)
+		}
+		return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", ref, cur, old)
+	}
+	if _, err := l.Write([]byte(sha + "\n")); err != nil {
+		return err
+	}
+	return l.Commit()
+}
+
+// 删除 loose ref，并从 packed-refs 中移除，name 与 CreateRef 相同
+func DeleteRef(repo *Repository, name string) error {
+	ref := "refs/" + name
+	fnm, err := repo.RepoFile(false, ref)
+	if err != nil {
+		return err
+	}
+	l, err := AcquireLock(fnm, refLockTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot lock ref '%s': %w", ref, err)
+	}
+	defer l.Rollback()
+
+	// 先从 packed-refs 中删除，否则删除 loose ref 后会短暂地露出旧值
+	if err := removePackedRef(repo, ref); err != nil {
+		return err
+	}
+	if err := os.Remove(fnm); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func removePackedRef(repo *Repository, ref string) error {
+	p := repo.repoPath(packedRefsFile)
+	l, err := AcquireLock(p, refLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Rollback()
+
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	removed, skipPeeled := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if skipPeeled && strings.HasPrefix(line, "^") {
+			continue
+		}
+		skipPeeled = false
+		if _, n, ok := strings.Cut(line, " "); ok && line[0] != '#' && n == ref {
+			removed, skipPeeled = true, true
+			continue
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !removed {
+		return nil
+	}
+
+	if _, err := l.Write(buf.Bytes()); err != nil {
+		return err
 	}
+	return l.Commit()
 }
@@ -5,29 +5,69 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/ignorantshr/mgit/util"
-	"github.com/spf13/viper"
 )
 
-const GitDir = ".mgit"
+const (
+	GitDir       = ".mgit"
+	CompatGitDir = ".git" // 兼容模式直接使用 git 的仓库目录
+)
+
+// 指定仓库目录和 worktree 的环境变量，对应 --git-dir 和 --work-tree
+const (
+	EnvDir      = "MGIT_DIR"
+	EnvWorkTree = "MGIT_WORK_TREE"
+)
 
 type Repository struct {
-	worktree string
-	gitdir   string
-	conf     *viper.Viper
+	worktree  string
+	gitdir    string
+	commondir string // linked worktree 共享的主仓库目录，其他情况下与 gitdir 相同
+	conf      *Config
+	compat    bool // 操作标准的 .git 仓库，配置文件为 config 而不是 conf
+
+	objectFormat string // extensions.objectFormat, sha1 or sha256
+
+	objects ObjectStore // see Objects
+	loose   *LooseStore // on-disk backends of the default store, nil for other stores
+	pack    *PackStore
+
+	graph       *CommitGraph // see commitGraph
+	graphLoaded bool
 }
 
-func CreateRepository(p string) (*Repository, error) {
-	repo := newRepository(p, true)
+// compat 为 true 时创建 git 可以直接使用的 .git 仓库；
+// bare 为 true 时 p 本身就是仓库目录，没有 worktree 和 index
+func CreateRepository(p string, objectFormat string, compat, bare bool) (*Repository, error) {
+	if objectFormat == "" {
+		objectFormat = ObjectFormatSHA1
+	}
+	if err := checkObjectFormat(objectFormat); err != nil {
+		return nil, err
+	}
 
-	stat, err := os.Stat(repo.worktree)
+	worktree, gitdir := p, path.Join(p, GitDir)
+	if compat {
+		gitdir = path.Join(p, CompatGitDir)
+	}
+	if bare {
+		worktree, gitdir = "", p
+	}
+	repo, err := newRepository(worktree, gitdir, compat, true)
+	if err != nil {
+		return nil, err
+	}
+	repo.objectFormat = objectFormat
+
+	stat, err := os.Stat(p)
 	if err != nil {
 		return nil, err
 	}
 
 	if !stat.IsDir() {
-		return nil, fmt.Errorf("%s is not a directory", repo.worktree)
+		return nil, fmt.Errorf("%s is not a directory", p)
 	}
 
 	if dir, err := os.ReadDir(repo.gitdir); err != nil {
@@ -56,61 +96,181 @@ func CreateRepository(p string) (*Repository, error) {
 	defer f.Close()
 	f.WriteString("ref: refs/heads/master\n")
 
-	f2, err := os.OpenFile(repo.repoPath("conf"), os.O_CREATE|os.O_WRONLY, 0644)
+	f2, err := os.OpenFile(repo.repoPath(repo.configFile()), os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 	defer f2.Close()
+	// 非 sha1 的仓库需要 repositoryformatversion = 1 才能声明 extensions
+	version := 0
+	if objectFormat != ObjectFormatSHA1 {
+		version = 1
+	}
 	f2.WriteString("[core]\n")
-	f2.WriteString("repositoryformatversion = 0\n")
-	f2.WriteString("filemode = false\n")
-	f2.WriteString("bare = false\n")
+	f2.WriteString(fmt.Sprintf("\trepositoryformatversion = %d\n", version))
+	f2.WriteString(fmt.Sprintf("\tfilemode = %v\n", probeFileMode(repo.gitdir)))
+	f2.WriteString(fmt.Sprintf("\tbare = %v\n", bare))
+	if !probeSymlinks(repo.gitdir) {
+		f2.WriteString("\tsymlinks = false\n")
+	}
+	if version == 1 {
+		f2.WriteString("[extensions]\n")
+		f2.WriteString(fmt.Sprintf("\tobjectformat = %s\n", objectFormat))
+	}
+	if err := f2.Close(); err != nil {
+		return nil, err
+	}
 
+	// 重新读取刚写入的配置
+	if repo.conf, err = LoadConfig(repo); err != nil {
+		return nil, err
+	}
 	return repo, nil
 }
 
-func newRepository(p string, force bool) *Repository {
-	r := &Repository{}
-	r.worktree = p
-	r.gitdir = path.Join(p, GitDir)
+// 与 git init 相同，检查文件系统能否记录可执行位
+func probeFileMode(dir string) bool {
+	f, err := os.CreateTemp(dir, "probe")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return false
+	}
+	stat, err := os.Lstat(f.Name())
+	return err == nil && stat.Mode().Perm()&0100 != 0
+}
+
+// 检查文件系统能否创建符号链接
+func probeSymlinks(dir string) bool {
+	p := path.Join(dir, "probe-symlink")
+	if err := os.Symlink("target", p); err != nil {
+		return false
+	}
+	os.Remove(p)
+	return true
+}
+
+// worktree 为空时是 bare 仓库
+func newRepository(worktree, gitdir string, compat, force bool) (*Repository, error) {
+	r := &Repository{compat: compat}
+	r.worktree = worktree
+	r.gitdir = gitdir
+	r.commondir = gitdir
 
 	fileinfo, err := os.Stat(r.gitdir)
 
 	if !force && (os.IsNotExist(err) || !fileinfo.IsDir()) {
-		util.PanicErr(fmt.Errorf("%s/{%v} not a Git repository", p, fileinfo))
+		return nil, fmt.Errorf("%w: %s", ErrNotARepository, gitdir)
 	}
 
-	cf, err := r.RepoFile(false, "conf")
-	if err != nil {
-		util.PanicErr(err)
-	}
-	_, err = os.Stat(cf)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return r
+	if force {
+		if err := os.MkdirAll(r.gitdir, 0755); err != nil {
+			return nil, err
 		}
-		util.PanicErr(err)
-	}
-
-	r.conf = viper.New()
-	r.conf.SetConfigName("conf")
-	r.conf.SetConfigType("ini")
-	r.conf.AddConfigPath(r.gitdir)
-	if err := r.conf.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok && !force {
-			util.PanicErr(fmt.Errorf("%s/conf file not found", GitDir))
-		} else {
-			util.PanicErr(err)
+	}
+
+	// linked worktree 的 commondir 文件指向主仓库目录，相对路径基于 gitdir
+	if raw, err := os.ReadFile(path.Join(r.gitdir, commonDirFile)); err == nil {
+		common := strings.TrimSpace(string(raw))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(r.gitdir, common)
 		}
+		r.commondir = filepath.Clean(common)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if r.conf, err = LoadConfig(r); err != nil {
+		return nil, err
 	}
 
 	if !force {
-		if vers := r.conf.GetInt("core.repositoryformatversion"); vers != 0 {
-			util.PanicErr(fmt.Errorf("unsupported repositoryformatversion %d", vers))
+		vers, err := r.conf.GetInt("core.repositoryformatversion", 0)
+		if err != nil {
+			return nil, err
+		}
+		switch vers {
+		case 0:
+		case 1:
+			// extensions 只在 version 1 中生效
+			if format, ok := r.conf.Get("extensions.objectformat"); ok {
+				if err := checkObjectFormat(format); err != nil {
+					return nil, err
+				}
+				r.objectFormat = format
+			}
+		default:
+			return nil, fmt.Errorf("unsupported repositoryformatversion %d", vers)
+		}
+
+		// core.bare 和 core.worktree 描述的是主 worktree，linked worktree 不受影响
+		if r.IsLinked() {
+			return r, nil
+		}
+
+		// core.bare = true 的仓库即使在 .mgit 目录中也没有 worktree
+		if bare, err := r.conf.GetBool("core.bare", false); err != nil {
+			return nil, err
+		} else if bare {
+			r.worktree = ""
+		}
+		// core.worktree 把 worktree 放在仓库目录之外，相对路径基于仓库目录
+		if wt, ok := r.conf.Get("core.worktree"); ok && wt != "" {
+			if !filepath.IsAbs(wt) {
+				wt = filepath.Join(r.gitdir, wt)
+			}
+			r.worktree = filepath.Clean(wt)
 		}
 	}
 
-	return r
+	return r, nil
+}
+
+// 是否为兼容模式的 .git 仓库
+func (r *Repository) Compat() bool {
+	return r.compat
+}
+
+// bare 仓库没有 worktree 和 index
+func (r *Repository) IsBare() bool {
+	return r.worktree == ""
+}
+
+// 需要 worktree 的命令先检查
+func (r *Repository) CheckWorktree() error {
+	if r.IsBare() {
+		return fmt.Errorf("%w: %s", ErrNoWorktree, r.gitdir)
+	}
+	return nil
+}
+
+// 仓库配置文件的名称
+func (r *Repository) configFile() string {
+	if r.compat {
+		return "config"
+	}
+	return "conf"
+}
+
+// 合并了所有 scope 的配置
+func (r *Repository) Config() *Config {
+	if r == nil || r.conf == nil {
+		return &Config{}
+	}
+	return r.conf
+}
+
+// core.filemode：文件系统的可执行位是否可信，为 false 时 add 沿用 index 中已有的 mode
+func (r *Repository) FileMode() (bool, error) {
+	return r.Config().GetBool("core.filemode", true)
+}
+
+// core.symlinks：为 false 时符号链接检出为内容是链接目标的普通文件
+func (r *Repository) Symlinks() (bool, error) {
+	return r.Config().GetBool("core.symlinks", true)
 }
 
 func (r *Repository) Worktree() string {
@@ -127,11 +287,36 @@ func (r *Repository) GitDir() string {
 
 func (r *Repository) SetGitDir(p string) {
 	r.gitdir = p
+	r.commondir = p
+}
+
+// objects、refs、config 等共享数据所在的目录
+func (r *Repository) CommonDir() string {
+	return r.commondir
+}
+
+// 是否为 linked worktree（mgit worktree add 创建）
+func (r *Repository) IsLinked() bool {
+	return r.commondir != r.gitdir
+}
+
+// 每个 worktree 独有的文件，其余的都在 commondir 中
+var perWorktreeFiles = map[string]bool{
+	"HEAD":            true,
+	"ORIG_HEAD":       true,
+	"COMMIT_EDITMSG":  true,
+	"index":           true,
+	"conf.worktree":   true,
+	"config.worktree": true,
 }
 
 // 组装成 .git/** 文件字符串
 func (r *Repository) repoPath(paths ...string) string {
-	return path.Join(r.gitdir, path.Join(paths...))
+	p := path.Join(paths...)
+	if first, _, _ := strings.Cut(p, "/"); r.IsLinked() && !perWorktreeFiles[first] {
+		return path.Join(r.commondir, p)
+	}
+	return path.Join(r.gitdir, p)
 }
 
 // 组装 .git/** 文件字符串，如果父目录缺失则创建目录结构
@@ -149,23 +334,102 @@ func (r *Repository) repoDir(mkdir bool, paths ...string) (string, error) {
 	return p, os.MkdirAll(p, 0755)
 }
 
-func FindRepo(p string) *Repository {
-	if p == "" {
-		p = "."
+// 从 p 开始向上查找仓库，找不到时返回 ErrNotARepository。
+// 从当前目录（p 为 "." 或空）查找时，MGIT_DIR 和 MGIT_WORK_TREE 优先
+func FindRepo(p string) (*Repository, error) {
+	if p != "" && p != "." {
+		return findRepo(p)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	var repo *Repository
+	if gitdir := os.Getenv(EnvDir); gitdir != "" {
+		repo, err = openGitDir(gitdir, cwd)
+	} else {
+		repo, err = findRepo(cwd)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if wt := os.Getenv(EnvWorkTree); wt != "" {
+		if repo.worktree, err = filepath.Abs(wt); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// MGIT_DIR 指定的仓库目录，没有配置 core.worktree 时当前目录就是 worktree 的根目录（与 git 相同）
+func openGitDir(gitdir, cwd string) (*Repository, error) {
+	gitdir, err := filepath.Abs(gitdir)
+	if err != nil {
+		return nil, err
+	}
+	ok, compat := isGitDir(gitdir)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotARepository, gitdir)
 	}
-	if p == "." {
-		var err error
-		p, err = os.Getwd()
-		util.PanicErr(err)
+	return newRepository(cwd, gitdir, compat, false)
+}
+
+func findRepo(p string) (*Repository, error) {
+	for _, name := range []string{GitDir, CompatGitDir} { // 没有 .mgit 时使用 git 的仓库
+		compat := name == CompatGitDir
+		dot := path.Join(p, name)
+		if util.IsDir(dot) {
+			return newRepository(p, dot, compat, false)
+		}
+		// linked worktree 中是一个指向仓库目录的文件
+		if util.IsFile(dot) {
+			gitdir, err := readGitFile(dot)
+			if err != nil {
+				return nil, err
+			}
+			return newRepository(p, gitdir, compat, false)
+		}
 	}
-	if util.IsDir(path.Join(p, GitDir)) {
-		return newRepository(p, false)
+	if ok, compat := isGitDir(p); ok {
+		return newRepository("", p, compat, false) // bare
 	}
 
 	pp := filepath.Dir(p)
-	if pp == "/" {
-		util.PanicErr(fmt.Errorf("no git directory"))
+	if pp == p {
+		return nil, fmt.Errorf("%w (or any of the parent directories)", ErrNotARepository)
 	}
 
-	return FindRepo(pp)
+	return findRepo(pp)
+}
+
+// p 本身是否为仓库目录：有 HEAD、objects 和 refs，以及配置文件（config 说明是 git 的仓库）
+func isGitDir(p string) (bool, bool) {
+	if !util.IsFile(path.Join(p, "HEAD")) || !util.IsDir(path.Join(p, "objects")) || !util.IsDir(path.Join(p, "refs")) {
+		return false, false
+	}
+	if util.IsFile(path.Join(p, "conf")) {
+		return true, false
+	}
+	if util.IsFile(path.Join(p, "config")) {
+		return true, true
+	}
+	return false, false
+}
+
+// 解析 "gitdir: <path>" 格式的 .mgit 文件，相对路径基于文件所在目录
+func readGitFile(file string) (string, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	gitdir, ok := strings.CutPrefix(strings.TrimSpace(string(raw)), "gitdir: ")
+	if !ok {
+		return "", fmt.Errorf("%w: invalid gitfile format: %s", ErrNotARepository, file)
+	}
+	if !filepath.IsAbs(gitdir) {
+		gitdir = filepath.Join(filepath.Dir(file), gitdir)
+	}
+	return filepath.Clean(gitdir), nil
 }
@@ -0,0 +1,378 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ignorantshr/mgit/util"
+)
+
+/*
+linked worktree：与 git 的布局相同，主仓库的 worktrees/<name> 目录中保存该 worktree 的
+HEAD、index，以及
+  - gitdir：指回 worktree 中 .mgit 文件的绝对路径，文件不存在时该 worktree 可以被 prune
+  - commondir：主仓库目录的相对路径（../..），objects、refs、config 都从这里读取
+  - locked：存在时不会被 prune 和 remove，内容为原因
+worktree 根目录下的 .mgit 是一个文件，内容为 "gitdir: <主仓库>/worktrees/<name>"
+*/
+
+const (
+	worktreesDir  = "worktrees"
+	commonDirFile = "commondir"
+	gitDirFile    = "gitdir"
+	lockedFile    = "locked"
+)
+
+type WorktreeInfo struct {
+	Path     string // worktree 的根目录，bare 仓库为仓库目录
+	GitDir   string // 主 worktree 为仓库目录，linked worktree 为 worktrees/<name>
+	Name     string // linked worktree 的名称，主 worktree 为空
+	Head     string // HEAD 的 sha，空仓库为空
+	Branch   string // 检出的分支，detached HEAD 时为空
+	Bare     bool
+	Locked   bool
+	Reason   string // 锁定的原因
+	Prunable string // 可以被 prune 的原因，为空时不能 prune
+}
+
+func (w *WorktreeInfo) IsMain() bool {
+	return w.Name == ""
+}
+
+// 列出主 worktree 和所有 linked worktree，主 worktree 在第一个
+func ListWorktrees(repo *Repository) ([]*WorktreeInfo, error) {
+	main, err := mainWorktree(repo)
+	if err != nil {
+		return nil, err
+	}
+	res := []*WorktreeInfo{main}
+
+	entries, err := os.ReadDir(path.Join(repo.commondir, worktreesDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, v := range entries {
+		if !v.IsDir() {
+			continue
+		}
+		wt, err := readWorktree(repo, v.Name())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, wt)
+	}
+	return res, nil
+}
+
+// 主 worktree 的目录：core.worktree，或者 .mgit 所在的目录；两者都没有时为 bare 仓库
+func mainWorktree(repo *Repository) (*WorktreeInfo, error) {
+	wt := &WorktreeInfo{Path: repo.commondir, GitDir: repo.commondir}
+	if !repo.IsLinked() {
+		wt.Path, wt.Bare = repo.worktree, repo.IsBare()
+	} else if bare, err := repo.Config().GetBool("core.bare", false); err != nil {
+		return nil, err
+	} else if bare {
+		wt.Bare = true
+	} else if p, ok := repo.Config().Get("core.worktree"); ok && p != "" {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(repo.commondir, p)
+		}
+		wt.Path = filepath.Clean(p)
+	} else if base := filepath.Base(repo.commondir); base == GitDir || base == CompatGitDir {
+		wt.Path = filepath.Dir(repo.commondir)
+	} else {
+		wt.Bare = true
+	}
+	if wt.Bare {
+		wt.Path = repo.commondir
+	}
+
+	var err error
+	if wt.Head, wt.Branch, err = readWorktreeHead(repo, path.Join(wt.GitDir, "HEAD")); err != nil {
+		return nil, err
+	}
+	return wt, nil
+}
+
+func readWorktree(repo *Repository, name string) (*WorktreeInfo, error) {
+	admin := path.Join(repo.commondir, worktreesDir, name)
+	wt := &WorktreeInfo{GitDir: admin, Name: name}
+
+	if raw, err := os.ReadFile(path.Join(admin, lockedFile)); err == nil {
+		wt.Locked, wt.Reason = true, strings.TrimSpace(string(raw))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(path.Join(admin, gitDirFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		wt.Prunable = "gitdir file does not exist"
+		return wt, nil
+	}
+	dotGit := strings.TrimSpace(string(raw))
+	wt.Path = filepath.Dir(dotGit)
+	if !util.IsFileExist(dotGit) {
+		wt.Prunable = "gitdir file points to non-existent location"
+	}
+
+	if wt.Head, wt.Branch, err = readWorktreeHead(repo, path.Join(admin, "HEAD")); err != nil {
+		return nil, err
+	}
+	return wt, nil
+}
+
+// 读取其他 worktree 的 HEAD 文件，ref 通过 repo 的 commondir 解析
+func readWorktreeHead(repo *Repository, file string) (string, string, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	head := strings.TrimSpace(string(raw))
+	ref, ok := strings.CutPrefix(head, "ref: ")
+	if !ok {
+		return head, "", nil
+	}
+	sha, err := GetRefSha(repo, ref)
+	return sha, strings.TrimPrefix(ref, BranchDir), err
+}
+
+// 按路径或名称查找 worktree
+func FindWorktree(repo *Repository, p string) (*WorktreeInfo, error) {
+	worktrees, err := ListWorktrees(repo)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, wt := range worktrees {
+		if wt.Path == abs {
+			return wt, nil
+		}
+	}
+	for _, wt := range worktrees {
+		if wt.Name != "" && wt.Name == p {
+			return wt, nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' is not a working tree", p)
+}
+
+// 检出了 branch 的 worktree，没有时返回 nil
+func WorktreeOfBranch(repo *Repository, branch string) (*WorktreeInfo, error) {
+	worktrees, err := ListWorktrees(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, wt := range worktrees {
+		if !wt.Bare && wt.Branch == branch {
+			return wt, nil
+		}
+	}
+	return nil, nil
+}
+
+// 在 dest 创建 linked worktree，head 为 HEAD 文件的内容（"ref: refs/heads/<branch>" 或 sha）。
+// 创建管理目录和 .mgit 文件之后调用 checkout 检出文件、生成 index；
+// 任何一步失败都会删除管理目录，以及本次创建的 dest
+func AddWorktree(repo *Repository, dest, head string, checkout func(wt *Repository) error) (wt *Repository, err error) {
+	if dest, err = filepath.Abs(dest); err != nil {
+		return nil, err
+	}
+	dotGit := path.Join(dest, GitDir)
+	if repo.compat {
+		dotGit = path.Join(dest, CompatGitDir)
+	}
+
+	// 名称取目录名，重名时加数字后缀
+	base := strings.Map(func(r rune) rune {
+		if r == ' ' || r == ':' || r == '*' || r == '?' || r == '[' || r == '\\' {
+			return '-'
+		}
+		return r
+	}, filepath.Base(dest))
+	name := base
+	for i := 1; util.IsFileExist(path.Join(repo.commondir, worktreesDir, name)); i++ {
+		name = base + strconv.Itoa(i)
+	}
+	admin := path.Join(repo.commondir, worktreesDir, name)
+	// dest 原来是空目录时只清空，不删除目录本身
+	createdDest := !util.IsFileExist(dest)
+	emptyDest := util.IsDir(dest) && util.IsDirEmpty(dest)
+	defer func() {
+		if err == nil {
+			return
+		}
+		os.RemoveAll(admin)
+		if createdDest {
+			os.RemoveAll(dest)
+		} else if emptyDest {
+			entries, _ := os.ReadDir(dest)
+			for _, e := range entries {
+				os.RemoveAll(path.Join(dest, e.Name()))
+			}
+		}
+	}()
+	if err := os.MkdirAll(admin, 0755); err != nil {
+		return nil, err
+	}
+
+	// 创建过程中加锁，避免被并发的 prune 清理
+	if err := os.WriteFile(path.Join(admin, lockedFile), []byte("initializing\n"), 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(path.Join(admin, lockedFile))
+
+	files := [][2]string{
+		{path.Join(admin, "HEAD"), head + "\n"},
+		{path.Join(admin, commonDirFile), "../..\n"},
+		{path.Join(admin, gitDirFile), dotGit + "\n"},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(f[0], []byte(f[1]), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(dotGit, []byte("gitdir: "+admin+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if wt, err = newRepository(dest, admin, repo.compat, false); err != nil {
+		return nil, err
+	}
+	if err := checkout(wt); err != nil {
+		return nil, err
+	}
+	return wt, nil
+}
+
+// 删除 linked worktree 的文件和管理目录
+func RemoveWorktree(wt *WorktreeInfo) error {
+	if wt.IsMain() {
+		return errors.New("'" + wt.Path + "' is a main working tree")
+	}
+	if wt.Path != "" {
+		if err := os.RemoveAll(wt.Path); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(wt.GitDir)
+}
+
+// 清理 worktree 目录已经不存在的管理目录，跳过锁定的；dryRun 时只返回要清理的 worktree
+func PruneWorktrees(repo *Repository, dryRun bool) ([]*WorktreeInfo, error) {
+	worktrees, err := ListWorktrees(repo)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []*WorktreeInfo{}
+	for _, wt := range worktrees {
+		if wt.IsMain() || wt.Locked || wt.Prunable == "" {
+			continue
+		}
+		if !dryRun {
+			if err := os.RemoveAll(wt.GitDir); err != nil {
+				return nil, err
+			}
+		}
+		pruned = append(pruned, wt)
+	}
+
+	// 与 git 一样，worktrees 为空时删除该目录
+	if !dryRun {
+		dir := path.Join(repo.commondir, worktreesDir)
+		if util.IsDir(dir) && util.IsDirEmpty(dir) {
+			os.Remove(dir)
+		}
+	}
+	return pruned, nil
+}
+
+func LockWorktree(wt *WorktreeInfo, reason string) error {
+	if wt.IsMain() {
+		return errors.New("the main working tree cannot be locked or unlocked")
+	}
+	if wt.Locked {
+		if wt.Reason != "" {
+			return fmt.Errorf("'%s' is already locked, reason: %s", wt.Path, wt.Reason)
+		}
+		return fmt.Errorf("'%s' is already locked", wt.Path)
+	}
+	if reason != "" {
+		reason += "\n"
+	}
+	return os.WriteFile(path.Join(wt.GitDir, lockedFile), []byte(reason), 0644)
+}
+
+func UnlockWorktree(wt *WorktreeInfo) error {
+	if wt.IsMain() {
+		return errors.New("the main working tree cannot be locked or unlocked")
+	}
+	if !wt.Locked {
+		return fmt.Errorf("'%s' is not locked", wt.Path)
+	}
+	return os.Remove(path.Join(wt.GitDir, lockedFile))
+}
+
+// 其他 linked worktree 的 HEAD 和 index 也是 gc、fsck 的根，返回 [名称, sha]
+func linkedWorktreeRoots(repo *Repository) ([][2]string, error) {
+	worktrees, err := ListWorktrees(repo)
+	if err != nil {
+		return nil, err
+	}
+	roots := [][2]string{}
+	for _, wt := range worktrees {
+		// 当前 worktree 的 HEAD 和 index 由调用方处理
+		if wt.IsMain() || wt.GitDir == repo.gitdir {
+			continue
+		}
+		prefix := path.Join(worktreesDir, wt.Name)
+		if wt.Head != "" {
+			roots = append(roots, [2]string{prefix + "/HEAD", wt.Head})
+		}
+
+		other := *repo
+		other.gitdir, other.worktree = wt.GitDir, wt.Path
+		index, err := ReadIndex(&other)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, indexRoots(index, prefix+" ")...)
+	}
+
+	// 从 linked worktree 运行时主 worktree 的也要算上
+	if repo.IsLinked() {
+		main := worktrees[0]
+		if main.Head != "" {
+			roots = append(roots, [2]string{"HEAD", main.Head})
+		}
+		if !main.Bare {
+			other := *repo
+			other.gitdir, other.worktree = repo.commondir, main.Path
+			index, err := ReadIndex(&other)
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, indexRoots(index, "")...)
+		}
+	}
+	return roots, nil
+}
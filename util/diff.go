@@ -0,0 +1,177 @@
+package util
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+按行比较两个文本，使用线性空间的 Myers 算法（An O(ND) Difference Algorithm and Its Variations 第 4 节）：
+从两端同时在编辑图上按编辑距离 d 逐层扩展，V[k] 记录对角线 k 上能到达的最远的 x，
+两个方向相遇处的 snake 把问题分成前后两半，递归求解。只需要 O(N+M) 的内存
+*/
+
+// 正确的输入总能找到中间的 snake，找不到说明算法有错误
+var errMiddleSnake = errors.New("diff: middle snake not found")
+
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffDelete
+	DiffInsert
+)
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string // 包括结尾的换行符，文件的最后一行可能没有
+}
+
+// 按行切分，保留每行结尾的换行符
+func SplitLines(s string) []string {
+	lines := []string{}
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i == -1 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// 把 a 变成 b 的最短编辑序列，删除排在插入之前
+func DiffLines(a, b []string) ([]DiffLine, error) {
+	res, err := myers(a, b, make([]DiffLine, 0, len(a)+len(b)))
+	if err != nil {
+		return nil, err
+	}
+	return reorderChanges(res), nil
+}
+
+// 把 a 变成 b 的编辑序列追加到 res 后面
+func myers(a, b []string, res []DiffLine) ([]DiffLine, error) {
+	// 去掉相同的开头和结尾之后，a、b 都不为空时编辑距离至少为 2，中间的 snake 会把问题分成两个更小的部分
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		res = append(res, DiffLine{DiffEqual, a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if len(a) == 0 || len(b) == 0 {
+		for _, line := range a {
+			res = append(res, DiffLine{DiffDelete, line})
+		}
+		for _, line := range b {
+			res = append(res, DiffLine{DiffInsert, line})
+		}
+	} else {
+		x, y, u, v, err := middleSnake(a, b)
+		if err != nil {
+			return nil, err
+		}
+		if res, err = myers(a[:x], b[:y], res); err != nil {
+			return nil, err
+		}
+		for _, line := range a[x:u] {
+			res = append(res, DiffLine{DiffEqual, line})
+		}
+		if res, err = myers(a[u:], b[v:], res); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, line := range tail {
+		res = append(res, DiffLine{DiffEqual, line})
+	}
+	return res, nil
+}
+
+// 最短编辑路径中间的 snake，从 (x, y) 沿对角线到 (u, v)。
+// 反向搜索在 a、b 倒序后的编辑图上进行，正向的对角线 k 对应反向的对角线 delta-k
+func middleSnake(a, b []string) (x, y, u, v int, err error) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1 // 对角线 k 的取值范围为 [-max-1, max+1]
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || k != d && vf[offset+k-1] < vf[offset+k+1] {
+				x = vf[offset+k+1] // 从 k+1 向下走：插入
+			} else {
+				x = vf[offset+k-1] + 1 // 从 k-1 向右走：删除
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u, v = u+1, v+1
+			}
+			vf[offset+k] = u
+			// delta 为奇数时在正向搜索中相遇，反向已经完成了第 d-1 层
+			if kr := delta - k; odd && kr >= -(d-1) && kr <= d-1 && u+vb[offset+kr] >= n {
+				return x, y, u, v, nil
+			}
+		}
+		for kr := -d; kr <= d; kr += 2 {
+			var xr int
+			if kr == -d || kr != d && vb[offset+kr-1] < vb[offset+kr+1] {
+				xr = vb[offset+kr+1]
+			} else {
+				xr = vb[offset+kr-1] + 1
+			}
+			yr := xr - kr
+			ur, vr := xr, yr
+			for ur < n && vr < m && a[n-1-ur] == b[m-1-vr] {
+				ur, vr = ur+1, vr+1
+			}
+			vb[offset+kr] = ur
+			// delta 为偶数时在反向搜索中相遇，正向已经完成了第 d 层
+			if k := delta - kr; !odd && k >= -d && k <= d && ur+vf[offset+k] >= n {
+				return n - ur, m - vr, n - xr, m - yr, nil
+			}
+		}
+	}
+	return 0, 0, 0, 0, errMiddleSnake
+}
+
+// 把相邻的插入和删除整理成先删除后插入
+func reorderChanges(res []DiffLine) []DiffLine {
+	for i := 0; i < len(res); {
+		if res[i].Op == DiffEqual {
+			i++
+			continue
+		}
+		j := i
+		for j < len(res) && res[j].Op != DiffEqual {
+			j++
+		}
+		changes := res[i:j]
+		ordered := make([]DiffLine, 0, len(changes))
+		for _, l := range changes {
+			if l.Op == DiffDelete {
+				ordered = append(ordered, l)
+			}
+		}
+		for _, l := range changes {
+			if l.Op == DiffInsert {
+				ordered = append(ordered, l)
+			}
+		}
+		copy(changes, ordered)
+		i = j
+	}
+	return res
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"a\n\nb\n", []string{"a\n", "\n", "b\n"}},
+	}
+	for _, tt := range tests {
+		if got := SplitLines(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 用 "=a -b +c" 这样的形式表示编辑序列，方便比较
+func formatDiff(diff []DiffLine) string {
+	parts := []string{}
+	for _, l := range diff {
+		parts = append(parts, string("=-+"[l.Op])+strings.TrimSuffix(l.Text, "\n"))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"old empty", "", "a\nb\n", "+a +b"},
+		{"new empty", "a\nb\n", "", "-a -b"},
+		{"identical", "a\nb\n", "a\nb\n", "=a =b"},
+		{"insert in middle", "a\nc\n", "a\nb\nc\n", "=a +b =c"},
+		{"delete in middle", "a\nb\nc\n", "a\nc\n", "=a -b =c"},
+		{"delete before insert", "a\nb\nc\n", "a\nx\nc\n", "=a -b +x =c"},
+		{"replace all", "a\nb\n", "x\ny\n", "-a -b +x +y"},
+		{"missing trailing newline", "a\nb", "a\nb\n", "=a -b +b"},
+		{"add trailing line without newline", "a\n", "a\nb", "=a +b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff, err := DiffLines(SplitLines(tt.a), SplitLines(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := formatDiff(diff)
+			if got != tt.want {
+				t.Errorf("DiffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// 最长公共子序列的长度，即最短编辑序列中相同行的数量
+func lcsLen(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else {
+				dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+			}
+		}
+	}
+	return dp[0][0]
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randLines := func() []string {
+		lines := make([]string, r.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a'+r.Intn(4))) + "\n"
+		}
+		return lines
+	}
+
+	for n := 0; n < 2000; n++ {
+		a, b := randLines(), randLines()
+		diff, err := DiffLines(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var oldLines, newLines []string
+		equal := 0
+		for i, l := range diff {
+			if l.Op != DiffInsert {
+				oldLines = append(oldLines, l.Text)
+			}
+			if l.Op != DiffDelete {
+				newLines = append(newLines, l.Text)
+			}
+			if l.Op == DiffEqual {
+				equal++
+			}
+			if l.Op == DiffInsert && i+1 < len(diff) && diff[i+1].Op == DiffDelete {
+				t.Fatalf("insert before delete in %q", formatDiff(diff))
+			}
+		}
+		if strings.Join(oldLines, "") != strings.Join(a, "") || strings.Join(newLines, "") != strings.Join(b, "") {
+			t.Fatalf("DiffLines(%q, %q) = %q does not reproduce the inputs", a, b, formatDiff(diff))
+		}
+		if want := lcsLen(a, b); equal != want {
+			t.Fatalf("DiffLines(%q, %q) keeps %d lines, want %d", a, b, equal, want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// 完全改写的大文件，线性空间的算法不会占用 O(D*(N+M)) 的内存
+	a, b := make([]string, 5000), make([]string, 5000)
+	for i := range a {
+		a[i] = "old " + string(rune('a'+i%26)) + "\n"
+		b[i] = "new " + string(rune('a'+i%26)) + "\n"
+	}
+	if diff, err := DiffLines(a, b); err != nil || len(diff) != len(a)+len(b) {
+		t.Errorf("DiffLines() = %d lines, %v, want %d", len(diff), err, len(a)+len(b))
+	}
+}
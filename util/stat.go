@@ -0,0 +1,51 @@
+package util
+
+import (
+	"os"
+)
+
+// 与平台无关的文件元数据，index 条目中记录的就是这些值。
+// 平台不提供的字段为 0，ctime 不可用时与 mtime 相同
+type FileStat struct {
+	CtimeSec  int64
+	CtimeNsec int64
+	MtimeSec  int64
+	MtimeNsec int64
+	Dev       int64
+	Ino       int64
+	Uid       int
+	Gid       int
+	Mode      os.FileMode
+	Size      int64
+}
+
+// 跟随符号链接
+func Stat(p string) (*FileStat, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStat(fi), nil
+}
+
+// 不跟随符号链接
+func Lstat(p string) (*FileStat, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStat(fi), nil
+}
+
+func NewFileStat(fi os.FileInfo) *FileStat {
+	mtime := fi.ModTime()
+	st := &FileStat{
+		MtimeSec:  mtime.Unix(),
+		MtimeNsec: int64(mtime.Nanosecond()),
+		Mode:      fi.Mode(),
+		Size:      fi.Size(),
+	}
+	st.CtimeSec, st.CtimeNsec = st.MtimeSec, st.MtimeNsec
+	fillSysStat(st, fi.Sys())
+	return st
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package util
+
+import "syscall"
+
+// macOS 和 BSD 的 Stat_t 使用 Ctimespec、Mtimespec
+func fillSysStat(st *FileStat, sys any) {
+	s, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	st.CtimeSec, st.CtimeNsec = int64(s.Ctimespec.Sec), int64(s.Ctimespec.Nsec)
+	st.MtimeSec, st.MtimeNsec = int64(s.Mtimespec.Sec), int64(s.Mtimespec.Nsec)
+	st.Dev, st.Ino = int64(s.Dev), int64(s.Ino)
+	st.Uid, st.Gid = int(s.Uid), int(s.Gid)
+}
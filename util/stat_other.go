@@ -0,0 +1,6 @@
+//go:build !(darwin || freebsd || netbsd || linux || openbsd || dragonfly || solaris)
+
+package util
+
+// 其他平台（例如 Windows）只有 os.FileInfo 中的 mtime 和大小
+func fillSysStat(st *FileStat, sys any) {}
@@ -0,0 +1,17 @@
+//go:build linux || openbsd || dragonfly || solaris
+
+package util
+
+import "syscall"
+
+// Linux 等平台的 Stat_t 使用 Ctim、Mtim
+func fillSysStat(st *FileStat, sys any) {
+	s, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	st.CtimeSec, st.CtimeNsec = int64(s.Ctim.Sec), int64(s.Ctim.Nsec)
+	st.MtimeSec, st.MtimeNsec = int64(s.Mtim.Sec), int64(s.Mtim.Nsec)
+	st.Dev, st.Ino = int64(s.Dev), int64(s.Ino)
+	st.Uid, st.Gid = int(s.Uid), int(s.Gid)
+}